@@ -58,6 +58,12 @@ func main() {
 	}
 
 	engine := pipeline.NewEngine(source, procs, sink, cfg.Pipeline.WorkerCount, cfg.Pipeline.BatchSize, cfg.Pipeline.BatchTimeout)
+	if cfg.Pipeline.DeadLetter != nil {
+		engine.DeadLetter, err = createDeadLetter(*cfg.Pipeline.DeadLetter)
+		if err != nil {
+			log.Fatalf("Failed to create dead letter: %v", err)
+		}
+	}
 	defer engine.Close()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -86,6 +92,30 @@ func createSource(cfg config.ComponentConfig) (pipeline.Source, error) {
 		topic := getString(cfg.Config, "topic")
 		groupID := getString(cfg.Config, "group_id")
 		return kafka.NewKafkaSource(brokers, topic, groupID), nil
+	case "elasticsearch":
+		client, err := createESClientConfig(cfg.Config)
+		if err != nil {
+			return nil, err
+		}
+		query, err := elasticsearch.LoadDefinition(cfg.Config["query"])
+		if err != nil {
+			return nil, fmt.Errorf("query: %w", err)
+		}
+		keepAlive, err := getDuration(cfg.Config, "keep_alive", 0)
+		if err != nil {
+			return nil, err
+		}
+		sort, _ := cfg.Config["sort"].([]interface{})
+		return elasticsearch.NewElasticsearchSource(elasticsearch.SourceConfig{
+			ClientConfig: client,
+			Index:        getString(cfg.Config, "index"),
+			Query:        query,
+			Mode:         getString(cfg.Config, "mode"),
+			Size:         getInt(cfg.Config, "size", 0),
+			KeepAlive:    keepAlive,
+			Sort:         sort,
+			Checkpoint:   getString(cfg.Config, "checkpoint"),
+		})
 	default:
 		return nil, fmt.Errorf("unknown source type: %s", cfg.Type)
 	}
@@ -108,22 +138,143 @@ func createSink(cfg config.ComponentConfig) (pipeline.Sink, error) {
 					fields = append(fields, sqlserver.FieldMapping{
 						Source: getString(fMap, "source"),
 						Target: getString(fMap, "target"),
+						Type:   getString(fMap, "type"),
 					})
 				}
 			}
 		}
-		return sqlserver.NewSQLServerSink(dsn, table, fields)
-	case "elasticsearch":
-		addresses := getStringSlice(cfg.Config, "addresses")
-		index := getString(cfg.Config, "index")
-		username := getString(cfg.Config, "username")
-		password := getString(cfg.Config, "password")
-		return elasticsearch.NewElasticsearchSink(addresses, index, username, password)
+		return sqlserver.NewSQLServerSink(sqlserver.Config{
+			DSN:              dsn,
+			Table:            table,
+			Fields:           fields,
+			Mode:             getString(cfg.Config, "mode"),
+			KeyColumns:       getStringSlice(cfg.Config, "key_columns"),
+			VersionColumn:    getString(cfg.Config, "version_column"),
+			DeleteField:      getString(cfg.Config, "delete_field"),
+			SoftDeleteColumn: getString(cfg.Config, "soft_delete_column"),
+			CreateTable:      getBool(cfg.Config, "create_table", false),
+			AddColumns:       getBool(cfg.Config, "add_columns", false),
+		})
+	case "elasticsearch", "opensearch":
+		backoff, err := getDuration(cfg.Config, "retry_backoff", 500*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		template, err := elasticsearch.LoadDefinition(cfg.Config["index_template"])
+		if err != nil {
+			return nil, fmt.Errorf("index_template: %w", err)
+		}
+		mappings, err := elasticsearch.LoadDefinition(cfg.Config["mappings"])
+		if err != nil {
+			return nil, fmt.Errorf("mappings: %w", err)
+		}
+		client, err := createESClientConfig(cfg.Config)
+		if err != nil {
+			return nil, err
+		}
+		esCfg := elasticsearch.Config{
+			ClientConfig:      client,
+			Index:             getString(cfg.Config, "index"),
+			IndexTime:         getString(cfg.Config, "index_time"),
+			TimestampField:    getString(cfg.Config, "timestamp_field"),
+			RequireAlias:      getBool(cfg.Config, "require_alias", false),
+			DataStream:        getBool(cfg.Config, "data_stream", false),
+			IndexTemplateName: getString(cfg.Config, "index_template_name"),
+			IndexTemplate:     template,
+			Mappings:          mappings,
+			IDField:           getString(cfg.Config, "id_field"),
+			OpType:            getString(cfg.Config, "op_type"),
+			Pipeline:          getString(cfg.Config, "pipeline"),
+			Routing:           getString(cfg.Config, "routing"),
+			MaxRetries:        getInt(cfg.Config, "max_retries", 3),
+			RetryBackoff:      backoff,
+			MaxBulkActions:    getInt(cfg.Config, "max_bulk_actions", 0),
+			MaxBulkBytes:      getInt(cfg.Config, "max_bulk_bytes", 0),
+			Concurrency:       getInt(cfg.Config, "concurrency", 0),
+			Compress:          getBool(cfg.Config, "compress", false),
+		}
+		if cfg.Type == "opensearch" {
+			return elasticsearch.NewOpenSearchSink(esCfg)
+		}
+		return elasticsearch.NewElasticsearchSink(esCfg)
+	case "router":
+		routes := make(map[string]pipeline.Sink)
+		for value, sub := range getMap(cfg.Config, "routes") {
+			sink, err := createNestedSink(sub)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", value, err)
+			}
+			routes[value] = sink
+		}
+		var def pipeline.Sink
+		if sub, ok := cfg.Config["default"]; ok {
+			sink, err := createNestedSink(sub)
+			if err != nil {
+				return nil, fmt.Errorf("default: %w", err)
+			}
+			def = sink
+		}
+		return pipeline.NewRouterSink(getString(cfg.Config, "key"), routes, def)
 	default:
 		return nil, fmt.Errorf("unknown sink type: %s", cfg.Type)
 	}
 }
 
+// createNestedSink creates a sink declared inside another, like the routes
+// of a router.
+func createNestedSink(v interface{}) (pipeline.Sink, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid sink: %v", v)
+	}
+	sub, _ := m["config"].(map[string]interface{})
+	return createSink(config.ComponentConfig{Type: getString(m, "type"), Config: sub})
+}
+
+// createESClientConfig reads the Elasticsearch connection options.
+func createESClientConfig(m map[string]interface{}) (elasticsearch.ClientConfig, error) {
+	timeout, err := getDuration(m, "request_timeout", 0)
+	if err != nil {
+		return elasticsearch.ClientConfig{}, err
+	}
+	sniffInterval, err := getDuration(m, "sniff_interval", 0)
+	if err != nil {
+		return elasticsearch.ClientConfig{}, err
+	}
+	return elasticsearch.ClientConfig{
+		Addresses:              getStringSlice(m, "addresses"),
+		CloudID:                getString(m, "cloud_id"),
+		Username:               getString(m, "username"),
+		Password:               getString(m, "password"),
+		APIKey:                 getString(m, "api_key"),
+		BearerToken:            getString(m, "bearer_token"),
+		CACert:                 getString(m, "ca_cert"),
+		CertificateFingerprint: getString(m, "certificate_fingerprint"),
+		ClientCert:             getString(m, "client_cert"),
+		ClientKey:              getString(m, "client_key"),
+		InsecureSkipVerify:     getBool(m, "insecure_skip_verify", false),
+		RequestTimeout:         timeout,
+		RetryOnStatus:          getIntSlice(m, "retry_on_status"),
+		DiscoverNodesOnStart:   getBool(m, "sniff_on_start", false),
+		DiscoverNodesInterval:  sniffInterval,
+		OpenSearch:             getBool(m, "opensearch", false),
+	}, nil
+}
+
+func createDeadLetter(cfg config.ComponentConfig) (pipeline.DeadLetter, error) {
+	switch cfg.Type {
+	case "kafka":
+		brokers := getStringSlice(cfg.Config, "brokers")
+		topic := getString(cfg.Config, "topic")
+		if topic == "" {
+			return nil, fmt.Errorf("kafka dead letter requires a topic")
+		}
+		return kafka.NewKafkaDeadLetter(brokers, topic), nil
+	default:
+		return nil, fmt.Errorf("unknown dead letter type: %s", cfg.Type)
+	}
+}
+
 // Helpers
 func getString(m map[string]interface{}, key string) string {
 	if v, ok := m[key]; ok {
@@ -147,3 +298,72 @@ func getStringSlice(m map[string]interface{}, key string) []string {
 	}
 	return res
 }
+
+// getMap reads a nested mapping, with YAML keys such as true or 1 as strings.
+func getMap(m map[string]interface{}, key string) map[string]interface{} {
+	switch v := m[key].(type) {
+	case map[string]interface{}:
+		return v
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			res[fmt.Sprint(k)] = item
+		}
+		return res
+	}
+	return nil
+}
+
+func getIntSlice(m map[string]interface{}, key string) []int {
+	var res []int
+	if slice, ok := m[key].([]interface{}); ok {
+		for _, item := range slice {
+			switch n := item.(type) {
+			case int:
+				res = append(res, n)
+			case float64:
+				res = append(res, int(n))
+			}
+		}
+	}
+	return res
+}
+
+func getInt(m map[string]interface{}, key string, def int) int {
+	if v, ok := m[key]; ok {
+		switch n := v.(type) {
+		case int:
+			return n
+		case float64:
+			return int(n)
+		}
+	}
+	return def
+}
+
+// getDuration accepts Go duration strings ("500ms") or numbers of seconds.
+func getDuration(m map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	switch v := m[key].(type) {
+	case nil:
+		return def, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration for '%s': %w", key, err)
+		}
+		return d, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	default:
+		return 0, fmt.Errorf("invalid duration for '%s': %v", key, v)
+	}
+}
+
+func getBool(m map[string]interface{}, key string, def bool) bool {
+	if b, ok := m[key].(bool); ok {
+		return b
+	}
+	return def
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"datapipeline/pkg/remote"
+
+	"google.golang.org/grpc"
+)
+
+// Servidor de referência do protocolo do processor `remote`, útil para
+// testar pipelines sem o serviço real.
+func main() {
+	httpAddr := flag.String("http", ":8081", "HTTP listen address (empty disables)")
+	grpcAddr := flag.String("grpc", ":9091", "gRPC listen address (empty disables)")
+	delay := flag.Duration("delay", 0, "Artificial latency per request")
+	flag.Parse()
+	if *httpAddr == "" && *grpcAddr == "" {
+		log.Fatal("Nothing to serve: both -http and -grpc are empty")
+	}
+
+	handler := remote.HandlerFunc(remote.MockHandler)
+	if *delay > 0 {
+		handler = func(ctx context.Context, req *remote.Request) (*remote.Response, error) {
+			select {
+			case <-time.After(*delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return remote.MockHandler(ctx, req)
+		}
+	}
+	handler = remote.Counting(handler, func(n int) {
+		log.Printf("Request with %d messages", n)
+	})
+
+	errs := make(chan error, 2)
+	if *httpAddr != "" {
+		go func() {
+			log.Printf("HTTP mock listening on %s", *httpAddr)
+			errs <- http.ListenAndServe(*httpAddr, remote.NewHTTPHandler(handler))
+		}()
+	}
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", *grpcAddr, err)
+		}
+		server := grpc.NewServer()
+		remote.RegisterGRPC(server, handler)
+		go func() {
+			log.Printf("gRPC mock listening on %s", *grpcAddr)
+			errs <- server.Serve(lis)
+		}()
+	}
+	log.Fatal(<-errs)
+}
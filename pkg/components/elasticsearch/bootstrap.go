@@ -0,0 +1,254 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"datapipeline/pkg/pipeline"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// LoadDefinition reads an index template or mappings definition given
+// inline (a map, as decoded from YAML) or as the path of a JSON file.
+func LoadDefinition(v interface{}) (map[string]interface{}, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return t, nil
+	case string:
+		data, err := os.ReadFile(t)
+		if err != nil {
+			return nil, err
+		}
+		var def map[string]interface{}
+		if err := json.Unmarshal(data, &def); err != nil {
+			return nil, fmt.Errorf("invalid JSON in %s: %w", t, err)
+		}
+		return def, nil
+	default:
+		return nil, fmt.Errorf("expected a map or a file path, got %T", v)
+	}
+}
+
+// bootstrap applies the configured index template and mappings. Both steps
+// are idempotent, so every instance can run them at startup:
+//   - the template is only (re)written when missing or older than the
+//     declared "version" (always when no version is declared)
+//   - mappings create the index when it doesn't exist and add missing
+//     fields to existing ones
+//
+// Declared fields whose live type differs are a conflict (ES cannot change
+// a field's type in place) and make bootstrap fail. Without explicit
+// mappings, the template's mappings are checked the same way.
+func (s *ElasticsearchSink) bootstrap(ctx context.Context) error {
+	if s.cfg.IndexTemplate != nil {
+		if err := s.applyTemplate(ctx); err != nil {
+			return err
+		}
+	}
+
+	declared := s.cfg.Mappings
+	if declared == nil {
+		tmpl, _ := s.cfg.IndexTemplate["template"].(map[string]interface{})
+		declared, _ = tmpl["mappings"].(map[string]interface{})
+	}
+	if declared == nil {
+		return nil
+	}
+	return s.applyMappings(ctx, declared, s.cfg.Mappings != nil)
+}
+
+func (s *ElasticsearchSink) applyTemplate(ctx context.Context) error {
+	name := s.cfg.IndexTemplateName
+	declared, hasVersion := s.cfg.IndexTemplate["version"].(float64)
+	if v, ok := s.cfg.IndexTemplate["version"].(int); ok {
+		declared, hasVersion = float64(v), true
+	}
+
+	if hasVersion {
+		res, err := s.client.Indices.GetIndexTemplate(
+			s.client.Indices.GetIndexTemplate.WithContext(ctx),
+			s.client.Indices.GetIndexTemplate.WithName(name),
+		)
+		if err != nil {
+			return fmt.Errorf("error getting index template %s: %s", name, err)
+		}
+		var live struct {
+			IndexTemplates []struct {
+				IndexTemplate struct {
+					Version *float64 `json:"version"`
+				} `json:"index_template"`
+			} `json:"index_templates"`
+		}
+		err = decode(res, &live)
+		if err != nil && res.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("error getting index template %s: %s", name, err)
+		}
+		if err == nil && len(live.IndexTemplates) > 0 {
+			if v := live.IndexTemplates[0].IndexTemplate.Version; v != nil && *v >= declared {
+				if *v > declared {
+					log.Printf("Index template %s has version %v, newer than the declared %v; keeping it", name, *v, declared)
+				}
+				return nil
+			}
+		}
+	}
+
+	body, err := json.Marshal(s.cfg.IndexTemplate)
+	if err != nil {
+		return fmt.Errorf("error marshaling index template %s: %s", name, err)
+	}
+	res, err := s.client.Indices.PutIndexTemplate(name, bytes.NewReader(body), s.client.Indices.PutIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error putting index template %s: %s", name, err)
+	}
+	if err := decode(res, nil); err != nil {
+		return fmt.Errorf("error putting index template %s: %s", name, err)
+	}
+	log.Printf("Index template %s applied.", name)
+	return nil
+}
+
+// applyMappings checks declared mappings against the live indices matching
+// the sink's index and, when manage is set, creates or extends them.
+func (s *ElasticsearchSink) applyMappings(ctx context.Context, declared map[string]interface{}, manage bool) error {
+	pattern := indexPattern(s.cfg.Index)
+	res, err := s.client.Indices.GetMapping(
+		s.client.Indices.GetMapping.WithContext(ctx),
+		s.client.Indices.GetMapping.WithIndex(pattern),
+		s.client.Indices.GetMapping.WithAllowNoIndices(true),
+		s.client.Indices.GetMapping.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return fmt.Errorf("error getting mappings of %s: %s", pattern, err)
+	}
+	live := map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}{}
+	if err := decode(res, &live); err != nil && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error getting mappings of %s: %s", pattern, err)
+	}
+
+	if len(live) == 0 {
+		if !manage || pattern != s.cfg.Index || s.cfg.DataStream || s.cfg.RequireAlias {
+			// Templated indices, data streams and aliases are created on first
+			// write (from the template) or by whoever manages the rollover
+			return nil
+		}
+		body, _ := json.Marshal(map[string]interface{}{"mappings": declared})
+		res, err := s.client.Indices.Create(s.cfg.Index,
+			s.client.Indices.Create.WithContext(ctx),
+			s.client.Indices.Create.WithBody(bytes.NewReader(body)),
+		)
+		if err != nil {
+			return fmt.Errorf("error creating index %s: %s", s.cfg.Index, err)
+		}
+		if err := decode(res, nil); err != nil && !strings.Contains(err.Error(), "resource_already_exists_exception") {
+			return fmt.Errorf("error creating index %s: %s", s.cfg.Index, err)
+		}
+		log.Printf("Index %s created with declared mappings.", s.cfg.Index)
+		return nil
+	}
+
+	names := make([]string, 0, len(live))
+	for name := range live {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conflicts []string
+	needsUpdate := false
+	for _, name := range names {
+		missing, conflict := compareMappings(declared, live[name].Mappings, "")
+		for _, c := range conflict {
+			conflicts = append(conflicts, name+": "+c)
+		}
+		needsUpdate = needsUpdate || len(missing) > 0
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("live mappings conflict with the declared ones: %s", strings.Join(conflicts, "; "))
+	}
+	if !manage || !needsUpdate {
+		return nil
+	}
+
+	body, _ := json.Marshal(declared)
+	res, err = s.client.Indices.PutMapping([]string{pattern}, bytes.NewReader(body), s.client.Indices.PutMapping.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error updating mappings of %s: %s", pattern, err)
+	}
+	if err := decode(res, nil); err != nil {
+		return fmt.Errorf("error updating mappings of %s: %s", pattern, err)
+	}
+	log.Printf("Mappings of %s updated with new fields.", pattern)
+	return nil
+}
+
+// compareMappings walks the declared properties and reports the fields
+// missing from live and the ones whose type differs.
+func compareMappings(declared, live map[string]interface{}, prefix string) (missing, conflicts []string) {
+	declaredProps, _ := declared["properties"].(map[string]interface{})
+	liveProps, _ := live["properties"].(map[string]interface{})
+
+	names := make([]string, 0, len(declaredProps))
+	for name := range declaredProps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		want, _ := declaredProps[name].(map[string]interface{})
+		got, exists := liveProps[name].(map[string]interface{})
+		if !exists {
+			missing = append(missing, prefix+name)
+			continue
+		}
+		if wt, gt := fieldType(want), fieldType(got); wt != gt {
+			conflicts = append(conflicts, fmt.Sprintf("field %s%s is %s, declared %s", prefix, name, gt, wt))
+			continue
+		}
+		m, c := compareMappings(want, got, prefix+name+".")
+		missing = append(missing, m...)
+		conflicts = append(conflicts, c...)
+	}
+	return missing, conflicts
+}
+
+func fieldType(def map[string]interface{}) string {
+	if t, ok := def["type"].(string); ok {
+		return t
+	}
+	return "object"
+}
+
+// indexPattern turns an index template into a wildcard pattern matching all
+// the indices it can produce.
+func indexPattern(index string) string {
+	pattern := datePlaceholder.ReplaceAllString(index, "*")
+	pattern = pipeline.Placeholder.ReplaceAllString(pattern, "*")
+	if pattern != index {
+		return strings.ToLower(pattern)
+	}
+	return index
+}
+
+// decode closes the response, returning its body as an error when ES
+// answered with one, or decoding it into v (if not nil) otherwise.
+func decode(res *esapi.Response, v interface{}) error {
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("%s", res.String())
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
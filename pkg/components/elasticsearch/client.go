@@ -0,0 +1,133 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// ClientConfig holds the connection options shared by the Elasticsearch
+// components.
+type ClientConfig struct {
+	// Addresses or CloudID (Elastic Cloud), not both
+	Addresses []string
+	CloudID   string
+
+	// Authentication: APIKey (base64 encoded "id:key") takes precedence over
+	// BearerToken (a service or OAuth token), which takes precedence over
+	// Username and Password.
+	Username    string
+	Password    string
+	APIKey      string
+	BearerToken string
+
+	// TLS: CACert, ClientCert and ClientKey are PEM file paths.
+	// CertificateFingerprint (the SHA-256 of the server or CA certificate, as
+	// printed by ES on first start) trusts that certificate alone, and
+	// InsecureSkipVerify disables verification, for development only.
+	CACert                 string
+	CertificateFingerprint string
+	ClientCert             string
+	ClientKey              string
+	InsecureSkipVerify     bool
+
+	// RequestTimeout bounds the wait for each response (0: no limit).
+	// Requests answered with a RetryOnStatus code (default 502, 503, 504)
+	// are retried on another node. DiscoverNodesOnStart and
+	// DiscoverNodesInterval enable node sniffing.
+	RequestTimeout        time.Duration
+	RetryOnStatus         []int
+	DiscoverNodesOnStart  bool
+	DiscoverNodesInterval time.Duration
+
+	// OpenSearch talks to OpenSearch (or another ES compatible API), which
+	// the Elasticsearch client refuses in its product check.
+	OpenSearch bool
+}
+
+// newClient creates a client with cfg's options.
+func newClient(cfg ClientConfig, compress bool) (*esapi.API, error) {
+	transport, err := cfg.transport()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.OpenSearch {
+		return newOpenSearchClient(cfg, compress, transport)
+	}
+	es, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses:             cfg.Addresses,
+		CloudID:               cfg.CloudID,
+		Username:              cfg.Username,
+		Password:              cfg.Password,
+		APIKey:                cfg.APIKey,
+		ServiceToken:          cfg.BearerToken,
+		RetryOnStatus:         cfg.RetryOnStatus,
+		DiscoverNodesOnStart:  cfg.DiscoverNodesOnStart,
+		DiscoverNodesInterval: cfg.DiscoverNodesInterval,
+		CompressRequestBody:   compress,
+		Transport:             transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the client: %s", err)
+	}
+	return es.API, nil
+}
+
+// transport builds the HTTP transport for the TLS and timeout options, or
+// returns nil (the client's default) when none is set.
+func (cfg ClientConfig) transport() (http.RoundTripper, error) {
+	if cfg.CACert == "" && cfg.CertificateFingerprint == "" && cfg.ClientCert == "" &&
+		!cfg.InsecureSkipVerify && cfg.RequestTimeout == 0 {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CertificateFingerprint != "" {
+		want, err := hex.DecodeString(strings.ReplaceAll(cfg.CertificateFingerprint, ":", ""))
+		if err != nil || len(want) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate fingerprint %q", cfg.CertificateFingerprint)
+		}
+		// The chain is checked against the fingerprint instead of the CAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				if sum := sha256.Sum256(raw); bytes.Equal(sum[:], want) {
+					return nil
+				}
+			}
+			return fmt.Errorf("no server certificate matches fingerprint %s", cfg.CertificateFingerprint)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ResponseHeaderTimeout = cfg.RequestTimeout
+	return transport, nil
+}
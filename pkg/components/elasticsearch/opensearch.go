@@ -0,0 +1,57 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/elastic/elastic-transport-go/v8/elastictransport"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// NewOpenSearchSink creates a sink writing to OpenSearch. It shares
+// everything with ElasticsearchSink (bulk building, IDs, index names,
+// templates): only the client skips the Elasticsearch product check.
+func NewOpenSearchSink(cfg Config) (*ElasticsearchSink, error) {
+	cfg.OpenSearch = true
+	return NewElasticsearchSink(cfg)
+}
+
+// newOpenSearchClient builds the API on a bare transport, as the
+// Elasticsearch client does minus its product check.
+func newOpenSearchClient(cfg ClientConfig, compress bool, transport http.RoundTripper) (*esapi.API, error) {
+	if cfg.CloudID != "" {
+		return nil, fmt.Errorf("cloud_id is only supported by Elasticsearch")
+	}
+	if len(cfg.Addresses) == 0 {
+		return nil, fmt.Errorf("opensearch requires addresses")
+	}
+	urls := make([]*url.URL, 0, len(cfg.Addresses))
+	for _, addr := range cfg.Addresses {
+		u, err := url.Parse(strings.TrimRight(addr, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %s", addr, err)
+		}
+		urls = append(urls, u)
+	}
+
+	tp, err := elastictransport.New(elastictransport.Config{
+		URLs:                  urls,
+		Username:              cfg.Username,
+		Password:              cfg.Password,
+		APIKey:                cfg.APIKey,
+		ServiceToken:          cfg.BearerToken,
+		RetryOnStatus:         cfg.RetryOnStatus,
+		CompressRequestBody:   compress,
+		DiscoverNodesInterval: cfg.DiscoverNodesInterval,
+		Transport:             transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating the client: %s", err)
+	}
+	if cfg.DiscoverNodesOnStart {
+		go tp.DiscoverNodes()
+	}
+	return esapi.New(tp), nil
+}
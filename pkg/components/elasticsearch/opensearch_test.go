@@ -0,0 +1,67 @@
+package elasticsearch
+
+import (
+	"context"
+	"datapipeline/pkg/pipeline"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenSearchSink(t *testing.T) {
+	mock := newMockES()
+	mock.opensearch = true
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	client := ClientConfig{Addresses: []string{server.URL}}
+	if _, err := NewElasticsearchSink(Config{ClientConfig: client, Index: "orders"}); err == nil {
+		t.Fatalf("expected the Elasticsearch client to refuse OpenSearch")
+	}
+
+	sink, err := NewOpenSearchSink(Config{
+		ClientConfig: client,
+		Index:        "orders-${Data.country}-%{+yyyy.MM}",
+		IDField:      "${topic}-${offset}",
+		OpType:       "create",
+		IndexTemplate: map[string]interface{}{
+			"index_patterns": []interface{}{"orders-*"},
+			"version":        1,
+		},
+		Compress: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mock.templates["orders"] == nil {
+		t.Errorf("expected the index template to be applied")
+	}
+
+	msgs := []pipeline.Message{
+		{ID: "1", Data: map[string]interface{}{"id": "1", "country": "BR"}, Metadata: map[string]string{"topic": "orders", "offset": "1"}},
+		{ID: "2", Data: map[string]interface{}{"id": "2", "country": "BR", "bad": true}, Metadata: map[string]string{"topic": "orders", "offset": "2"}},
+	}
+	err = sink.WriteBatch(context.Background(), msgs)
+	var partial *pipeline.PartialWriteError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Message.ID != "2" {
+		t.Fatalf("expected document 2 to be rejected, got %v", err)
+	}
+
+	meta := mock.actions[0]["create"]
+	wantIndex := "orders-br-" + time.Now().UTC().Format("2006.01")
+	if meta["_index"] != wantIndex || meta["_id"] != "orders-1" {
+		t.Errorf("unexpected bulk action: %v", meta)
+	}
+	if mock.gzipped != 1 {
+		t.Errorf("expected a gzipped bulk request")
+	}
+
+	// Redelivering the batch finds the document already written
+	if err := sink.WriteBatch(context.Background(), msgs[:1]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(mock.indexed) != 1 {
+		t.Errorf("expected a single indexed document, got %d", len(mock.indexed))
+	}
+}
@@ -6,25 +6,130 @@ import (
 	"datapipeline/pkg/pipeline"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
 )
 
+// Config configures the Elasticsearch sink.
+type Config struct {
+	ClientConfig
+
+	// Index may be a template with ${ref} placeholders (see IDField) and
+	// %{+yyyy.MM.dd} style dates, e.g. "orders-${Data.country}-%{+yyyy.MM.dd}".
+	// Dates come from TimestampField when IndexTime is "event", otherwise
+	// from the ingest time ("ingest", default).
+	Index          string
+	IndexTime      string
+	TimestampField string
+
+	// RequireAlias makes ES reject documents when Index is not an alias (e.g.
+	// a rollover write alias) instead of creating a concrete index with its
+	// name. DataStream writes to a data stream: documents are sent with
+	// op_type create and get a @timestamp (event or ingest time) if missing.
+	RequireAlias bool
+	DataStream   bool
+
+	// IndexTemplate (a composable index template body) and Mappings are
+	// applied at startup, see bootstrap. IndexTemplateName defaults to the
+	// static prefix of Index.
+	IndexTemplateName string
+	IndexTemplate     map[string]interface{}
+	Mappings          map[string]interface{}
+
+	// IDField sets the document _id from a dot path or a template such as
+	// "${topic}-${partition}-${offset}", making redeliveries idempotent.
+	// OpType is "index" (default), "create", "update" (partial update with
+	// doc_as_upsert) or "delete"; update and delete need IDField.
+	IDField string
+	OpType  string
+
+	// Pipeline runs documents through an ingest pipeline. Routing sets the
+	// shard routing from a dot path or template, as IDField.
+	Pipeline string
+	Routing  string
+
+	// Documents rejected with 429 or 503 are retried up to MaxRetries times,
+	// waiting RetryBackoff before the first retry and doubling it after.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// Batches are split into bulk requests of at most MaxBulkActions
+	// documents and MaxBulkBytes of body (keep it under the cluster's
+	// http.max_content_length), sent with up to Concurrency requests in
+	// flight. Compress gzips request bodies.
+	MaxBulkActions int
+	MaxBulkBytes   int
+	Concurrency    int
+	Compress       bool
+}
+
+// Bulk defaults, in line with the ES clients' bulk indexers.
+const (
+	defaultMaxBulkActions = 1000
+	defaultMaxBulkBytes   = 5 << 20
+	defaultConcurrency    = 2
+)
+
+// bufferPool recycles bulk request bodies across batches.
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
 type ElasticsearchSink struct {
-	client *elasticsearch.Client
-	index  string
+	client *esapi.API
+	cfg    Config
 }
 
-func NewElasticsearchSink(addresses []string, index, username, password string) (*ElasticsearchSink, error) {
-	cfg := elasticsearch.Config{
-		Addresses: addresses,
-		Username:  username,
-		Password:  password,
+func NewElasticsearchSink(cfg Config) (*ElasticsearchSink, error) {
+	if cfg.DataStream {
+		if cfg.OpType != "" && cfg.OpType != "create" {
+			return nil, fmt.Errorf("data streams only accept op_type create, got %q", cfg.OpType)
+		}
+		cfg.OpType = "create"
+	}
+	if cfg.TimestampField == "" {
+		cfg.TimestampField = "@timestamp"
+	}
+	switch cfg.IndexTime {
+	case "":
+		cfg.IndexTime = "ingest"
+	case "ingest", "event":
+	default:
+		return nil, fmt.Errorf("unknown index_time %q", cfg.IndexTime)
+	}
+	if cfg.IndexTemplate != nil && cfg.IndexTemplateName == "" {
+		prefix, _, _ := strings.Cut(indexPattern(cfg.Index), "*")
+		if cfg.IndexTemplateName = strings.Trim(prefix, "-_."); cfg.IndexTemplateName == "" {
+			return nil, fmt.Errorf("index_template requires index_template_name")
+		}
+	}
+	switch cfg.OpType {
+	case "":
+		cfg.OpType = "index"
+	case "index", "create":
+	case "update", "delete":
+		if cfg.IDField == "" {
+			return nil, fmt.Errorf("op_type %q requires id_field", cfg.OpType)
+		}
+	default:
+		return nil, fmt.Errorf("unknown op_type %q", cfg.OpType)
+	}
+
+	if cfg.MaxBulkActions <= 0 {
+		cfg.MaxBulkActions = defaultMaxBulkActions
 	}
-	es, err := elasticsearch.NewClient(cfg)
+	if cfg.MaxBulkBytes <= 0 {
+		cfg.MaxBulkBytes = defaultMaxBulkBytes
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+
+	es, err := newClient(cfg.ClientConfig, cfg.Compress)
 	if err != nil {
-		return nil, fmt.Errorf("error creating the client: %s", err)
+		return nil, err
 	}
 
 	// Verify connection
@@ -38,65 +143,291 @@ func NewElasticsearchSink(addresses []string, index, username, password string)
 		return nil, fmt.Errorf("error: %s", res.String())
 	}
 
-	return &ElasticsearchSink{
+	s := &ElasticsearchSink{
 		client: es,
-		index:  index,
-	}, nil
+		cfg:    cfg,
+	}
+	if err := s.bootstrap(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
+// Write indexes a single message, with the same options as WriteBatch.
 func (s *ElasticsearchSink) Write(ctx context.Context, msg pipeline.Message) error {
-	data, err := json.Marshal(msg.Data)
+	return s.WriteBatch(ctx, []pipeline.Message{msg})
+}
+
+// bulkItem is one message encoded as its bulk action and document lines.
+type bulkItem struct {
+	msg   pipeline.Message
+	index int // Position in the batch
+	lines []byte
+}
+
+// bulkResponse holds the parts of the bulk response we need (see filter_path).
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// WriteBatch indexes msgs with the bulk API, split into bulk requests by
+// MaxBulkActions and MaxBulkBytes and sent concurrently. ES answers 200 even
+// when single documents are rejected, so every item's status is checked: documents
+// rejected with 429/503 are retried, and documents rejected for good (e.g.
+// mapping conflicts) are returned in a *pipeline.PartialWriteError with the
+// ES reason, so the engine can dead-letter them. When retryable rejections
+// remain after MaxRetries, the batch fails as a whole.
+func (s *ElasticsearchSink) WriteBatch(ctx context.Context, msgs []pipeline.Message) error {
+	var pending []bulkItem
+	var failed []pipeline.FailedMessage
+	now := time.Now()
+	for i, msg := range msgs {
+		lines, err := s.encode(msg, now)
+		if err != nil {
+			failed = append(failed, pipeline.FailedMessage{Message: msg, Index: i, Reason: err.Error()})
+			continue
+		}
+		pending = append(pending, bulkItem{msg: msg, index: i, lines: lines})
+	}
+
+	backoff := s.cfg.RetryBackoff
+	for attempt := 0; len(pending) > 0; attempt++ {
+		retry, rejected, reason, err := s.bulkAll(ctx, pending)
+		if err != nil {
+			return err
+		}
+		failed = append(failed, rejected...)
+		if len(retry) == 0 {
+			break
+		}
+		if attempt >= s.cfg.MaxRetries {
+			return fmt.Errorf("error performing bulk index: %d documents still rejected after %d retries: %s", len(retry), attempt, reason)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		pending = retry
+	}
+
+	if len(failed) > 0 {
+		return &pipeline.PartialWriteError{Failed: failed}
+	}
+	return nil
+}
+
+// encode builds the bulk action line for msg and, except for deletes, its
+// document line.
+func (s *ElasticsearchSink) encode(msg pipeline.Message, now time.Time) ([]byte, error) {
+	// Ingest time is taken once per batch, so a batch never straddles indices
+	ts := now
+	if s.cfg.IndexTime == "event" {
+		v := pipeline.GetValue(msg.Data, s.cfg.TimestampField)
+		if v == nil {
+			return nil, fmt.Errorf("missing event time field %q", s.cfg.TimestampField)
+		}
+		var err error
+		if ts, err = parseTime(v); err != nil {
+			return nil, fmt.Errorf("invalid event time field %q: %s", s.cfg.TimestampField, err)
+		}
+	}
+
+	index := s.cfg.Index
+	if strings.Contains(index, "${") || strings.Contains(index, "%{") {
+		var err error
+		if index, err = indexName(index, msg, ts); err != nil {
+			return nil, err
+		}
+	}
+	meta := map[string]interface{}{"_index": index}
+	if s.cfg.RequireAlias {
+		meta["require_alias"] = true
+	}
+	if s.cfg.IDField != "" {
+		id, ok := render(s.cfg.IDField, msg)
+		if ok && id != "" {
+			meta["_id"] = id
+		} else if s.cfg.OpType == "update" || s.cfg.OpType == "delete" {
+			return nil, fmt.Errorf("missing document id for %s (id_field %q)", s.cfg.OpType, s.cfg.IDField)
+		}
+	}
+	if s.cfg.Routing != "" {
+		routing, ok := render(s.cfg.Routing, msg)
+		if !ok || routing == "" {
+			return nil, fmt.Errorf("missing routing (routing %q)", s.cfg.Routing)
+		}
+		meta["routing"] = routing
+	}
+	action, err := json.Marshal(map[string]interface{}{s.cfg.OpType: meta})
 	if err != nil {
-		return fmt.Errorf("error marshaling document: %s", err)
+		return nil, fmt.Errorf("error marshaling bulk action: %s", err)
+	}
+	lines := append(action, '\n')
+	if s.cfg.OpType == "delete" {
+		return lines, nil
 	}
 
-	res, err := s.client.Index(
-		s.index,
-		bytes.NewReader(data),
-		s.client.Index.WithContext(ctx),
-	)
+	var doc interface{} = msg.Data
+	if s.cfg.DataStream && pipeline.GetValue(msg.Data, "@timestamp") == nil {
+		withTS := make(map[string]interface{}, len(msg.Data)+1)
+		for k, v := range msg.Data {
+			withTS[k] = v
+		}
+		withTS["@timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+		doc = withTS
+	}
+	if s.cfg.OpType == "update" {
+		doc = map[string]interface{}{"doc": msg.Data, "doc_as_upsert": true}
+	}
+	data, err := json.Marshal(doc)
 	if err != nil {
-		return fmt.Errorf("error indexing document: %s", err)
+		return nil, fmt.Errorf("error marshaling document: %s", err)
 	}
-	defer res.Body.Close()
+	lines = append(lines, data...)
+	return append(lines, '\n'), nil
+}
 
-	if res.IsError() {
-		return fmt.Errorf("error indexing document: %s", res.String())
+// bulkAll sends items in bulk requests of at most MaxBulkActions documents
+// and MaxBulkBytes, with up to Concurrency requests in flight, and merges
+// their results in batch order. A document larger than MaxBulkBytes is sent
+// on its own.
+func (s *ElasticsearchSink) bulkAll(ctx context.Context, items []bulkItem) (retry []bulkItem, rejected []pipeline.FailedMessage, reason string, err error) {
+	var chunks [][]bulkItem
+	start, size := 0, 0
+	for i, item := range items {
+		if i > start && (i-start >= s.cfg.MaxBulkActions || size+len(item.lines) > s.cfg.MaxBulkBytes) {
+			chunks = append(chunks, items[start:i])
+			start, size = i, 0
+		}
+		size += len(item.lines)
+	}
+	chunks = append(chunks, items[start:])
+	if len(chunks) == 1 {
+		return s.bulk(ctx, chunks[0])
 	}
 
-	return nil
-}
+	type result struct {
+		retry    []bulkItem
+		rejected []pipeline.FailedMessage
+		reason   string
+		err      error
+	}
+	results := make([]result, len(chunks))
+	sem := make(chan struct{}, s.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chunk []bulkItem) {
+			defer func() { <-sem; wg.Done() }()
+			r := &results[i]
+			r.retry, r.rejected, r.reason, r.err = s.bulk(ctx, chunk)
+		}(i, chunk)
+	}
+	wg.Wait()
 
-func (s *ElasticsearchSink) WriteBatch(ctx context.Context, msgs []pipeline.Message) error {
-	var buf bytes.Buffer
-	for _, msg := range msgs {
-		meta := []byte(fmt.Sprintf(`{ "index" : { "_index" : "%s" } }%s`, s.index, "\n"))
-		data, err := json.Marshal(msg.Data)
-		if err != nil {
-			log.Printf("Error marshaling message %s: %v", msg.ID, err)
-			continue
+	for _, r := range results {
+		if r.err != nil {
+			// Other chunks may have been written: the batch is redelivered
+			// as a whole, which IDField makes idempotent
+			return nil, nil, "", r.err
+		}
+		retry = append(retry, r.retry...)
+		rejected = append(rejected, r.rejected...)
+		if r.reason != "" {
+			reason = r.reason
 		}
-		data = append(data, "\n"...)
-		buf.Grow(len(meta) + len(data))
-		buf.Write(meta)
-		buf.Write(data)
 	}
+	return retry, rejected, reason, nil
+}
 
-	if buf.Len() == 0 {
-		return nil
+// bulk sends items in one bulk request and splits them into items to retry
+// and items rejected permanently. reason describes the last retryable error.
+func (s *ElasticsearchSink) bulk(ctx context.Context, items []bulkItem) (retry []bulkItem, rejected []pipeline.FailedMessage, reason string, err error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+	for _, item := range items {
+		buf.Write(item.lines)
 	}
 
-	res, err := s.client.Bulk(bytes.NewReader(buf.Bytes()), s.client.Bulk.WithContext(ctx))
+	opts := []func(*esapi.BulkRequest){
+		s.client.Bulk.WithContext(ctx),
+		s.client.Bulk.WithFilterPath("errors", "items.*.status", "items.*.error"),
+	}
+	if s.cfg.Pipeline != "" {
+		opts = append(opts, s.client.Bulk.WithPipeline(s.cfg.Pipeline))
+	}
+	res, err := s.client.Bulk(bytes.NewReader(buf.Bytes()), opts...)
 	if err != nil {
-		return fmt.Errorf("error performing bulk index: %s", err)
+		return nil, nil, "", fmt.Errorf("error performing bulk index: %s", err)
 	}
 	defer res.Body.Close()
 
+	if retryable(res.StatusCode) {
+		return items, nil, res.Status(), nil
+	}
 	if res.IsError() {
-		return fmt.Errorf("error performing bulk index: %s", res.String())
+		return nil, nil, "", fmt.Errorf("error performing bulk index: %s", res.String())
 	}
 
-	return nil
+	var body bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, nil, "", fmt.Errorf("error parsing bulk response: %s", err)
+	}
+	if !body.Errors {
+		return nil, nil, "", nil
+	}
+	if len(body.Items) != len(items) {
+		return nil, nil, "", fmt.Errorf("error parsing bulk response: %d items for %d documents", len(body.Items), len(items))
+	}
+
+	for i, entry := range body.Items {
+		// Each entry has a single key, the action ("index", "create", ...)
+		for _, result := range entry {
+			if result.Error == nil && result.Status < 300 || s.alreadyApplied(result.Status) {
+				continue
+			}
+			why := http.StatusText(result.Status)
+			if result.Error != nil {
+				why = fmt.Sprintf("%s: %s", result.Error.Type, result.Error.Reason)
+			}
+			if retryable(result.Status) {
+				retry = append(retry, items[i])
+				reason = why
+				continue
+			}
+			rejected = append(rejected, pipeline.FailedMessage{
+				Message: items[i].msg,
+				Index:   items[i].index,
+				Reason:  fmt.Sprintf("status %d: %s", result.Status, why),
+			})
+		}
+	}
+	return retry, rejected, reason, nil
+}
+
+// alreadyApplied reports whether a rejected item means a replay found its
+// work done: create hits an existing document, delete a missing one.
+func (s *ElasticsearchSink) alreadyApplied(status int) bool {
+	return s.cfg.OpType == "create" && status == http.StatusConflict ||
+		s.cfg.OpType == "delete" && status == http.StatusNotFound
+}
+
+// retryable reports whether ES rejected a request or document for lack of
+// capacity, rather than because of its content.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
 }
 
 func (s *ElasticsearchSink) Close() error {
@@ -0,0 +1,496 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"datapipeline/pkg/pipeline"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// mockES serves the info and bulk APIs. Documents with "bad" are rejected
+// with a mapping error, documents with "busy" get a 429 the first time. With
+// opensearch set it answers as OpenSearch does, without the product header.
+type mockES struct {
+	mu         sync.Mutex
+	opensearch bool
+	busySeen   map[string]bool
+	indexed    []map[string]interface{}
+	actions    []map[string]map[string]interface{}
+	ids        map[string]bool
+	requests   int
+	gzipped    int
+	auth       string
+	pipeline   string
+
+	inFlight, maxInFlight int32
+
+	templates    map[string]map[string]interface{}
+	templatePuts int
+	mappings     map[string]map[string]interface{} // Index -> mappings
+}
+
+func newMockES() *mockES {
+	return &mockES{
+		busySeen:  map[string]bool{},
+		ids:       map[string]bool{},
+		templates: map[string]map[string]interface{}{},
+		mappings:  map[string]map[string]interface{}{},
+	}
+}
+
+// serveAdmin handles the index template and mapping APIs used at startup.
+func (m *mockES) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var body map[string]interface{}
+	json.NewDecoder(requestBody(r)).Decode(&body)
+
+	switch {
+	case parts[0] == "_index_template" && r.Method == http.MethodGet:
+		tmpl, ok := m.templates[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not found","status":404}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"index_templates": []interface{}{
+			map[string]interface{}{"name": parts[1], "index_template": tmpl},
+		}})
+	case parts[0] == "_index_template" && r.Method == http.MethodPut:
+		m.templates[parts[1]] = body
+		m.templatePuts++
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case len(parts) == 2 && parts[1] == "_mapping" && r.Method == http.MethodGet:
+		out := map[string]interface{}{}
+		for index, mappings := range m.mappings {
+			if ok, _ := path.Match(parts[0], index); ok {
+				out[index] = map[string]interface{}{"mappings": mappings}
+			}
+		}
+		json.NewEncoder(w).Encode(out)
+	case len(parts) == 2 && parts[1] == "_mapping" && r.Method == http.MethodPut:
+		for index, mappings := range m.mappings {
+			if ok, _ := path.Match(parts[0], index); ok {
+				props := mappings["properties"].(map[string]interface{})
+				for k, v := range body["properties"].(map[string]interface{}) {
+					props[k] = v
+				}
+			}
+		}
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		m.mappings[parts[0]] = body["mappings"].(map[string]interface{})
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *mockES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if m.opensearch {
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `{"version":{"distribution":"opensearch","number":"2.13.0"},"tagline":"The OpenSearch Project: https://opensearch.org/"}`)
+			return
+		}
+	} else {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `{"version":{"number":"8.19.0"},"tagline":"You Know, for Search"}`)
+			return
+		}
+	}
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		m.serveAdmin(w, r)
+		return
+	}
+
+	n := atomic.AddInt32(&m.inFlight, 1)
+	defer atomic.AddInt32(&m.inFlight, -1)
+	for max := atomic.LoadInt32(&m.maxInFlight); n > max && !atomic.CompareAndSwapInt32(&m.maxInFlight, max, n); {
+		max = atomic.LoadInt32(&m.maxInFlight)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	m.auth = r.Header.Get("Authorization")
+	m.pipeline = r.URL.Query().Get("pipeline")
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		m.gzipped++
+	}
+	body := requestBody(r)
+
+	var items []map[string]interface{}
+	errs := false
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		// Action line, then document line (except for deletes)
+		var action map[string]map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &action)
+		m.actions = append(m.actions, action)
+		if _, isDelete := action["delete"]; isDelete {
+			items = append(items, map[string]interface{}{"delete": map[string]interface{}{"status": 200}})
+			continue
+		}
+		if !scanner.Scan() {
+			break
+		}
+		var doc map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &doc)
+		id, _ := doc["id"].(string)
+
+		result := map[string]interface{}{"status": 201}
+		var docID string
+		if create, ok := action["create"]; ok {
+			docID, _ = create["_id"].(string)
+		}
+		switch {
+		case docID != "" && m.ids[docID]:
+			errs = true
+			result = map[string]interface{}{"status": 409, "error": map[string]interface{}{
+				"type": "version_conflict_engine_exception", "reason": "document already exists",
+			}}
+		case doc["bad"] != nil:
+			errs = true
+			result = map[string]interface{}{"status": 400, "error": map[string]interface{}{
+				"type": "mapper_parsing_exception", "reason": "failed to parse field [bad]",
+			}}
+		case doc["busy"] != nil && !m.busySeen[id]:
+			errs = true
+			m.busySeen[id] = true
+			result = map[string]interface{}{"status": 429, "error": map[string]interface{}{
+				"type": "es_rejected_execution_exception", "reason": "rejected execution",
+			}}
+		default:
+			m.indexed = append(m.indexed, doc)
+			if docID != "" {
+				m.ids[docID] = true
+			}
+		}
+		items = append(items, map[string]interface{}{"index": result})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs, "items": items})
+}
+
+// requestBody returns the body of r, decompressed when gzipped.
+func requestBody(r *http.Request) io.Reader {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(r.Body); err == nil {
+			return zr
+		}
+	}
+	return r.Body
+}
+
+func TestWriteBatchItemErrors(t *testing.T) {
+	mock := newMockES()
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	sink, err := NewElasticsearchSink(Config{ClientConfig: ClientConfig{Addresses: []string{server.URL}}, Index: "orders", MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msgs := []pipeline.Message{
+		{ID: "1", Data: map[string]interface{}{"id": "1"}},
+		{ID: "2", Data: map[string]interface{}{"id": "2", "bad": true}},
+		{ID: "3", Data: map[string]interface{}{"id": "3", "busy": true}},
+	}
+	err = sink.WriteBatch(context.Background(), msgs)
+
+	var partial *pipeline.PartialWriteError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a partial write error, got %v", err)
+	}
+	if len(partial.Failed) != 1 || partial.Failed[0].Index != 1 || partial.Failed[0].Message.ID != "2" {
+		t.Fatalf("unexpected failed messages: %+v", partial.Failed)
+	}
+	if !strings.Contains(partial.Failed[0].Reason, "mapper_parsing_exception") {
+		t.Errorf("expected the ES reason, got %q", partial.Failed[0].Reason)
+	}
+	if len(mock.indexed) != 2 || mock.requests != 2 {
+		t.Errorf("expected the busy document to be retried once, got %d docs in %d requests", len(mock.indexed), mock.requests)
+	}
+
+	// Retryable rejections that outlast MaxRetries fail the whole batch
+	sink.cfg.MaxRetries = 0
+	err = sink.WriteBatch(context.Background(), []pipeline.Message{{ID: "4", Data: map[string]interface{}{"id": "4", "busy": true}}})
+	if err == nil || errors.As(err, &partial) {
+		t.Errorf("expected a batch error, got %v", err)
+	}
+
+	if err := sink.WriteBatch(context.Background(), msgs[:1]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWriteBatchIDs(t *testing.T) {
+	mock := newMockES()
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	sink, err := NewElasticsearchSink(Config{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+		IDField:      "${topic}-${partition}-${offset}",
+		OpType:       "create",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg := pipeline.Message{
+		Data:     map[string]interface{}{"order": map[string]interface{}{"id": 7.0}},
+		Metadata: map[string]string{"topic": "orders", "partition": "0", "offset": "42"},
+	}
+
+	// A replay of the same message is accepted without a second document
+	for i := 0; i < 2; i++ {
+		if err := sink.WriteBatch(context.Background(), []pipeline.Message{msg}); err != nil {
+			t.Fatalf("unexpected error on write %d: %v", i, err)
+		}
+	}
+	if len(mock.indexed) != 1 || mock.actions[0]["create"]["_id"] != "orders-0-42" {
+		t.Errorf("unexpected writes: %v %v", mock.indexed, mock.actions)
+	}
+
+	sink.cfg.OpType, sink.cfg.IDField = "update", "order.id"
+	if err := sink.Write(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	last := mock.indexed[len(mock.indexed)-1]
+	if mock.actions[len(mock.actions)-1]["update"]["_id"] != "7" || last["doc_as_upsert"] != true {
+		t.Errorf("unexpected update: %v %v", mock.actions[len(mock.actions)-1], last)
+	}
+
+	sink.cfg.OpType = "delete"
+	err = sink.WriteBatch(context.Background(), []pipeline.Message{msg, {ID: "no-id", Data: map[string]interface{}{}}})
+	var partial *pipeline.PartialWriteError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Index != 1 {
+		t.Errorf("expected the message without id to fail, got %v", err)
+	}
+	if _, ok := mock.actions[len(mock.actions)-1]["delete"]; !ok {
+		t.Errorf("expected a delete action, got %v", mock.actions[len(mock.actions)-1])
+	}
+
+	if _, err := NewElasticsearchSink(Config{ClientConfig: ClientConfig{Addresses: []string{server.URL}}, OpType: "update"}); err == nil {
+		t.Error("expected update without id_field to fail")
+	}
+}
+
+func TestWriteBatchIndexNames(t *testing.T) {
+	mock := newMockES()
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	sink, err := NewElasticsearchSink(Config{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders-${Data.country}-%{+yyyy.MM.dd}",
+		IndexTime:    "event",
+		RequireAlias: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msgs := []pipeline.Message{
+		{Data: map[string]interface{}{"country": "BR", "@timestamp": "2024-03-05T23:10:00Z"}},
+		{Data: map[string]interface{}{"country": "us", "@timestamp": 1709856000000.0}}, // 2024-03-08
+		{Data: map[string]interface{}{"@timestamp": "2024-03-05T23:10:00Z"}},
+	}
+	err = sink.WriteBatch(context.Background(), msgs)
+	var partial *pipeline.PartialWriteError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Index != 2 {
+		t.Fatalf("expected the message without country to fail, got %v", err)
+	}
+	if got := mock.actions[0]["index"]; got["_index"] != "orders-br-2024.03.05" || got["require_alias"] != true {
+		t.Errorf("unexpected action: %v", got)
+	}
+	if got := mock.actions[1]["index"]["_index"]; got != "orders-us-2024.03.08" {
+		t.Errorf("unexpected index: %v", got)
+	}
+
+	ds, err := NewElasticsearchSink(Config{ClientConfig: ClientConfig{Addresses: []string{server.URL}}, Index: "logs-app-default", DataStream: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ds.WriteBatch(context.Background(), []pipeline.Message{{Data: map[string]interface{}{"msg": "hi"}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	last := mock.indexed[len(mock.indexed)-1]
+	if _, ok := mock.actions[len(mock.actions)-1]["create"]; !ok || last["@timestamp"] == nil {
+		t.Errorf("expected a create with @timestamp, got %v %v", mock.actions[len(mock.actions)-1], last)
+	}
+
+	if _, err := NewElasticsearchSink(Config{ClientConfig: ClientConfig{Addresses: []string{server.URL}}, DataStream: true, OpType: "index"}); err == nil {
+		t.Error("expected data stream with op_type index to fail")
+	}
+}
+
+func TestWriteBatchSplit(t *testing.T) {
+	mock := newMockES()
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	sink, err := NewElasticsearchSink(Config{
+		ClientConfig:   ClientConfig{Addresses: []string{server.URL}},
+		Index:          "orders",
+		MaxBulkActions: 3,
+		Concurrency:    2,
+		Compress:       true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var msgs []pipeline.Message
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprint(i)
+		data := map[string]interface{}{"id": id}
+		if i == 7 {
+			data["bad"] = true
+		}
+		msgs = append(msgs, pipeline.Message{ID: id, Data: data})
+	}
+	err = sink.WriteBatch(context.Background(), msgs)
+	var partial *pipeline.PartialWriteError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Index != 7 {
+		t.Fatalf("expected document 7 to fail, got %v", err)
+	}
+	if mock.requests != 4 || mock.gzipped != 4 || len(mock.indexed) != 9 {
+		t.Errorf("expected 4 gzipped bulks with 9 documents, got %d (%d gzipped) with %d", mock.requests, mock.gzipped, len(mock.indexed))
+	}
+	if mock.maxInFlight > 2 {
+		t.Errorf("expected at most 2 bulks in flight, got %d", mock.maxInFlight)
+	}
+
+	// Byte limit: each document line is ~12 bytes plus its action line
+	mock.requests = 0
+	sink.cfg.MaxBulkActions = 1000
+	sink.cfg.MaxBulkBytes = 100
+	if err := sink.WriteBatch(context.Background(), msgs[:6]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mock.requests < 2 {
+		t.Errorf("expected the batch to be split by size, got %d requests", mock.requests)
+	}
+}
+
+func TestConnectionOptions(t *testing.T) {
+	mock := newMockES()
+	server := httptest.NewTLSServer(mock)
+	defer server.Close()
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	client := ClientConfig{
+		Addresses:              []string{server.URL},
+		APIKey:                 "a2V5",
+		CertificateFingerprint: hex.EncodeToString(sum[:]),
+	}
+	sink, err := NewElasticsearchSink(Config{
+		ClientConfig: client,
+		Index:        "orders",
+		Pipeline:     "enrich",
+		Routing:      "${Data.customer}",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msgs := []pipeline.Message{
+		{ID: "1", Data: map[string]interface{}{"id": "1", "customer": "c1"}},
+		{ID: "2", Data: map[string]interface{}{"id": "2"}},
+	}
+	err = sink.WriteBatch(context.Background(), msgs)
+	var partial *pipeline.PartialWriteError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Index != 1 {
+		t.Fatalf("expected the document without routing to fail, got %v", err)
+	}
+	if got := mock.actions[0]["index"]["routing"]; got != "c1" {
+		t.Errorf("expected routing c1, got %v", got)
+	}
+	if mock.pipeline != "enrich" || mock.auth != "APIKey a2V5" {
+		t.Errorf("expected pipeline enrich and API key auth, got %q and %q", mock.pipeline, mock.auth)
+	}
+
+	// Untrusted certificates are refused unless verification is disabled
+	client.CertificateFingerprint = strings.Repeat("00", sha256.Size)
+	if _, err := NewElasticsearchSink(Config{ClientConfig: client, Index: "orders"}); err == nil {
+		t.Errorf("expected a fingerprint mismatch error")
+	}
+	client.CertificateFingerprint = ""
+	if _, err := NewElasticsearchSink(Config{ClientConfig: client, Index: "orders"}); err == nil {
+		t.Errorf("expected a certificate verification error")
+	}
+	client.InsecureSkipVerify = true
+	if _, err := NewElasticsearchSink(Config{ClientConfig: client, Index: "orders"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	mock := newMockES()
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	cfg := Config{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+		IndexTemplate: map[string]interface{}{
+			"index_patterns": []interface{}{"orders*"},
+			"version":        1,
+		},
+		Mappings: map[string]interface{}{"properties": map[string]interface{}{
+			"Amount": map[string]interface{}{"type": "double"},
+		}},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := NewElasticsearchSink(cfg); err != nil {
+			t.Fatalf("unexpected error on start %d: %v", i, err)
+		}
+	}
+	if mock.templatePuts != 1 || mock.templates["orders"] == nil {
+		t.Errorf("expected the template to be applied once, got %d puts", mock.templatePuts)
+	}
+	if got := fieldTypeOf(mock.mappings["orders"], "Amount"); got != "double" {
+		t.Errorf("expected the index to be created with Amount as double, got %q", got)
+	}
+
+	// New declared fields are added to the live index
+	cfg.Mappings["properties"].(map[string]interface{})["country"] = map[string]interface{}{"type": "keyword"}
+	if _, err := NewElasticsearchSink(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := fieldTypeOf(mock.mappings["orders"], "country"); got != "keyword" {
+		t.Errorf("expected country to be added, got %q", got)
+	}
+
+	// A live field with another type refuses to start
+	mock.mappings["orders"]["properties"].(map[string]interface{})["Amount"] = map[string]interface{}{"type": "long"}
+	if _, err := NewElasticsearchSink(cfg); err == nil || !strings.Contains(err.Error(), "Amount is long, declared double") {
+		t.Errorf("expected a mapping conflict, got %v", err)
+	}
+}
+
+// fieldTypeOf returns the type of a top level field in mappings.
+func fieldTypeOf(mappings map[string]interface{}, field string) string {
+	props, _ := mappings["properties"].(map[string]interface{})
+	def, _ := props[field].(map[string]interface{})
+	t, _ := def["type"].(string)
+	return t
+}
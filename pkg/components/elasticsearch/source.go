@@ -0,0 +1,446 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"datapipeline/pkg/pipeline"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// SourceConfig configures the Elasticsearch source.
+type SourceConfig struct {
+	ClientConfig
+
+	// Index (a name, alias or pattern) is read whole, or the documents
+	// matching Query (a query DSL clause such as {"range": {...}}).
+	Index string
+	Query map[string]interface{}
+
+	// Mode is "pit" (point in time + search_after), "scroll" or "auto"
+	// (default: pit, falling back to scroll when the cluster lacks it).
+	// Pages of Size hits (default 1000) are read, keeping the search
+	// context alive for KeepAlive (default 5m) between pages.
+	Mode      string
+	Size      int
+	KeepAlive time.Duration
+
+	// Sort defaults to index order, which is only stable within a point in
+	// time. Set it to fields ending with a unique one (e.g.
+	// [{"@timestamp": "asc"}, {"id": "asc"}]) to resume a reindex whose point
+	// in time expired, or a scroll (resumed with search_after).
+	Sort []interface{}
+
+	// Checkpoint is the path of a file where progress is saved on Commit. A
+	// restarted reindex resumes after the last committed document, or starts
+	// over when its position can't be restored (see Sort).
+	Checkpoint string
+}
+
+// checkpoint is the saved progress of a reindex.
+type checkpoint struct {
+	PITID       string        `json:"pit_id,omitempty"`
+	SearchAfter []interface{} `json:"search_after,omitempty"`
+	Read        int64         `json:"read"`
+	Done        bool          `json:"done,omitempty"`
+}
+
+// hitPosition is kept in OriginalMessage to checkpoint a message on Commit.
+type hitPosition struct {
+	run   int64
+	seq   int64
+	sort  []interface{}
+	pitID string
+}
+
+type searchHit struct {
+	Index  string                 `json:"_index"`
+	ID     string                 `json:"_id"`
+	Source map[string]interface{} `json:"_source"`
+	Sort   []interface{}          `json:"sort"`
+}
+
+type searchResponse struct {
+	PITID    string `json:"pit_id"`
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []searchHit `json:"hits"`
+	} `json:"hits"`
+}
+
+// ElasticsearchSource reads the documents of an index, for reprocessing
+// them through the pipeline, and returns io.EOF once all were read.
+type ElasticsearchSource struct {
+	client *esapi.API
+	cfg    SourceConfig
+
+	// Reading state, used by Read only
+	pitID       string
+	scrollID    string
+	searchAfter []interface{}
+	hits        []searchHit
+	seq         int64
+	done        bool
+
+	// Committed progress, guarded by mu (Commit runs on the batcher).
+	// Batches may commit out of order, so acked holds the positions
+	// committed past the first gap.
+	mu        sync.Mutex
+	committed checkpoint
+	acked     map[int64]hitPosition
+	// run counts restarts: positions of an earlier run may still be in
+	// flight and their seq would collide with the new run's. Only Read
+	// writes it, under mu.
+	run int64
+}
+
+func NewElasticsearchSource(cfg SourceConfig) (*ElasticsearchSource, error) {
+	if cfg.Index == "" {
+		return nil, fmt.Errorf("elasticsearch source requires an index")
+	}
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = "auto"
+	case "auto", "pit", "scroll":
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = 1000
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 5 * time.Minute
+	}
+
+	es, err := newClient(cfg.ClientConfig, false)
+	if err != nil {
+		return nil, err
+	}
+	s := &ElasticsearchSource{client: es, cfg: cfg, acked: map[int64]hitPosition{}}
+
+	if cfg.Checkpoint != "" {
+		data, err := os.ReadFile(cfg.Checkpoint)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("error reading checkpoint: %s", err)
+		default:
+			if err := json.Unmarshal(data, &s.committed); err != nil {
+				return nil, fmt.Errorf("invalid checkpoint %s: %s", cfg.Checkpoint, err)
+			}
+			s.pitID = s.committed.PITID
+			s.searchAfter, s.seq, s.done = s.committed.SearchAfter, s.committed.Read, s.committed.Done
+			log.Printf("Resuming reindex of %s after %d documents.", cfg.Index, s.seq)
+		}
+	}
+	return s, nil
+}
+
+// Read returns the next document, fetching a page when the current one is
+// consumed, and io.EOF when the index was read entirely.
+func (s *ElasticsearchSource) Read(ctx context.Context) (pipeline.Message, error) {
+	for len(s.hits) == 0 {
+		if s.done {
+			return pipeline.Message{}, io.EOF
+		}
+		if err := s.fetch(ctx); err != nil {
+			return pipeline.Message{}, err
+		}
+	}
+
+	hit := s.hits[0]
+	s.hits = s.hits[1:]
+	s.seq++
+	if len(hit.Sort) > 0 {
+		s.searchAfter = hit.Sort
+	}
+	return pipeline.Message{
+		ID:   hit.ID,
+		Data: hit.Source,
+		Metadata: map[string]string{
+			"index": hit.Index,
+			"id":    hit.ID,
+		},
+		OriginalMessage: hitPosition{run: s.run, seq: s.seq, sort: hit.Sort, pitID: s.pitID},
+	}, nil
+}
+
+// fetch reads the next page into s.hits, setting s.done after the last one.
+func (s *ElasticsearchSource) fetch(ctx context.Context) error {
+	var page searchResponse
+	var err error
+	switch {
+	case s.scrollID != "":
+		page, err = s.scrollNext(ctx)
+	case s.pitID != "":
+		page, err = s.searchPIT(ctx)
+	case s.seq > 0 && (s.searchAfter == nil || s.cfg.Sort == nil):
+		// Resuming without a stable position
+		s.restart()
+		return nil
+	case s.cfg.Mode == "scroll" && s.seq > 0:
+		page, _, err = s.search(ctx, s.searchAfterBody(),
+			s.client.Search.WithContext(ctx),
+			s.client.Search.WithIndex(s.cfg.Index),
+		)
+	case s.cfg.Mode == "scroll":
+		page, err = s.scrollStart(ctx)
+	default:
+		var status int
+		if s.pitID, status, err = s.openPIT(ctx); err == nil {
+			page, err = s.searchPIT(ctx)
+		} else if s.cfg.Mode == "auto" && pitUnsupported(status, err) {
+			log.Printf("Point in time unavailable (%s), falling back to scroll.", err)
+			s.cfg.Mode = "scroll"
+			// A resumed reindex continues with search_after like the scroll mode
+			return s.fetch(ctx)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if page.PITID != "" {
+		s.pitID = page.PITID
+	}
+	if page.ScrollID != "" {
+		s.scrollID = page.ScrollID
+	}
+	s.hits = page.Hits.Hits
+	if len(s.hits) == 0 {
+		s.done = true
+		s.release()
+	}
+	return nil
+}
+
+// openPIT opens a point in time, returning the status of a failed request
+// so fetch can tell a cluster without the API from other errors.
+func (s *ElasticsearchSource) openPIT(ctx context.Context) (string, int, error) {
+	res, err := s.client.OpenPointInTime([]string{s.cfg.Index}, keepAlive(s.cfg.KeepAlive),
+		s.client.OpenPointInTime.WithContext(ctx),
+	)
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening point in time: %s", err)
+	}
+	var pit struct {
+		ID string `json:"id"`
+	}
+	if err := decode(res, &pit); err != nil {
+		return "", res.StatusCode, fmt.Errorf("error opening point in time: %s", err)
+	}
+	return pit.ID, res.StatusCode, nil
+}
+
+// pitUnsupported tells a cluster without the point in time API, which
+// answers an unknown endpoint, from other failures such as a missing index
+// or denied access.
+func pitUnsupported(status int, err error) bool {
+	switch status {
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return !strings.Contains(err.Error(), "index_not_found_exception")
+	case http.StatusBadRequest:
+		return strings.Contains(err.Error(), "no handler found")
+	}
+	return false
+}
+
+// searchPIT reads the page after s.searchAfter. An expired point in time is
+// dropped: the next fetch opens a new one, resuming when Sort is stable
+// across points in time and restarting otherwise.
+func (s *ElasticsearchSource) searchPIT(ctx context.Context) (searchResponse, error) {
+	body := s.searchAfterBody()
+	body["pit"] = map[string]interface{}{"id": s.pitID, "keep_alive": keepAlive(s.cfg.KeepAlive)}
+	if s.cfg.Sort == nil {
+		body["sort"] = []interface{}{map[string]interface{}{"_shard_doc": "asc"}}
+	}
+
+	page, status, err := s.search(ctx, body, s.client.Search.WithContext(ctx))
+	if status == http.StatusNotFound {
+		log.Printf("Point in time of %s expired.", s.cfg.Index)
+		s.pitID = ""
+	}
+	return page, err
+}
+
+func (s *ElasticsearchSource) scrollStart(ctx context.Context) (searchResponse, error) {
+	body := s.searchBody()
+	if s.cfg.Sort == nil {
+		body["sort"] = []interface{}{"_doc"}
+	}
+	page, _, err := s.search(ctx, body,
+		s.client.Search.WithContext(ctx),
+		s.client.Search.WithIndex(s.cfg.Index),
+		s.client.Search.WithScroll(s.cfg.KeepAlive),
+	)
+	return page, err
+}
+
+func (s *ElasticsearchSource) scrollNext(ctx context.Context) (searchResponse, error) {
+	body, _ := json.Marshal(map[string]interface{}{"scroll_id": s.scrollID, "scroll": keepAlive(s.cfg.KeepAlive)})
+	res, err := s.client.Scroll(s.client.Scroll.WithContext(ctx), s.client.Scroll.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		return searchResponse{}, fmt.Errorf("error scrolling %s: %s", s.cfg.Index, err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		// Expired: the next fetch resumes with search_after or starts over
+		log.Printf("Scroll of %s expired.", s.cfg.Index)
+		s.scrollID = ""
+	}
+	var page searchResponse
+	if err := decode(res, &page); err != nil {
+		return searchResponse{}, fmt.Errorf("error scrolling %s: %s", s.cfg.Index, err)
+	}
+	return page, nil
+}
+
+func (s *ElasticsearchSource) searchBody() map[string]interface{} {
+	body := map[string]interface{}{"size": s.cfg.Size}
+	if s.cfg.Query != nil {
+		body["query"] = s.cfg.Query
+	}
+	if s.cfg.Sort != nil {
+		body["sort"] = s.cfg.Sort
+	}
+	return body
+}
+
+func (s *ElasticsearchSource) searchAfterBody() map[string]interface{} {
+	body := s.searchBody()
+	if s.searchAfter != nil {
+		body["search_after"] = s.searchAfter
+	}
+	return body
+}
+
+// restart discards the progress of a reindex whose position was lost.
+func (s *ElasticsearchSource) restart() {
+	log.Printf("Cannot resume the reindex of %s from its position, starting over.", s.cfg.Index)
+	s.searchAfter, s.seq = nil, 0
+	s.mu.Lock()
+	s.committed = checkpoint{}
+	s.acked = map[int64]hitPosition{}
+	s.run++
+	s.mu.Unlock()
+}
+
+// search runs a search request, returning the status for callers handling
+// expired contexts.
+func (s *ElasticsearchSource) search(ctx context.Context, body map[string]interface{}, opts ...func(*esapi.SearchRequest)) (searchResponse, int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return searchResponse{}, 0, fmt.Errorf("error marshaling search: %s", err)
+	}
+	res, err := s.client.Search(append(opts, s.client.Search.WithBody(bytes.NewReader(data)))...)
+	if err != nil {
+		return searchResponse{}, 0, fmt.Errorf("error searching %s: %s", s.cfg.Index, err)
+	}
+	var page searchResponse
+	if err := decode(res, &page); err != nil {
+		return searchResponse{}, res.StatusCode, fmt.Errorf("error searching %s: %s", s.cfg.Index, err)
+	}
+	return page, res.StatusCode, nil
+}
+
+// Commit checkpoints the position up to which every document was committed
+// (the low-water mark): documents of a batch still in flight keep the
+// checkpoint before them, even when later batches commit first.
+func (s *ElasticsearchSource) Commit(ctx context.Context, msgs []pipeline.Message) error {
+	if s.cfg.Checkpoint == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range msgs {
+		if pos, ok := msg.OriginalMessage.(hitPosition); ok && pos.run == s.run && pos.seq > s.committed.Read {
+			s.acked[pos.seq] = pos
+		}
+	}
+	advanced := false
+	for {
+		pos, ok := s.acked[s.committed.Read+1]
+		if !ok {
+			break
+		}
+		delete(s.acked, pos.seq)
+		s.committed.Read = pos.seq
+		s.committed.SearchAfter = pos.sort
+		s.committed.PITID = pos.pitID
+		advanced = true
+	}
+	if !advanced {
+		return nil
+	}
+	return s.saveCheckpoint()
+}
+
+// saveCheckpoint writes the committed progress atomically. Callers hold mu.
+func (s *ElasticsearchSource) saveCheckpoint() error {
+	data, err := json.Marshal(s.committed)
+	if err != nil {
+		return err
+	}
+	tmp := s.cfg.Checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("error writing checkpoint: %s", err)
+	}
+	if err := os.Rename(tmp, s.cfg.Checkpoint); err != nil {
+		return fmt.Errorf("error writing checkpoint: %s", err)
+	}
+	return nil
+}
+
+// release closes the point in time or scroll, which otherwise hold
+// resources on the cluster until they expire.
+func (s *ElasticsearchSource) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if s.pitID != "" {
+		body, _ := json.Marshal(map[string]string{"id": s.pitID})
+		if res, err := s.client.ClosePointInTime(s.client.ClosePointInTime.WithContext(ctx), s.client.ClosePointInTime.WithBody(bytes.NewReader(body))); err == nil {
+			res.Body.Close()
+		}
+		s.pitID = ""
+	}
+	if s.scrollID != "" {
+		body, _ := json.Marshal(map[string]string{"scroll_id": s.scrollID})
+		if res, err := s.client.ClearScroll(s.client.ClearScroll.WithContext(ctx), s.client.ClearScroll.WithBody(bytes.NewReader(body))); err == nil {
+			res.Body.Close()
+		}
+		s.scrollID = ""
+	}
+}
+
+// Close keeps the point in time or scroll of an unfinished reindex open
+// when checkpointing, so a restart within KeepAlive resumes from it.
+func (s *ElasticsearchSource) Close() error {
+	if s.cfg.Checkpoint == "" {
+		s.release()
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done && len(s.hits) == 0 {
+		s.committed.Done = s.committed.Read == s.seq
+		return s.saveCheckpoint()
+	}
+	return nil
+}
+
+// keepAlive formats d as an ES time unit.
+func keepAlive(d time.Duration) string {
+	if d%time.Second != 0 {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
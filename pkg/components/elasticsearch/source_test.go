@@ -0,0 +1,388 @@
+package elasticsearch
+
+import (
+	"context"
+	"datapipeline/pkg/pipeline"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockSearch serves docs with point in time, scroll and search_after
+// searches. Documents are sorted by "n", which is also returned as the sort
+// value. With noPIT set, opening a point in time fails with that status like
+// on clusters lacking the API.
+type mockSearch struct {
+	mu          sync.Mutex
+	docs        []map[string]interface{}
+	noPIT       int
+	scrolls     map[string]int // Scroll id -> next position
+	pits        map[string]bool
+	closed      int
+	searchAfter []interface{} // Of the last search without pit or scroll
+}
+
+func newMockSearch(n int) *mockSearch {
+	m := &mockSearch{scrolls: map[string]int{}, pits: map[string]bool{}}
+	for i := 1; i <= n; i++ {
+		m.docs = append(m.docs, map[string]interface{}{"n": float64(i)})
+	}
+	return m
+}
+
+func (m *mockSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var body struct {
+		Size        int                    `json:"size"`
+		PIT         map[string]interface{} `json:"pit"`
+		SearchAfter []interface{}          `json:"search_after"`
+		ScrollID    string                 `json:"scroll_id"`
+		ID          string                 `json:"id"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch {
+	case r.URL.Path == "/":
+		fmt.Fprint(w, `{"version":{"number":"8.19.0"},"tagline":"You Know, for Search"}`)
+	case strings.HasSuffix(r.URL.Path, "/_pit") && r.Method == http.MethodPost:
+		if m.noPIT != 0 {
+			w.WriteHeader(m.noPIT)
+			fmt.Fprintf(w, `{"error":"no handler found","status":%d}`, m.noPIT)
+			return
+		}
+		m.pits["pit-1"] = true
+		fmt.Fprint(w, `{"id":"pit-1"}`)
+	case r.URL.Path == "/_pit" && r.Method == http.MethodDelete:
+		delete(m.pits, body.ID)
+		m.closed++
+		fmt.Fprint(w, `{"succeeded":true}`)
+	case r.URL.Path == "/_search/scroll" && r.Method == http.MethodDelete:
+		m.closed++
+		fmt.Fprint(w, `{"succeeded":true}`)
+	case r.URL.Path == "/_search/scroll":
+		pos, ok := m.scrolls[body.ScrollID]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"search_context_missing_exception","status":404}`)
+			return
+		}
+		m.page(w, pos, 2, "_scroll_id", body.ScrollID)
+	case strings.HasSuffix(r.URL.Path, "/_search") && r.URL.Query().Get("scroll") != "":
+		m.page(w, 0, body.Size, "_scroll_id", "scroll-1")
+	case strings.HasSuffix(r.URL.Path, "/_search") && r.URL.Path != "/_search":
+		m.searchAfter = body.SearchAfter
+		pos := 0
+		if len(body.SearchAfter) > 0 {
+			pos = int(body.SearchAfter[0].(float64))
+		}
+		m.page(w, pos, body.Size, "", "")
+	case r.URL.Path == "/_search":
+		id, _ := body.PIT["id"].(string)
+		if !m.pits[id] {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"search_context_missing_exception","status":404}`)
+			return
+		}
+		pos := 0
+		if len(body.SearchAfter) > 0 {
+			pos = int(body.SearchAfter[0].(float64))
+		}
+		m.page(w, pos, body.Size, "pit_id", "pit-1")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// page writes up to size docs from pos, returning id under key when set.
+// Scroll pages are always of 2 docs, the size of the first request in the
+// tests below.
+func (m *mockSearch) page(w http.ResponseWriter, pos, size int, key, id string) {
+	var hits []map[string]interface{}
+	for i := pos; i < len(m.docs) && i < pos+size; i++ {
+		hits = append(hits, map[string]interface{}{
+			"_index":  "orders",
+			"_id":     fmt.Sprint(i + 1),
+			"_source": m.docs[i],
+			"sort":    []interface{}{m.docs[i]["n"]},
+		})
+	}
+	resp := map[string]interface{}{"hits": map[string]interface{}{"hits": hits}}
+	if key == "_scroll_id" {
+		m.scrolls[id] = pos + len(hits)
+	}
+	if key != "" {
+		resp[key] = id
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readAll reads src until io.EOF, returning the messages read.
+func readAll(t *testing.T, src *ElasticsearchSource) []pipeline.Message {
+	t.Helper()
+	var msgs []pipeline.Message
+	for {
+		msg, err := src.Read(context.Background())
+		if errors.Is(err, io.EOF) {
+			return msgs
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestSourcePIT(t *testing.T) {
+	mock := newMockSearch(5)
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	cfg := SourceConfig{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+		Size:         2,
+		Sort:         []interface{}{map[string]interface{}{"n": "asc"}},
+		Checkpoint:   filepath.Join(t.TempDir(), "orders.checkpoint"),
+	}
+	src, err := NewElasticsearchSource(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Stop after 3 documents, committing them
+	var msgs []pipeline.Message
+	for i := 0; i < 3; i++ {
+		msg, err := src.Read(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if msgs[2].ID != "3" || msgs[2].Metadata["index"] != "orders" {
+		t.Fatalf("unexpected message: %+v", msgs[2])
+	}
+	if err := src.Commit(context.Background(), msgs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	src.Close()
+
+	// A restart resumes after the committed documents
+	src, err = NewElasticsearchSource(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rest := readAll(t, src)
+	if len(rest) != 2 || rest[0].ID != "4" || rest[1].ID != "5" {
+		t.Fatalf("expected documents 4 and 5, got %+v", rest)
+	}
+	src.Commit(context.Background(), rest)
+	src.Close()
+	if mock.closed != 1 || len(mock.pits) != 0 {
+		t.Errorf("expected the point in time to be closed")
+	}
+
+	// A finished reindex reads nothing
+	src, err = NewElasticsearchSource(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rest := readAll(t, src); len(rest) != 0 {
+		t.Errorf("expected no documents, got %d", len(rest))
+	}
+
+	// An expired point in time is replaced, resuming from the sort values
+	mock.pits = map[string]bool{}
+	cfg.Checkpoint = filepath.Join(t.TempDir(), "expired.checkpoint")
+	src, _ = NewElasticsearchSource(cfg)
+	src.pitID, src.searchAfter, src.seq = "expired", []interface{}{3.0}, 3
+	if _, err := src.Read(context.Background()); err == nil {
+		t.Fatalf("expected an error for the expired point in time")
+	}
+	if rest := readAll(t, src); len(rest) != 2 || rest[0].ID != "4" {
+		t.Errorf("expected documents 4 and 5, got %+v", rest)
+	}
+}
+
+func TestSourceCommitOutOfOrder(t *testing.T) {
+	server := httptest.NewServer(newMockSearch(5))
+	defer server.Close()
+
+	cfg := SourceConfig{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+		Size:         5,
+		Sort:         []interface{}{map[string]interface{}{"n": "asc"}},
+		Checkpoint:   filepath.Join(t.TempDir(), "orders.checkpoint"),
+	}
+	src, err := NewElasticsearchSource(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer src.Close()
+	msgs := readAll(t, src)
+
+	saved := func() checkpoint {
+		var cp checkpoint
+		if data, err := os.ReadFile(cfg.Checkpoint); err == nil {
+			json.Unmarshal(data, &cp)
+		}
+		return cp
+	}
+	// Batches written by different workers commit out of order
+	for _, step := range []struct {
+		batch []pipeline.Message
+		read  int64
+	}{
+		{msgs[3:5], 0},
+		{msgs[0:2], 2},
+		{msgs[2:3], 5},
+	} {
+		if err := src.Commit(context.Background(), step.batch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cp := saved(); cp.Read != step.read {
+			t.Errorf("expected the checkpoint at %d, got %d", step.read, cp.Read)
+		}
+	}
+	if cp := saved(); len(cp.SearchAfter) != 1 || cp.SearchAfter[0] != 5.0 {
+		t.Errorf("expected to resume after document 5, got %v", cp.SearchAfter)
+	}
+}
+
+func TestSourceCommitAfterRestart(t *testing.T) {
+	server := httptest.NewServer(newMockSearch(5))
+	defer server.Close()
+
+	cfg := SourceConfig{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+		Size:         5,
+		Checkpoint:   filepath.Join(t.TempDir(), "orders.checkpoint"),
+	}
+	src, err := NewElasticsearchSource(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer src.Close()
+	read := func(n int) []pipeline.Message {
+		var msgs []pipeline.Message
+		for i := 0; i < n; i++ {
+			msg, err := src.Read(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+
+	// The reindex starts over while documents of the first run are in flight
+	old := read(3)
+	src.hits, src.pitID = nil, ""
+	src.restart()
+	current := read(2)
+
+	if err := src.Commit(context.Background(), old); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(cfg.Checkpoint); !os.IsNotExist(err) {
+		t.Errorf("expected no checkpoint from the previous run, got %v", err)
+	}
+	if err := src.Commit(context.Background(), current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var cp checkpoint
+	data, _ := os.ReadFile(cfg.Checkpoint)
+	json.Unmarshal(data, &cp)
+	if cp.Read != 2 {
+		t.Errorf("expected the checkpoint at 2, got %d", cp.Read)
+	}
+}
+
+func TestSourceScrollFallback(t *testing.T) {
+	mock := newMockSearch(5)
+	mock.noPIT = http.StatusBadRequest
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	src, err := NewElasticsearchSource(SourceConfig{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+		Size:         2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msgs := readAll(t, src)
+	if len(msgs) != 5 || msgs[4].ID != "5" {
+		t.Fatalf("expected 5 documents, got %d", len(msgs))
+	}
+	if src.cfg.Mode != "scroll" || mock.closed != 1 {
+		t.Errorf("expected a cleared scroll, got mode %s", src.cfg.Mode)
+	}
+}
+
+func TestSourceNoFallbackOnOtherErrors(t *testing.T) {
+	mock := newMockSearch(5)
+	mock.noPIT = http.StatusUnauthorized
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	src, err := NewElasticsearchSource(SourceConfig{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := src.Read(context.Background()); err == nil {
+		t.Fatal("expected the point in time error")
+	}
+	if src.cfg.Mode != "auto" {
+		t.Errorf("expected no fallback to scroll, got mode %s", src.cfg.Mode)
+	}
+}
+
+func TestSourceScrollFallbackResume(t *testing.T) {
+	mock := newMockSearch(5)
+	mock.noPIT = http.StatusNotFound
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	src, err := NewElasticsearchSource(SourceConfig{
+		ClientConfig: ClientConfig{Addresses: []string{server.URL}},
+		Index:        "orders",
+		Size:         5,
+		Sort:         []interface{}{map[string]interface{}{"n": "asc"}},
+		Checkpoint:   filepath.Join(t.TempDir(), "orders.checkpoint"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer src.Close()
+
+	// Resuming from a checkpoint continues after it instead of starting over
+	src.searchAfter, src.seq = []interface{}{3.0}, 3
+	rest := readAll(t, src)
+	if len(rest) != 2 || rest[0].ID != "4" || rest[1].ID != "5" {
+		t.Fatalf("expected documents 4 and 5, got %+v", rest)
+	}
+	if len(mock.searchAfter) != 1 || mock.searchAfter[0] != 5.0 {
+		t.Errorf("expected the last search after document 5, got %v", mock.searchAfter)
+	}
+	if src.cfg.Mode != "scroll" || len(mock.scrolls) != 0 {
+		t.Errorf("expected search_after without a scroll, got mode %s", src.cfg.Mode)
+	}
+}
@@ -0,0 +1,101 @@
+package elasticsearch
+
+import (
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	datePlaceholder = regexp.MustCompile(`%\{\+([^}]+)\}`)
+	dateToken       = regexp.MustCompile(`yyyy|yy|xxxx|MM|ww|dd|HH|mm|ss`)
+)
+
+// render expands a template with ${ref} placeholders, or resolves a plain
+// reference when tmpl has none (see pipeline.LookupRef). ok is false when
+// any reference is missing.
+func render(tmpl string, msg pipeline.Message) (string, bool) {
+	if !strings.Contains(tmpl, "${") {
+		v := pipeline.LookupRef(msg, tmpl)
+		if v == nil {
+			return "", false
+		}
+		return pipeline.ValueText(v), true
+	}
+	return pipeline.Interpolate(tmpl, msg)
+}
+
+// indexName expands an index template: ${ref} placeholders as in render and
+// %{+pattern} dates formatted from t in UTC, e.g. "orders-%{+yyyy.MM.dd}".
+// Index names must be lowercase, so the result is lowercased.
+func indexName(tmpl string, msg pipeline.Message, t time.Time) (string, error) {
+	name := datePlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		return formatDate(m[3:len(m)-1], t)
+	})
+	if strings.Contains(name, "${") {
+		var ok bool
+		if name, ok = render(name, msg); !ok {
+			return "", fmt.Errorf("cannot resolve index %q: missing field", tmpl)
+		}
+	}
+	return strings.ToLower(name), nil
+}
+
+// formatDate formats t in UTC with a Joda style pattern (yyyy, yy, MM, dd,
+// HH, mm, ss, and xxxx/ww for the ISO week year and week).
+func formatDate(pattern string, t time.Time) string {
+	t = t.UTC()
+	return dateToken.ReplaceAllStringFunc(pattern, func(tok string) string {
+		switch tok {
+		case "yyyy":
+			return fmt.Sprintf("%04d", t.Year())
+		case "yy":
+			return fmt.Sprintf("%02d", t.Year()%100)
+		case "MM":
+			return fmt.Sprintf("%02d", int(t.Month()))
+		case "dd":
+			return fmt.Sprintf("%02d", t.Day())
+		case "HH":
+			return fmt.Sprintf("%02d", t.Hour())
+		case "mm":
+			return fmt.Sprintf("%02d", t.Minute())
+		case "ss":
+			return fmt.Sprintf("%02d", t.Second())
+		case "xxxx":
+			year, _ := t.ISOWeek()
+			return fmt.Sprintf("%04d", year)
+		case "ww":
+			_, week := t.ISOWeek()
+			return fmt.Sprintf("%02d", week)
+		}
+		return tok
+	})
+}
+
+// parseTime reads an event time: time.Time, RFC 3339 or date strings, or
+// epoch milliseconds (as ES does for numbers).
+func parseTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case float64:
+		return time.UnixMilli(int64(t)), nil
+	case int:
+		return time.UnixMilli(int64(t)), nil
+	case int64:
+		return time.UnixMilli(t), nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+			if parsed, err := time.Parse(layout, t); err == nil {
+				return parsed, nil
+			}
+		}
+		if ms, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return time.UnixMilli(ms), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %v", v)
+}
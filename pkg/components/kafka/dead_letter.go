@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"datapipeline/pkg/pipeline"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaDeadLetter publishes messages rejected by the sink to a Kafka topic.
+// The value is the original payload when the message came from Kafka (so it
+// can be replayed once the cause is fixed), otherwise the processed data as
+// JSON. The rejection reason and the source position go in headers.
+type KafkaDeadLetter struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaDeadLetter(brokers []string, topic string) *KafkaDeadLetter {
+	return &KafkaDeadLetter{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (d *KafkaDeadLetter) WriteFailed(ctx context.Context, failed []pipeline.FailedMessage) error {
+	msgs := make([]kafka.Message, 0, len(failed))
+	for _, f := range failed {
+		km := kafka.Message{
+			Key:     []byte(f.Message.ID),
+			Headers: []kafka.Header{{Key: "dlq_reason", Value: []byte(f.Reason)}},
+		}
+		if orig, ok := f.Message.OriginalMessage.(kafka.Message); ok {
+			km.Value = orig.Value
+			km.Headers = append(km.Headers,
+				kafka.Header{Key: "dlq_source_topic", Value: []byte(orig.Topic)},
+				kafka.Header{Key: "dlq_source_partition", Value: []byte(strconv.Itoa(orig.Partition))},
+				kafka.Header{Key: "dlq_source_offset", Value: []byte(strconv.FormatInt(orig.Offset, 10))},
+			)
+		} else {
+			data, err := json.Marshal(f.Message.Data)
+			if err != nil {
+				return fmt.Errorf("error marshaling message %s: %w", f.Message.ID, err)
+			}
+			km.Value = data
+		}
+		msgs = append(msgs, km)
+	}
+	return d.writer.WriteMessages(ctx, msgs...)
+}
+
+func (d *KafkaDeadLetter) Close() error {
+	return d.writer.Close()
+}
@@ -0,0 +1,484 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterProcessor("aggregate", NewAggregate)
+}
+
+// --- Aggregate ---
+
+// Aggregate computes windowed aggregations grouped by GroupBy paths and emits
+// one message per closed window (see pipeline.Emitter). Windows are:
+//   - tumbling: fixed, non-overlapping windows of Size
+//   - sliding: windows of Size starting every Slide
+//   - session: per group, closed after Gap without events
+//
+// With event time a window closes once the highest event time seen passes
+// its end plus AllowedLateness; events for already closed windows are late
+// and ignored. With processing time windows follow the wall clock. All open
+// windows are emitted when the engine shuts down.
+//
+// Window state lives in memory only, while the input messages are committed
+// as soon as they are written: after a crash (not a clean shutdown) their
+// contribution to the windows still open is lost, and is not redelivered.
+//
+// Input messages pass through unchanged unless DropInput is set, and join the
+// batch with the emitted windows. Windows carry Metadata["aggregate"] =
+// "true": write them to a table of their own with a router sink on that key
+// (see pipeline.RouterSink), or set DropInput to keep only the aggregates.
+type Aggregate struct {
+	GroupBy         []string
+	WindowType      string
+	Size            time.Duration
+	Slide           time.Duration
+	Gap             time.Duration
+	EventTime       bool
+	TimeField       string // Empty reads Metadata["timestamp"]
+	TimeFormats     []string
+	AllowedLateness time.Duration
+	Aggregations    []aggregation
+	DropInput       bool
+
+	mu        sync.Mutex
+	windows   map[string]*window   // Tumbling/sliding, by group and start
+	sessions  map[string][]*window // Session windows, by group
+	watermark time.Time            // Highest event time seen
+	late      int64
+	now       func() time.Time
+}
+
+type aggregation struct {
+	Type   string // count, sum, avg, min, max, distinct_count
+	Field  string
+	Target string
+}
+
+type window struct {
+	Start, End time.Time
+	Group      []interface{}
+	States     []aggState
+}
+
+type aggState struct {
+	Count    int64
+	Sum      float64
+	Min, Max float64
+	Distinct map[string]struct{}
+}
+
+func NewAggregate(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &Aggregate{
+		GroupBy:     getStringSlice(config, "group_by"),
+		TimeField:   getString(config, "time_field"),
+		TimeFormats: getStringSlice(config, "time_formats"),
+		DropInput:   getBool(config, "drop_input", false),
+		windows:     make(map[string]*window),
+		sessions:    make(map[string][]*window),
+		now:         time.Now,
+	}
+
+	switch t := getString(config, "time"); t {
+	case "", "event":
+		p.EventTime = true
+	case "processing":
+	default:
+		return nil, fmt.Errorf("aggregate: time must be 'event' or 'processing', got '%s'", t)
+	}
+	if len(p.TimeFormats) == 0 {
+		p.TimeFormats = []string{"unix", "RFC3339"}
+	}
+	for i, f := range p.TimeFormats {
+		switch strings.ToLower(f) {
+		case "unix", "unix_ms", "unix_ns":
+			p.TimeFormats[i] = strings.ToLower(f)
+		default:
+			p.TimeFormats[i] = toGoLayout(f)
+		}
+	}
+
+	var err error
+	if p.AllowedLateness, err = getDuration(config, "allowed_lateness", 0); err != nil {
+		return nil, fmt.Errorf("aggregate: %w", err)
+	}
+
+	windowCfg, _ := config["window"].(map[string]interface{})
+	if windowCfg == nil {
+		return nil, fmt.Errorf("aggregate: 'window' is required")
+	}
+	p.WindowType = getString(windowCfg, "type")
+	if p.Size, err = getDuration(windowCfg, "size", 0); err != nil {
+		return nil, fmt.Errorf("aggregate: %w", err)
+	}
+	if p.Slide, err = getDuration(windowCfg, "slide", 0); err != nil {
+		return nil, fmt.Errorf("aggregate: %w", err)
+	}
+	if p.Gap, err = getDuration(windowCfg, "gap", 0); err != nil {
+		return nil, fmt.Errorf("aggregate: %w", err)
+	}
+	switch p.WindowType {
+	case "", "tumbling":
+		p.WindowType = "tumbling"
+		if p.Size <= 0 {
+			return nil, fmt.Errorf("aggregate: tumbling window requires 'size'")
+		}
+		p.Slide = p.Size
+	case "sliding":
+		if p.Size <= 0 || p.Slide <= 0 || p.Slide > p.Size {
+			return nil, fmt.Errorf("aggregate: sliding window requires 'size' and 0 < 'slide' <= 'size'")
+		}
+	case "session":
+		if p.Gap <= 0 {
+			return nil, fmt.Errorf("aggregate: session window requires 'gap'")
+		}
+	default:
+		return nil, fmt.Errorf("aggregate: unknown window type '%s'", p.WindowType)
+	}
+
+	aggs, _ := config["aggregates"].([]interface{})
+	if len(aggs) == 0 {
+		return nil, fmt.Errorf("aggregate: at least one entry in 'aggregates' is required")
+	}
+	for _, a := range aggs {
+		aMap, ok := a.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("aggregate: each entry in 'aggregates' must be a map")
+		}
+		agg := aggregation{
+			Type:   getString(aMap, "type"),
+			Field:  getString(aMap, "field"),
+			Target: getString(aMap, "target"),
+		}
+		switch agg.Type {
+		case "count":
+		case "sum", "avg", "min", "max", "distinct_count":
+			if agg.Field == "" {
+				return nil, fmt.Errorf("aggregate: '%s' requires 'field'", agg.Type)
+			}
+		default:
+			return nil, fmt.Errorf("aggregate: unknown aggregate type '%s'", agg.Type)
+		}
+		if agg.Target == "" {
+			agg.Target = agg.Type
+			if agg.Field != "" {
+				agg.Target = agg.Type + "_" + strings.ReplaceAll(agg.Field, ".", "_")
+			}
+		}
+		p.Aggregations = append(p.Aggregations, agg)
+	}
+	return p, nil
+}
+
+func (p *Aggregate) Process(msg pipeline.Message) (pipeline.Message, error) {
+	ts, err := p.eventTime(msg)
+	if err != nil {
+		return msg, err
+	}
+
+	group := make([]interface{}, len(p.GroupBy))
+	for i, path := range p.GroupBy {
+		group[i] = GetValue(msg.Data, path)
+	}
+	groupKey, err := json.Marshal(group)
+	if err != nil {
+		return msg, fmt.Errorf("aggregate: invalid group_by value: %w", err)
+	}
+
+	p.mu.Lock()
+	if p.EventTime && ts.After(p.watermark) {
+		p.watermark = ts
+	}
+	if p.WindowType == "session" {
+		p.addToSession(string(groupKey), group, ts, msg.Data)
+	} else {
+		p.addToWindows(string(groupKey), group, ts, msg.Data)
+	}
+	p.mu.Unlock()
+
+	if p.DropInput {
+		return msg, fmt.Errorf("%w: aggregated", pipeline.ErrDropMessage)
+	}
+	return msg, nil
+}
+
+func (p *Aggregate) eventTime(msg pipeline.Message) (time.Time, error) {
+	if !p.EventTime {
+		return p.now(), nil
+	}
+	if p.TimeField == "" {
+		ts, err := time.Parse(time.RFC3339, msg.Metadata["timestamp"])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("aggregate: invalid metadata timestamp: %w", err)
+		}
+		return ts, nil
+	}
+	val := GetValue(msg.Data, p.TimeField)
+	if val == nil {
+		return time.Time{}, fmt.Errorf("aggregate: time field '%s' missing", p.TimeField)
+	}
+	for _, format := range p.TimeFormats {
+		switch format {
+		case "unix", "unix_ms", "unix_ns":
+			if ts, ok := parseEpoch(val, format); ok {
+				return ts, nil
+			}
+		default:
+			if s, ok := val.(string); ok {
+				if ts, err := time.Parse(format, s); err == nil {
+					return ts, nil
+				}
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("aggregate: time field '%s' value '%v' does not match %v", p.TimeField, val, p.TimeFormats)
+}
+
+// closed reports whether a window ending at end was already emitted.
+func (p *Aggregate) closed(end time.Time) bool {
+	if !p.EventTime {
+		return !p.now().Before(end)
+	}
+	return !p.watermark.Before(end.Add(p.AllowedLateness))
+}
+
+// addToWindows adds an event to every tumbling/sliding window containing ts.
+// Callers must hold p.mu.
+func (p *Aggregate) addToWindows(groupKey string, group []interface{}, ts time.Time, data map[string]interface{}) {
+	slide := p.Slide.Nanoseconds()
+	lastStart := ts.UnixNano() - mod(ts.UnixNano(), slide)
+	for start := lastStart; start > ts.UnixNano()-p.Size.Nanoseconds(); start -= slide {
+		end := time.Unix(0, start).Add(p.Size)
+		if p.closed(end) {
+			p.late++
+			continue
+		}
+		key := groupKey + "|" + strconv.FormatInt(start, 10)
+		w, ok := p.windows[key]
+		if !ok {
+			w = p.newWindow(time.Unix(0, start), end, group)
+			p.windows[key] = w
+		}
+		p.accumulate(w, data)
+	}
+}
+
+// addToSession adds an event to the group's session containing ts, creating
+// or merging sessions as needed. Callers must hold p.mu.
+func (p *Aggregate) addToSession(groupKey string, group []interface{}, ts time.Time, data map[string]interface{}) {
+	if p.closed(ts.Add(p.Gap)) {
+		p.late++
+		return
+	}
+	start, end := ts, ts.Add(p.Gap)
+	var kept []*window
+	var merged []*window
+	for _, s := range p.sessions[groupKey] {
+		// Sessions overlap when the gap around ts touches them
+		if !s.Start.After(end) && !start.After(s.End) {
+			merged = append(merged, s)
+			if s.Start.Before(start) {
+				start = s.Start
+			}
+			if s.End.After(end) {
+				end = s.End
+			}
+			continue
+		}
+		kept = append(kept, s)
+	}
+
+	w := p.newWindow(start, end, group)
+	for _, s := range merged {
+		mergeStates(w.States, s.States)
+	}
+	p.accumulate(w, data)
+	p.sessions[groupKey] = append(kept, w)
+}
+
+func (p *Aggregate) newWindow(start, end time.Time, group []interface{}) *window {
+	w := &window{Start: start, End: end, Group: group, States: make([]aggState, len(p.Aggregations))}
+	for i, agg := range p.Aggregations {
+		if agg.Type == "distinct_count" {
+			w.States[i].Distinct = make(map[string]struct{})
+		}
+	}
+	return w
+}
+
+func (p *Aggregate) accumulate(w *window, data map[string]interface{}) {
+	for i, agg := range p.Aggregations {
+		st := &w.States[i]
+		if agg.Type == "count" {
+			st.Count++
+			continue
+		}
+		val := GetValue(data, agg.Field)
+		if val == nil {
+			continue
+		}
+		if agg.Type == "distinct_count" {
+			st.Distinct[fmt.Sprint(val)] = struct{}{}
+			continue
+		}
+		f, ok := toFloat(val)
+		if !ok {
+			continue
+		}
+		if st.Count == 0 || f < st.Min {
+			st.Min = f
+		}
+		if st.Count == 0 || f > st.Max {
+			st.Max = f
+		}
+		st.Sum += f
+		st.Count++
+	}
+}
+
+func mergeStates(dst, src []aggState) {
+	for i := range dst {
+		d, s := &dst[i], &src[i]
+		if s.Count > 0 {
+			if d.Count == 0 || s.Min < d.Min {
+				d.Min = s.Min
+			}
+			if d.Count == 0 || s.Max > d.Max {
+				d.Max = s.Max
+			}
+		}
+		d.Count += s.Count
+		d.Sum += s.Sum
+		for k := range s.Distinct {
+			d.Distinct[k] = struct{}{}
+		}
+	}
+}
+
+// Emit returns one message per closed window, or every open window when final.
+func (p *Aggregate) Emit(final bool) []pipeline.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var ready []*window
+	for key, w := range p.windows {
+		if final || p.closed(w.End) {
+			ready = append(ready, w)
+			delete(p.windows, key)
+		}
+	}
+	for key, sessions := range p.sessions {
+		var open []*window
+		for _, w := range sessions {
+			if final || p.closed(w.End) {
+				ready = append(ready, w)
+			} else {
+				open = append(open, w)
+			}
+		}
+		if len(open) == 0 {
+			delete(p.sessions, key)
+		} else {
+			p.sessions[key] = open
+		}
+	}
+
+	sort.Slice(ready, func(i, j int) bool { return ready[i].End.Before(ready[j].End) })
+	msgs := make([]pipeline.Message, 0, len(ready))
+	for _, w := range ready {
+		msgs = append(msgs, p.windowMessage(w))
+	}
+	return msgs
+}
+
+func (p *Aggregate) windowMessage(w *window) pipeline.Message {
+	data := map[string]interface{}{
+		"window_start": w.Start.UTC().Format(time.RFC3339Nano),
+		"window_end":   w.End.UTC().Format(time.RFC3339Nano),
+	}
+	for i, path := range p.GroupBy {
+		SetValue(data, path, w.Group[i])
+	}
+	for i, agg := range p.Aggregations {
+		st := w.States[i]
+		var val interface{}
+		switch agg.Type {
+		case "count":
+			val = st.Count
+		case "sum":
+			val = st.Sum
+		case "avg":
+			if st.Count > 0 {
+				val = st.Sum / float64(st.Count)
+			}
+		case "min":
+			if st.Count > 0 {
+				val = st.Min
+			}
+		case "max":
+			if st.Count > 0 {
+				val = st.Max
+			}
+		case "distinct_count":
+			val = int64(len(st.Distinct))
+		}
+		SetValue(data, agg.Target, val)
+	}
+
+	groupKey, _ := json.Marshal(w.Group)
+	return pipeline.Message{
+		ID:   fmt.Sprintf("%s@%d", groupKey, w.Start.UnixNano()),
+		Data: data,
+		Metadata: map[string]string{
+			"aggregate":    "true",
+			"window_type":  p.WindowType,
+			"window_start": w.Start.UTC().Format(time.RFC3339Nano),
+			"window_end":   w.End.UTC().Format(time.RFC3339Nano),
+		},
+	}
+}
+
+// Late returns how many events arrived after their window was closed.
+func (p *Aggregate) Late() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.late
+}
+
+// toFloat converts numeric values (and numeric strings) to float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// mod is a modulo that is never negative, for epochs before 1970.
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
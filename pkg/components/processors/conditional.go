@@ -0,0 +1,472 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+func init() {
+	RegisterProcessor("if", NewIf)
+	RegisterProcessor("switch", NewSwitch)
+}
+
+// --- Condition ---
+
+// Condition is a predicate on a message. Field uses the same lookup as
+// templates (see pipeline.LookupRef). Supported operators:
+// ==, !=, >, >=, <, <=, exists, not_exists, in, not_in, contains, matches.
+// Conditions combine with All, Any and Not.
+type Condition struct {
+	Field    string
+	Operator string
+	Value    interface{}
+	All      []*Condition
+	Any      []*Condition
+	Not      *Condition
+
+	re *regexp.Regexp
+}
+
+func parseCondition(config map[string]interface{}) (*Condition, error) {
+	c := &Condition{
+		Field:    getString(config, "field"),
+		Operator: getString(config, "operator"),
+		Value:    config["value"],
+	}
+	for _, key := range []string{"all", "any"} {
+		list, ok := config[key].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, item := range list {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("'%s' entries must be conditions", key)
+			}
+			sub, err := parseCondition(m)
+			if err != nil {
+				return nil, err
+			}
+			if key == "all" {
+				c.All = append(c.All, sub)
+			} else {
+				c.Any = append(c.Any, sub)
+			}
+		}
+	}
+	if m, ok := config["not"].(map[string]interface{}); ok {
+		sub, err := parseCondition(m)
+		if err != nil {
+			return nil, err
+		}
+		c.Not = sub
+	}
+
+	if c.Field == "" {
+		if c.All == nil && c.Any == nil && c.Not == nil {
+			return nil, fmt.Errorf("condition needs 'field' or one of 'all', 'any', 'not'")
+		}
+		return c, nil
+	}
+	if c.Operator == "" {
+		c.Operator = "=="
+	}
+	switch c.Operator {
+	case "==", "!=", ">", ">=", "<", "<=", "exists", "not_exists", "contains":
+	case "in", "not_in":
+		if _, ok := c.Value.([]interface{}); !ok {
+			return nil, fmt.Errorf("operator '%s' needs a list value", c.Operator)
+		}
+	case "matches":
+		pattern, _ := c.Value.(string)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for field '%s': %w", c.Field, err)
+		}
+		c.re = re
+	default:
+		return nil, fmt.Errorf("unknown operator '%s'", c.Operator)
+	}
+	return c, nil
+}
+
+// Match reports whether msg satisfies the condition. A missing field only
+// matches "!=", "not_in" and "not_exists".
+func (c *Condition) Match(msg pipeline.Message) bool {
+	for _, sub := range c.All {
+		if !sub.Match(msg) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 {
+		matched := false
+		for _, sub := range c.Any {
+			if sub.Match(msg) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if c.Not != nil && c.Not.Match(msg) {
+		return false
+	}
+	if c.Field == "" {
+		return true
+	}
+
+	val := pipeline.LookupRef(msg, c.Field)
+	switch c.Operator {
+	case "exists":
+		return val != nil
+	case "not_exists":
+		return val == nil
+	case "==":
+		return val != nil && equalValues(val, c.Value)
+	case "!=":
+		return val == nil || !equalValues(val, c.Value)
+	case "in", "not_in":
+		found := false
+		for _, v := range c.Value.([]interface{}) {
+			if val != nil && equalValues(val, v) {
+				found = true
+				break
+			}
+		}
+		return found == (c.Operator == "in")
+	case "contains":
+		switch t := val.(type) {
+		case []interface{}:
+			for _, v := range t {
+				if equalValues(v, c.Value) {
+					return true
+				}
+			}
+			return false
+		default:
+			s, ok := toText(val)
+			return ok && strings.Contains(s, scalarText(c.Value))
+		}
+	case "matches":
+		s, ok := toText(val)
+		return ok && c.re.MatchString(s)
+	}
+
+	if val == nil {
+		return false
+	}
+	cmp, ok := compareValues(val, c.Value)
+	if !ok {
+		return false
+	}
+	switch c.Operator {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// equalValues compares numbers numerically (JSON decodes them as float64,
+// YAML as int) and anything else by its text.
+func equalValues(a, b interface{}) bool {
+	_, aIsText := a.(string)
+	_, bIsText := b.(string)
+	if !aIsText && !bIsText {
+		if x, ok := toFloat(a); ok {
+			if y, ok := toFloat(b); ok {
+				return x == y
+			}
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	return scalarText(a) == scalarText(b)
+}
+
+// compareValues orders numbers (and numeric strings) numerically and other
+// values as text.
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	x, ok1 := toText(a)
+	y, ok2 := toText(b)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
+
+// --- Chain ---
+
+// chain is a nested processor list inside a composite processor.
+type chain []pipeline.Processor
+
+// buildChain creates the processors of a nested 'processors:' style list,
+// whose entries have the same shape as PipelineConfig.Processors.
+func buildChain(v interface{}) (chain, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of processors, got %T", v)
+	}
+	procs := make(chain, 0, len(list))
+	for i, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("processor %d: expected a map with 'type' and 'config'", i)
+		}
+		typ := getString(entry, "type")
+		cfg, _ := entry["config"].(map[string]interface{})
+		if cfg == nil {
+			cfg = map[string]interface{}{}
+		}
+		p, err := CreateProcessor(typ, cfg)
+		if err != nil {
+			closeChains(procs)
+			return nil, fmt.Errorf("processor %d (%s): %w", i, typ, err)
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// composite holds the nested chains of a conditional processor and forwards
+// the optional pipeline interfaces (WriteObserver, FailureObserver, Emitter,
+// WorkerAware, io.Closer) to the processors inside them. Nested chains run with
+// pipeline.RunProcessors, so drops and errors propagate as if their
+// processors were top-level.
+type composite struct {
+	chains []chain
+}
+
+// single adapts a possibly split result to Process.
+func single(out []pipeline.Message, err error, msg pipeline.Message) (pipeline.Message, error) {
+	var partial *pipeline.PartialProcessError
+	if errors.As(err, &partial) {
+		// The parts that succeeded cannot be returned: msg fails as a whole
+		return msg, fmt.Errorf("nested chain failed: %s", err)
+	}
+	if err != nil {
+		return msg, err
+	}
+	switch len(out) {
+	case 0:
+		return msg, fmt.Errorf("%w: nested chain produced no message", pipeline.ErrDropMessage)
+	case 1:
+		return out[0], nil
+	default:
+		return msg, fmt.Errorf("nested chain produced %d messages but the chain cannot split here", len(out))
+	}
+}
+
+func (c *composite) OnBatchWritten(msgs []pipeline.Message) {
+	for _, ch := range c.chains {
+		for _, p := range ch {
+			if o, ok := p.(pipeline.WriteObserver); ok {
+				o.OnBatchWritten(msgs)
+			}
+		}
+	}
+}
+
+func (c *composite) OnBatchFailed(msgs []pipeline.Message) {
+	for _, ch := range c.chains {
+		for _, p := range ch {
+			if o, ok := p.(pipeline.FailureObserver); ok {
+				o.OnBatchFailed(msgs)
+			}
+		}
+	}
+}
+
+func (c *composite) SetWorkerCount(n int) {
+	for _, ch := range c.chains {
+		for _, p := range ch {
+			if w, ok := p.(pipeline.WorkerAware); ok {
+				w.SetWorkerCount(n)
+			}
+		}
+	}
+}
+
+// Emit collects messages from nested emitters and runs them through the rest
+// of their chain, as the engine does for top-level emitters.
+func (c *composite) Emit(final bool) []pipeline.Message {
+	var out []pipeline.Message
+	for _, ch := range c.chains {
+		for i, p := range ch {
+			em, ok := p.(pipeline.Emitter)
+			if !ok {
+				continue
+			}
+			for _, msg := range em.Emit(final) {
+				res, err := pipeline.RunProcessors(ch[i+1:], msg)
+				if err != nil && !errors.Is(err, pipeline.ErrDropMessage) {
+					log.Printf("Error processing emitted message %s: %v", msg.ID, err)
+				}
+				out = append(out, res...)
+			}
+		}
+	}
+	return out
+}
+
+func (c *composite) Close() error {
+	var errs []error
+	for _, ch := range c.chains {
+		for _, p := range ch {
+			if cl, ok := p.(io.Closer); ok {
+				if err := cl.Close(); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeChains releases the chains built before a construction error.
+func closeChains(chains ...chain) {
+	(&composite{chains: chains}).Close()
+}
+
+// --- If ---
+
+// If runs Processors on messages matching the condition (field, operator,
+// value, all, any, not at the top of its config) and Else on the others.
+// Messages without a matching branch pass through unchanged.
+type If struct {
+	composite
+	Condition  *Condition
+	Processors chain
+	Else       chain
+}
+
+func NewIf(config map[string]interface{}) (pipeline.Processor, error) {
+	cond, err := parseCondition(config)
+	if err != nil {
+		return nil, fmt.Errorf("if: %w", err)
+	}
+	then, err := buildChain(config["processors"])
+	if err != nil {
+		return nil, fmt.Errorf("if: processors: %w", err)
+	}
+	if len(then) == 0 {
+		return nil, fmt.Errorf("if: 'processors' is required")
+	}
+	otherwise, err := buildChain(config["else"])
+	if err != nil {
+		closeChains(then)
+		return nil, fmt.Errorf("if: else: %w", err)
+	}
+	return &If{
+		composite:  composite{chains: []chain{then, otherwise}},
+		Condition:  cond,
+		Processors: then,
+		Else:       otherwise,
+	}, nil
+}
+
+func (p *If) Process(msg pipeline.Message) (pipeline.Message, error) {
+	out, err := p.ProcessMulti(msg)
+	return single(out, err, msg)
+}
+
+func (p *If) ProcessMulti(msg pipeline.Message) ([]pipeline.Message, error) {
+	if p.Condition.Match(msg) {
+		return pipeline.RunProcessors(p.Processors, msg)
+	}
+	return pipeline.RunProcessors(p.Else, msg)
+}
+
+// --- Switch ---
+
+// Switch selects a sub-chain by the value of Field: the entry of Cases whose
+// key equals the value (as text), or Default when none does. Messages
+// without a matching case and no default pass through unchanged.
+type Switch struct {
+	composite
+	Field   string
+	Cases   map[string]chain
+	Default chain
+}
+
+func NewSwitch(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &Switch{
+		Field: getString(config, "field"),
+		Cases: make(map[string]chain),
+	}
+	if p.Field == "" {
+		return nil, fmt.Errorf("switch: 'field' is required")
+	}
+	cases, ok := config["cases"].(map[string]interface{})
+	if !ok || len(cases) == 0 {
+		return nil, fmt.Errorf("switch: 'cases' is required")
+	}
+
+	// Sorted so construction errors and Close order are deterministic
+	keys := make([]string, 0, len(cases))
+	for k := range cases {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ch, err := buildChain(cases[k])
+		if err != nil {
+			closeChains(p.chains...)
+			return nil, fmt.Errorf("switch: case '%s': %w", k, err)
+		}
+		p.Cases[k] = ch
+		p.chains = append(p.chains, ch)
+	}
+
+	var err error
+	if p.Default, err = buildChain(config["default"]); err != nil {
+		closeChains(p.chains...)
+		return nil, fmt.Errorf("switch: default: %w", err)
+	}
+	p.chains = append(p.chains, p.Default)
+	return p, nil
+}
+
+func (p *Switch) Process(msg pipeline.Message) (pipeline.Message, error) {
+	out, err := p.ProcessMulti(msg)
+	return single(out, err, msg)
+}
+
+func (p *Switch) ProcessMulti(msg pipeline.Message) ([]pipeline.Message, error) {
+	procs := p.Default
+	if val := pipeline.LookupRef(msg, p.Field); val != nil {
+		if ch, found := p.Cases[scalarText(val)]; found {
+			procs = ch
+		}
+	}
+	return pipeline.RunProcessors(procs, msg)
+}
@@ -0,0 +1,231 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+func init() {
+	RegisterProcessor("csv_parser", NewCSVParser)
+}
+
+// --- CSV Parser ---
+
+// CSVParser parses delimited text (CSV, semicolon separated, etc.) from a field.
+// Column names come either from the configured header list or from the first
+// record of the payload. A payload with a single data record is expanded into
+// Target (or the root of Data); several records are stored as a list in Target.
+type CSVParser struct {
+	Field           string
+	Target          string
+	Delimiter       rune
+	Quote           rune
+	Headers         []string
+	HeaderFromFirst bool
+	Types           map[string]string // Column -> string, int, float, bool
+	Trim            bool
+	SkipEmpty       bool
+}
+
+func NewCSVParser(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &CSVParser{
+		Field:           getString(config, "field"),
+		Target:          getString(config, "target"),
+		Delimiter:       ',',
+		Quote:           '"',
+		Headers:         getStringSlice(config, "headers"),
+		HeaderFromFirst: getBool(config, "header_from_first_record", false),
+		Types:           getStringMap(config, "types"),
+		Trim:            getBool(config, "trim", false),
+		SkipEmpty:       getBool(config, "skip_empty_lines", true),
+	}
+	if p.Field == "" {
+		p.Field = "raw"
+	}
+
+	if d := getString(config, "delimiter"); d != "" {
+		if d == `\t` {
+			d = "\t"
+		}
+		if utf8.RuneCountInString(d) != 1 {
+			return nil, fmt.Errorf("csv_parser: delimiter must be a single character, got '%s'", d)
+		}
+		p.Delimiter, _ = utf8.DecodeRuneInString(d)
+	}
+	if q, ok := config["quote"].(string); ok {
+		switch utf8.RuneCountInString(q) {
+		case 0:
+			p.Quote = 0 // Quoting disabled
+		case 1:
+			p.Quote, _ = utf8.DecodeRuneInString(q)
+		default:
+			return nil, fmt.Errorf("csv_parser: quote must be a single character, got '%s'", q)
+		}
+	}
+	if p.Quote != 0 && p.Quote == p.Delimiter {
+		return nil, fmt.Errorf("csv_parser: delimiter and quote must differ")
+	}
+
+	if len(p.Headers) == 0 && !p.HeaderFromFirst {
+		return nil, fmt.Errorf("csv_parser: either 'headers' or 'header_from_first_record' must be set")
+	}
+	for col, typ := range p.Types {
+		if !validType(typ) {
+			return nil, fmt.Errorf("csv_parser: column '%s' has unsupported type '%s'", col, typ)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *CSVParser) Process(msg pipeline.Message) (pipeline.Message, error) {
+	raw := GetValue(msg.Data, p.Field)
+	if raw == nil {
+		return msg, fmt.Errorf("field '%s' not found in message data", p.Field)
+	}
+	text, ok := toText(raw)
+	if !ok {
+		return msg, fmt.Errorf("field '%s' is not []byte or string", p.Field)
+	}
+
+	records, err := p.parse(text)
+	if err != nil {
+		return msg, fmt.Errorf("failed to parse csv: %w", err)
+	}
+
+	headers := p.Headers
+	if p.HeaderFromFirst {
+		if len(records) == 0 {
+			return msg, fmt.Errorf("csv payload has no header record")
+		}
+		headers = records[0]
+		if p.Trim {
+			for i := range headers {
+				headers[i] = strings.TrimSpace(headers[i])
+			}
+		}
+		records = records[1:]
+	}
+	if len(records) == 0 {
+		return msg, fmt.Errorf("csv payload has no data records")
+	}
+
+	rows := make([]interface{}, 0, len(records))
+	for i, record := range records {
+		if len(record) != len(headers) {
+			return msg, fmt.Errorf("csv record %d has %d columns, expected %d", i+1, len(record), len(headers))
+		}
+		row := make(map[string]interface{}, len(headers))
+		for j, col := range headers {
+			val := record[j]
+			if p.Trim {
+				val = strings.TrimSpace(val)
+			}
+			typed, err := convertValue(val, p.Types[col])
+			if err != nil {
+				return msg, fmt.Errorf("csv record %d column '%s': %w", i+1, col, err)
+			}
+			row[col] = typed
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 1 {
+		row := rows[0].(map[string]interface{})
+		if p.Target == "" {
+			for k, v := range row {
+				msg.Data[k] = v
+			}
+			return msg, nil
+		}
+		return msg, SetValue(msg.Data, p.Target, row)
+	}
+
+	if p.Target == "" {
+		return msg, fmt.Errorf("csv payload has %d records but no 'target' is configured", len(rows))
+	}
+	return msg, SetValue(msg.Data, p.Target, rows)
+}
+
+// parse splits text into records honoring the configured delimiter and quote
+// character. Inside a quoted value a doubled quote is a literal quote, and
+// delimiters and line breaks are kept as part of the value.
+func (p *CSVParser) parse(text string) ([][]string, error) {
+	var records [][]string
+	var record []string
+	var field strings.Builder
+	inQuotes := false
+	quoted := false // Current field started with a quote
+	line := 1
+
+	endField := func() {
+		record = append(record, field.String())
+		field.Reset()
+		quoted = false
+	}
+	endRecord := func() {
+		endField()
+		if p.SkipEmpty && len(record) == 1 && record[0] == "" {
+			record = nil
+			return
+		}
+		records = append(records, record)
+		record = nil
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if inQuotes {
+			if r == p.Quote {
+				if i+1 < len(runes) && runes[i+1] == p.Quote {
+					field.WriteRune(r)
+					i++
+					continue
+				}
+				inQuotes = false
+				continue
+			}
+			if r == '\n' {
+				line++
+			}
+			field.WriteRune(r)
+			continue
+		}
+
+		switch {
+		case p.Quote != 0 && r == p.Quote:
+			if field.Len() > 0 && !(p.Trim && strings.TrimSpace(field.String()) == "") {
+				return nil, fmt.Errorf("line %d: unexpected quote in unquoted field", line)
+			}
+			if quoted {
+				return nil, fmt.Errorf("line %d: extraneous quote in quoted field", line)
+			}
+			field.Reset()
+			inQuotes = true
+			quoted = true
+		case r == p.Delimiter:
+			endField()
+		case r == '\r' && i+1 < len(runes) && runes[i+1] == '\n':
+			// Handled by the following '\n'
+		case r == '\n':
+			endRecord()
+			line++
+		default:
+			if quoted && !(p.Trim && (r == ' ' || r == '\t')) {
+				return nil, fmt.Errorf("line %d: extraneous data after quoted field", line)
+			}
+			field.WriteRune(r)
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("line %d: unterminated quoted field", line)
+	}
+	if field.Len() > 0 || len(record) > 0 || quoted {
+		endRecord()
+	}
+	return records, nil
+}
@@ -0,0 +1,311 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // The runtime image has no zoneinfo database
+)
+
+func init() {
+	RegisterProcessor("date", NewDate)
+}
+
+// --- Date ---
+
+// Date parses a timestamp field using a list of candidate formats and writes
+// it normalized to Target. Formats may be "unix", "unix_ms", "unix_ns",
+// named layouts such as "RFC3339"/"ISO8601", Go reference layouts
+// ("02/01/2006 15:04") or Joda style patterns ("dd/MM/yyyy HH:mm").
+type Date struct {
+	Field          string
+	Target         string
+	Formats        []string
+	Location       *time.Location // Used for layouts without a zone
+	OutputLocation *time.Location
+	OutputFormat   string
+	UseMetadata    bool // Fall back to Metadata["timestamp"]
+}
+
+// namedLayouts maps well known layout names to Go layouts.
+var namedLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339NANO": time.RFC3339Nano,
+	"ISO8601":     "2006-01-02T15:04:05.999999999Z07:00",
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"HTTPDATE":    "02/Jan/2006:15:04:05 -0700",
+	"DATETIME":    time.DateTime,
+	"DATE":        time.DateOnly,
+}
+
+func NewDate(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &Date{
+		Field:        getString(config, "field"),
+		Target:       getString(config, "target"),
+		Formats:      getStringSlice(config, "formats"),
+		OutputFormat: getString(config, "output_format"),
+		UseMetadata:  getBool(config, "fallback_to_metadata", false),
+		Location:     time.UTC,
+	}
+	if p.Field == "" && !p.UseMetadata {
+		return nil, fmt.Errorf("date: 'field' is required unless 'fallback_to_metadata' is set")
+	}
+	if p.Target == "" {
+		p.Target = "@timestamp"
+	}
+	if len(p.Formats) == 0 {
+		p.Formats = []string{"ISO8601"}
+	}
+	if p.OutputFormat == "" {
+		p.OutputFormat = "rfc3339"
+	}
+
+	for i, f := range p.Formats {
+		switch strings.ToLower(f) {
+		case "unix", "unix_ms", "unix_ns":
+			p.Formats[i] = strings.ToLower(f)
+			continue
+		}
+		p.Formats[i] = toGoLayout(f)
+	}
+
+	var err error
+	if tz := getString(config, "timezone"); tz != "" {
+		if p.Location, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("date: invalid timezone: %w", err)
+		}
+	}
+	p.OutputLocation = time.UTC
+	if tz := getString(config, "output_timezone"); tz != "" {
+		if p.OutputLocation, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("date: invalid output_timezone: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *Date) Process(msg pipeline.Message) (pipeline.Message, error) {
+	var t time.Time
+	var parseErr error
+
+	if p.Field != "" {
+		if val := GetValue(msg.Data, p.Field); val != nil {
+			t, parseErr = p.parse(val)
+		} else {
+			parseErr = fmt.Errorf("date field '%s' missing", p.Field)
+		}
+	}
+
+	if t.IsZero() {
+		if !p.UseMetadata {
+			return msg, parseErr
+		}
+		ts, ok := msg.Metadata["timestamp"]
+		if !ok {
+			return msg, fmt.Errorf("date field '%s' unusable and metadata timestamp missing: %v", p.Field, parseErr)
+		}
+		var err error
+		if t, err = time.Parse(time.RFC3339, ts); err != nil {
+			return msg, fmt.Errorf("failed to parse metadata timestamp: %w", err)
+		}
+	}
+
+	if err := SetValue(msg.Data, p.Target, p.format(t.In(p.OutputLocation))); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// parse tries every configured format in order.
+func (p *Date) parse(val interface{}) (time.Time, error) {
+	for _, format := range p.Formats {
+		switch format {
+		case "unix", "unix_ms", "unix_ns":
+			if t, ok := parseEpoch(val, format); ok {
+				return t, nil
+			}
+		default:
+			text, ok := val.(string)
+			if !ok {
+				continue
+			}
+			if t, err := time.ParseInLocation(format, strings.TrimSpace(text), p.Location); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("date value '%v' does not match any of the formats %v", val, p.Formats)
+}
+
+func (p *Date) format(t time.Time) interface{} {
+	switch strings.ToLower(p.OutputFormat) {
+	case "rfc3339":
+		return t.Format(time.RFC3339)
+	case "rfc3339nano", "iso8601":
+		return t.Format(time.RFC3339Nano)
+	case "unix":
+		return t.Unix()
+	case "unix_ms":
+		return t.UnixMilli()
+	case "unix_ns":
+		return t.UnixNano()
+	default:
+		return t.Format(toGoLayout(p.OutputFormat))
+	}
+}
+
+// parseEpoch interprets numbers (or numeric strings) as an epoch in the given unit.
+func parseEpoch(val interface{}, unit string) (time.Time, bool) {
+	var f float64
+	switch v := val.(type) {
+	case float64:
+		f = v
+	case int:
+		f = float64(v)
+	case int64:
+		if unit == "unix_ns" {
+			return time.Unix(0, v), true
+		}
+		f = float64(v)
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if unit == "unix_ns" {
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return time.Unix(0, i), true
+			}
+		}
+		f = n
+	default:
+		return time.Time{}, false
+	}
+
+	switch unit {
+	case "unix_ms":
+		return time.UnixMilli(0).Add(time.Duration(f * float64(time.Millisecond))), true
+	case "unix_ns":
+		return time.Unix(0, int64(f)), true
+	default:
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+}
+
+// toGoLayout resolves named layouts and converts Joda style patterns
+// (yyyy-MM-dd HH:mm:ss) to Go reference layouts. Layouts that already use the
+// Go reference date are returned unchanged.
+func toGoLayout(format string) string {
+	if layout, ok := namedLayouts[strings.ToUpper(format)]; ok {
+		return layout
+	}
+	if strings.Contains(format, "2006") || strings.Contains(format, "15:04") {
+		return format
+	}
+
+	var b strings.Builder
+	runes := []rune(format)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		// Quoted literal text, '' is a literal quote
+		if r == '\'' {
+			j := i + 1
+			for j < len(runes) && runes[j] != '\'' {
+				b.WriteRune(runes[j])
+				j++
+			}
+			if j == i+1 && j < len(runes) {
+				b.WriteRune('\'')
+			}
+			i = j + 1
+			continue
+		}
+
+		n := 1
+		for i+n < len(runes) && runes[i+n] == r {
+			n++
+		}
+		switch r {
+		case 'y', 'Y', 'u':
+			if n == 2 {
+				b.WriteString("06")
+			} else {
+				b.WriteString("2006")
+			}
+		case 'M':
+			switch {
+			case n >= 4:
+				b.WriteString("January")
+			case n == 3:
+				b.WriteString("Jan")
+			case n == 2:
+				b.WriteString("01")
+			default:
+				b.WriteString("1")
+			}
+		case 'd':
+			if n >= 2 {
+				b.WriteString("02")
+			} else {
+				b.WriteString("2")
+			}
+		case 'D':
+			b.WriteString("002")
+		case 'H':
+			b.WriteString("15")
+		case 'h':
+			if n >= 2 {
+				b.WriteString("03")
+			} else {
+				b.WriteString("3")
+			}
+		case 'm':
+			if n >= 2 {
+				b.WriteString("04")
+			} else {
+				b.WriteString("4")
+			}
+		case 's':
+			if n >= 2 {
+				b.WriteString("05")
+			} else {
+				b.WriteString("5")
+			}
+		case 'S':
+			b.WriteString(strings.Repeat("0", n))
+		case 'a':
+			b.WriteString("PM")
+		case 'E':
+			if n >= 4 {
+				b.WriteString("Monday")
+			} else {
+				b.WriteString("Mon")
+			}
+		case 'z':
+			b.WriteString("MST")
+		case 'Z':
+			if n == 2 {
+				b.WriteString("-07:00")
+			} else {
+				b.WriteString("-0700")
+			}
+		case 'X':
+			if n >= 3 {
+				b.WriteString("Z07:00")
+			} else {
+				b.WriteString("Z0700")
+			}
+		default:
+			b.WriteString(string(runes[i : i+n]))
+		}
+		i += n
+	}
+	return b.String()
+}
@@ -0,0 +1,276 @@
+package processors
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"datapipeline/pkg/pipeline"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterProcessor("dedupe", NewDedupe)
+}
+
+// --- Dedupe ---
+
+// Dedupe drops messages whose key was already written to the sink. The key is
+// built from Fields (or Message.ID when no fields are configured) and kept in
+// a bounded in-memory store with TTL.
+//
+// Keys are only remembered once their batch was written (OnBatchWritten), so
+// a batch that failed in the sink is not mistaken for a duplicate when Kafka
+// redelivers it. Until then a key is reserved, so duplicates within the same
+// or a concurrent batch are dropped too; the reservation is released when the
+// batch fails (OnBatchFailed) or, for messages dropped further down the
+// chain, after ReservationTTL. With PersistPath set the store is also
+// appended to a local file and reloaded on start, so restarts don't forget
+// recent keys.
+type Dedupe struct {
+	Fields         []string
+	TTL            time.Duration
+	ReservationTTL time.Duration
+	MetadataKey    string // Metadata entry carrying the computed key
+	PersistPath    string
+
+	seen       *lruCache
+	inFlight   *lruCache  // Reserved keys of messages not written yet
+	reserveMu  sync.Mutex // Makes the lookup and the reservation atomic
+	duplicates atomic.Int64
+
+	mu       sync.Mutex // Guards the persistence file
+	file     *os.File
+	writer   *bufio.Writer
+	appended int
+	maxKeys  int
+}
+
+func NewDedupe(config map[string]interface{}) (pipeline.Processor, error) {
+	ttl, err := getDuration(config, "ttl", 24*time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("dedupe: %w", err)
+	}
+	reservationTTL, err := getDuration(config, "reservation_ttl", 10*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("dedupe: %w", err)
+	}
+	p := &Dedupe{
+		Fields:         getStringSlice(config, "fields"),
+		TTL:            ttl,
+		ReservationTTL: reservationTTL,
+		MetadataKey:    getString(config, "metadata_key"),
+		PersistPath:    getString(config, "persist_path"),
+		maxKeys:        getInt(config, "max_keys", 1000000),
+	}
+	if p.MetadataKey == "" {
+		p.MetadataKey = "dedupe_key"
+	}
+	p.seen = newLRUCache(p.maxKeys, ttl)
+	p.inFlight = newLRUCache(p.maxKeys, reservationTTL)
+
+	if p.PersistPath != "" {
+		if err := p.load(); err != nil {
+			return nil, fmt.Errorf("dedupe: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *Dedupe) Process(msg pipeline.Message) (pipeline.Message, error) {
+	key, ok := p.key(msg)
+	if !ok {
+		// Without a key the message cannot be deduplicated, let it through
+		return msg, nil
+	}
+	if !p.reserve(key) {
+		p.duplicates.Add(1)
+		return msg, fmt.Errorf("%w: duplicate key %s", pipeline.ErrDropMessage, key)
+	}
+
+	if msg.Metadata == nil {
+		msg.Metadata = make(map[string]string)
+	}
+	msg.Metadata[p.MetadataKey] = key
+	return msg, nil
+}
+
+// reserve claims key for a message on its way to the sink, reporting false
+// when the key was already written or is reserved by another message.
+func (p *Dedupe) reserve(key string) bool {
+	p.reserveMu.Lock()
+	defer p.reserveMu.Unlock()
+
+	if _, dup := p.seen.Get(key); dup {
+		return false
+	}
+	return !p.inFlight.Add(key, nil)
+}
+
+// key hashes the configured fields (or the message ID) into a fixed size key.
+func (p *Dedupe) key(msg pipeline.Message) (string, bool) {
+	h := sha256.New()
+	if len(p.Fields) == 0 {
+		if msg.ID == "" {
+			return "", false
+		}
+		h.Write([]byte(msg.ID))
+	} else {
+		for _, field := range p.Fields {
+			val := GetValue(msg.Data, field)
+			if val == nil {
+				return "", false
+			}
+			if b, ok := val.([]byte); ok {
+				val = string(b)
+			}
+			fmt.Fprintf(h, "%v\x1f", val)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), true
+}
+
+// OnBatchWritten remembers the keys of messages that reached the sink.
+func (p *Dedupe) OnBatchWritten(msgs []pipeline.Message) {
+	expires := time.Now().Add(p.TTL)
+	var lines strings.Builder
+	for _, msg := range msgs {
+		key, ok := msg.Metadata[p.MetadataKey]
+		if !ok {
+			continue
+		}
+		p.seen.AddUntil(key, nil, expires)
+		p.inFlight.Remove(key)
+		if p.PersistPath != "" {
+			fmt.Fprintf(&lines, "%d %s\n", expires.Unix(), key)
+		}
+	}
+	if lines.Len() > 0 {
+		if err := p.persist(lines.String()); err != nil {
+			log.Printf("dedupe: failed to persist keys: %v", err)
+		}
+	}
+}
+
+// OnBatchFailed releases the reservations of messages that were not written,
+// so their redelivery isn't taken for a duplicate.
+func (p *Dedupe) OnBatchFailed(msgs []pipeline.Message) {
+	for _, msg := range msgs {
+		if key, ok := msg.Metadata[p.MetadataKey]; ok {
+			p.inFlight.Remove(key)
+		}
+	}
+}
+
+// Duplicates returns how many duplicates were dropped so far.
+func (p *Dedupe) Duplicates() int64 {
+	return p.duplicates.Load()
+}
+
+// load reads the persisted keys, skipping expired ones, and compacts the file.
+func (p *Dedupe) load() error {
+	f, err := os.Open(p.PersistPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		now := time.Now()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			ts, key, ok := strings.Cut(scanner.Text(), " ")
+			if !ok {
+				continue // Torn write from a crash
+			}
+			unix, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				continue
+			}
+			if expires := time.Unix(unix, 0); expires.After(now) {
+				p.seen.AddUntil(key, nil, expires)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read %s: %w", p.PersistPath, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compact()
+}
+
+func (p *Dedupe) persist(lines string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.writer.WriteString(lines); err != nil {
+		return err
+	}
+	if err := p.writer.Flush(); err != nil {
+		return err
+	}
+	p.appended += strings.Count(lines, "\n")
+	if p.appended > 2*p.maxKeys {
+		return p.compact()
+	}
+	return nil
+}
+
+// compact rewrites the file with the live keys only and reopens it for appends.
+// Callers must hold p.mu.
+func (p *Dedupe) compact() error {
+	tmpPath := p.PersistPath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	count := 0
+	p.seen.Each(func(key string, _ interface{}, expires time.Time) {
+		fmt.Fprintf(w, "%d %s\n", expires.Unix(), key)
+		count++
+	})
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if p.file != nil {
+		p.file.Close()
+	}
+	if err := os.Rename(tmpPath, p.PersistPath); err != nil {
+		return err
+	}
+	if p.file, err = os.OpenFile(p.PersistPath, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	p.writer = bufio.NewWriter(p.file)
+	p.appended = count
+	return nil
+}
+
+func (p *Dedupe) Close() error {
+	if n := p.Duplicates(); n > 0 {
+		log.Printf("dedupe: dropped %d duplicate messages", n)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil {
+		return nil
+	}
+	if err := p.writer.Flush(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
@@ -0,0 +1,417 @@
+package processors
+
+import (
+	"context"
+	"database/sql"
+	"datapipeline/pkg/pipeline"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/denisenkom/go-mssqldb"
+)
+
+func init() {
+	RegisterProcessor("enrich", NewEnrich)
+}
+
+// --- Enrich ---
+
+// Enrich joins messages with a lookup table on Key and copies lookup columns
+// into the message. The table is loaded from a CSV/JSON file or a SQL query
+// (reloaded every refresh_interval), or looked up key by key with a
+// parameterized SQL query. Loaded tables are read directly, so a refresh
+// takes effect at once; query lookups go through an LRU cache with TTL,
+// misses included.
+//
+// OnMiss decides what happens when the key is not found: "pass" keeps the
+// message untouched, "default" writes Defaults and "drop" discards it.
+type Enrich struct {
+	Key      string
+	Columns  map[string]string // Lookup column -> message path
+	Target   string            // Used when Columns is empty: whole row under Target
+	OnMiss   string
+	Defaults map[string]interface{} // Lookup column -> value
+
+	cache        *lruCache // Query lookups only
+	table        *lookupTable
+	db           *sql.DB
+	lookupQuery  string
+	queryTimeout time.Duration
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// lookupTable holds a fully loaded lookup table that can be swapped on refresh.
+type lookupTable struct {
+	mu   sync.RWMutex
+	rows map[string]map[string]interface{}
+	load func() (map[string]map[string]interface{}, error)
+}
+
+func (t *lookupTable) refresh() error {
+	rows, err := t.load()
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.rows = rows
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *lookupTable) get(key string) (map[string]interface{}, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	row, ok := t.rows[key]
+	return row, ok
+}
+
+// enrichMiss is cached for keys that are not in the lookup source.
+var enrichMiss = struct{}{}
+
+func NewEnrich(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &Enrich{
+		Key:      getString(config, "key"),
+		Columns:  getStringMap(config, "columns"),
+		Target:   getString(config, "target"),
+		OnMiss:   getString(config, "on_miss"),
+		Defaults: make(map[string]interface{}),
+		stop:     make(chan struct{}),
+	}
+	if p.Key == "" {
+		return nil, fmt.Errorf("enrich: 'key' is required")
+	}
+	if len(p.Columns) == 0 && p.Target == "" {
+		return nil, fmt.Errorf("enrich: either 'columns' or 'target' is required")
+	}
+	if d, ok := config["defaults"].(map[string]interface{}); ok {
+		p.Defaults = d
+	}
+	switch p.OnMiss {
+	case "":
+		p.OnMiss = "pass"
+	case "pass", "drop", "default":
+	default:
+		return nil, fmt.Errorf("enrich: on_miss must be 'pass', 'drop' or 'default', got '%s'", p.OnMiss)
+	}
+
+	source, ok := config["source"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("enrich: 'source' is required")
+	}
+	if err := p.openSource(source); err != nil {
+		if p.db != nil {
+			p.db.Close()
+		}
+		return nil, fmt.Errorf("enrich: %w", err)
+	}
+	if p.table == nil {
+		ttl, err := getDuration(config, "cache_ttl", 5*time.Minute)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("enrich: %w", err)
+		}
+		p.cache = newLRUCache(getInt(config, "cache_size", 10000), ttl)
+	}
+	return p, nil
+}
+
+func (p *Enrich) openSource(source map[string]interface{}) error {
+	keyColumn := getString(source, "key_column")
+	refresh, err := getDuration(source, "refresh_interval", 0)
+	if err != nil {
+		return err
+	}
+	if p.queryTimeout, err = getDuration(source, "query_timeout", 5*time.Second); err != nil {
+		return err
+	}
+
+	switch sourceType := getString(source, "type"); sourceType {
+	case "csv", "json":
+		path := getString(source, "path")
+		if path == "" || keyColumn == "" {
+			return fmt.Errorf("%s source requires 'path' and 'key_column'", sourceType)
+		}
+		delimiter := getString(source, "delimiter")
+		p.table = &lookupTable{load: func() (map[string]map[string]interface{}, error) {
+			if sourceType == "csv" {
+				return loadCSVLookup(path, keyColumn, delimiter)
+			}
+			return loadJSONLookup(path, keyColumn)
+		}}
+
+	case "sql":
+		driver := getString(source, "driver")
+		if driver == "" {
+			driver = "sqlserver"
+		}
+		db, err := sql.Open(driver, getString(source, "dsn"))
+		if err != nil {
+			return err
+		}
+		p.db = db
+
+		if lookup := getString(source, "lookup_query"); lookup != "" {
+			// Key by key, e.g. "SELECT segment, region FROM Customers WHERE id = @p1"
+			p.lookupQuery = lookup
+			return db.Ping()
+		}
+		query := getString(source, "query")
+		if query == "" || keyColumn == "" {
+			return fmt.Errorf("sql source requires 'key_column' with 'query', or 'lookup_query'")
+		}
+		p.table = &lookupTable{load: func() (map[string]map[string]interface{}, error) {
+			return p.loadSQLLookup(query, keyColumn)
+		}}
+
+	default:
+		return fmt.Errorf("unknown source type '%s'", sourceType)
+	}
+
+	if err := p.table.refresh(); err != nil {
+		return fmt.Errorf("failed to load lookup table: %w", err)
+	}
+	if refresh > 0 {
+		p.wg.Add(1)
+		go p.refreshLoop(refresh)
+	}
+	return nil
+}
+
+func (p *Enrich) refreshLoop(interval time.Duration) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if err := p.table.refresh(); err != nil {
+				// Keep serving the previous table
+				log.Printf("enrich: failed to refresh lookup table: %v", err)
+			}
+		}
+	}
+}
+
+func (p *Enrich) Process(msg pipeline.Message) (pipeline.Message, error) {
+	key := GetValue(msg.Data, p.Key)
+	var row map[string]interface{}
+	if key != nil {
+		var err error
+		if row, err = p.lookup(scalarText(key)); err != nil {
+			return msg, fmt.Errorf("enrich lookup failed: %w", err)
+		}
+	}
+
+	if row == nil {
+		switch p.OnMiss {
+		case "drop":
+			return msg, fmt.Errorf("%w: enrich key '%v' not found", pipeline.ErrDropMessage, key)
+		case "default":
+			row = p.Defaults
+		default:
+			return msg, nil
+		}
+	}
+
+	if len(p.Columns) == 0 {
+		return msg, SetValue(msg.Data, p.Target, deepCopy(row))
+	}
+	for column, path := range p.Columns {
+		val, ok := row[column]
+		if !ok {
+			continue
+		}
+		if err := SetValue(msg.Data, path, deepCopy(val)); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// lookup returns the row for key or nil when it does not exist.
+func (p *Enrich) lookup(key string) (map[string]interface{}, error) {
+	if p.table != nil {
+		row, _ := p.table.get(key)
+		return row, nil
+	}
+	if cached, ok := p.cache.Get(key); ok {
+		if cached == enrichMiss {
+			return nil, nil
+		}
+		return cached.(map[string]interface{}), nil
+	}
+
+	row, err := p.queryRow(key)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		p.cache.Add(key, enrichMiss)
+	} else {
+		p.cache.Add(key, row)
+	}
+	return row, nil
+}
+
+func (p *Enrich) queryRow(key string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.queryTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, p.lookupQuery, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result, err := scanRows(rows, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range result {
+		return row, nil
+	}
+	return nil, nil
+}
+
+func (p *Enrich) loadSQLLookup(query, keyColumn string) (map[string]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.queryTimeout)
+	defer cancel()
+
+	rows, err := p.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRows(rows, keyColumn)
+}
+
+// scanRows reads every row into a map keyed by keyColumn. With an empty
+// keyColumn only the first row is returned, under the empty key.
+func scanRows(rows *sql.Rows, keyColumn string) (map[string]map[string]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]interface{})
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b) // DECIMAL and (VAR)CHAR come back as bytes
+			}
+			row[col] = values[i]
+		}
+		if keyColumn == "" {
+			result[""] = row
+			break
+		}
+		if key, ok := row[keyColumn]; ok && key != nil {
+			result[scalarText(key)] = row
+		}
+	}
+	return result, rows.Err()
+}
+
+func loadCSVLookup(path, keyColumn, delimiter string) (map[string]map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	if delimiter != "" {
+		r.Comma = []rune(delimiter)[0]
+	}
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: missing header", path)
+	}
+
+	header := records[0]
+	keyIdx := -1
+	for i, col := range header {
+		header[i] = strings.TrimSpace(col)
+		if header[i] == keyColumn {
+			keyIdx = i
+		}
+	}
+	if keyIdx < 0 {
+		return nil, fmt.Errorf("%s: key column '%s' not in header", path, keyColumn)
+	}
+
+	result := make(map[string]map[string]interface{}, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, col := range header {
+			row[col] = record[i]
+		}
+		result[record[keyIdx]] = row
+	}
+	return result, nil
+}
+
+// loadJSONLookup reads either an array of objects or an object of objects.
+func loadJSONLookup(path, keyColumn string) (map[string]map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []map[string]interface{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		var byKey map[string]map[string]interface{}
+		if err2 := json.Unmarshal(data, &byKey); err2 != nil {
+			return nil, fmt.Errorf("%s: expected an array or an object of objects: %w", path, err)
+		}
+		for k, row := range byKey {
+			if _, ok := row[keyColumn]; !ok {
+				row[keyColumn] = k
+			}
+			list = append(list, row)
+		}
+	}
+
+	result := make(map[string]map[string]interface{}, len(list))
+	for _, row := range list {
+		if key, ok := row[keyColumn]; ok && key != nil {
+			result[scalarText(key)] = row
+		}
+	}
+	return result, nil
+}
+
+// Close stops the refresh and closes the database; later calls do nothing.
+func (p *Enrich) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+		if p.db != nil {
+			err = p.db.Close()
+		}
+	})
+	return err
+}
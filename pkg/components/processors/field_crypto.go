@@ -0,0 +1,360 @@
+package processors
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"datapipeline/pkg/pipeline"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterProcessor("encrypt_fields", NewFieldEncryptor)
+	RegisterProcessor("decrypt_fields", NewFieldDecryptor)
+}
+
+// --- Field Encryption ---
+//
+// Values are encrypted with AES-256-GCM using a random data key (DEK). The DEK
+// is itself encrypted ("wrapped") with a master key loaded from a local
+// keyfile and stored next to the ciphertext, so master keys can be rotated
+// without reprocessing: old envelopes name the master key they were wrapped
+// with and keep decrypting as long as that key stays in the keyfile.
+//
+// Envelope: "enc:v1:" + base64( kidLen(1) | kid | wrappedLen(2) | wrappedDEK | nonce(12) | ciphertext )
+// where wrappedDEK is nonce(12) | AES-GCM(master, DEK). The plaintext is the
+// JSON encoding of the original value, so numbers and objects round-trip.
+// The value's AAD is the header followed by the optional context, a label
+// that encrypt_fields and decrypt_fields must both be configured with (e.g.
+// "customers.v1"). The field path is not part of it, so values still decrypt
+// after being moved, flattened or written to a column of another name.
+//
+// Keyfile (JSON):
+//
+//	{"active": "2024-01", "keys": {"2024-01": "<base64 32 byte key>"}}
+
+const envelopePrefix = "enc:v1:"
+
+// dataKeyMaxUses bounds how many values one data key encrypts before a new
+// one is generated, keeping random GCM nonces far from collision bounds.
+const dataKeyMaxUses = 1 << 24
+
+type keyring struct {
+	Active string
+	Keys   map[string]cipher.AEAD
+}
+
+func loadKeyring(path string) (*keyring, error) {
+	if path == "" {
+		return nil, fmt.Errorf("'keyfile' is required")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	var file struct {
+		Active string            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse keyfile: %w", err)
+	}
+
+	kr := &keyring{Active: file.Active, Keys: make(map[string]cipher.AEAD)}
+	for id, encoded := range file.Keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, fmt.Errorf("keyfile: key id '%s' must have 1 to 255 bytes", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("keyfile: key '%s' is not valid base64: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("keyfile: key '%s' must be 32 bytes for AES-256, got %d", id, len(key))
+		}
+		if kr.Keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+	}
+	if len(kr.Keys) == 0 {
+		return nil, fmt.Errorf("keyfile has no keys")
+	}
+	return kr, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD encrypts plaintext with a random nonce, returning nonce|ciphertext.
+func sealAEAD(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// openAEAD reverses sealAEAD.
+func openAEAD(aead cipher.AEAD, data, aad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// --- Encrypt Fields ---
+
+type FieldEncryptor struct {
+	Fields  []string
+	Context string
+	keys    *keyring
+	keyID   string
+
+	mu      sync.Mutex
+	dek     cipher.AEAD
+	wrapped []byte
+	uses    int
+}
+
+func NewFieldEncryptor(config map[string]interface{}) (pipeline.Processor, error) {
+	fields := getStringSlice(config, "fields")
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("encrypt_fields: 'fields' is required")
+	}
+	keys, err := loadKeyring(getString(config, "keyfile"))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt_fields: %w", err)
+	}
+	keyID := getString(config, "key_id")
+	if keyID == "" {
+		keyID = keys.Active
+	}
+	if _, ok := keys.Keys[keyID]; !ok {
+		return nil, fmt.Errorf("encrypt_fields: master key '%s' not found in keyfile", keyID)
+	}
+	return &FieldEncryptor{Fields: fields, Context: getString(config, "context"), keys: keys, keyID: keyID}, nil
+}
+
+// dataKey returns the current data key and its header, rotating it when worn out.
+func (p *FieldEncryptor) dataKey() (cipher.AEAD, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dek == nil || p.uses >= dataKeyMaxUses {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		dek, err := newGCM(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		wrappedDEK, err := sealAEAD(p.keys.Keys[p.keyID], raw, []byte(p.keyID))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		header := make([]byte, 0, 1+len(p.keyID)+2+len(wrappedDEK))
+		header = append(header, byte(len(p.keyID)))
+		header = append(header, p.keyID...)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(wrappedDEK)))
+		header = append(header, wrappedDEK...)
+
+		p.dek, p.wrapped, p.uses = dek, header, 0
+	}
+	p.uses++
+	return p.dek, p.wrapped, nil
+}
+
+// valueAAD binds a value's ciphertext to its data key header and context.
+// The header encodes its own length, so the concatenation is unambiguous.
+func valueAAD(header []byte, context string) []byte {
+	aad := make([]byte, 0, len(header)+len(context))
+	aad = append(aad, header...)
+	return append(aad, context...)
+}
+
+// envelope is a parsed "enc:v1:" value.
+type envelope struct {
+	kid        string
+	header     []byte // kidLen | kid | wrappedLen | wrapped
+	wrapped    []byte
+	ciphertext []byte
+}
+
+// parseEnvelope decodes s, reporting false when it is not a well formed
+// envelope (e.g. plaintext that happens to start with the prefix).
+func parseEnvelope(s string) (envelope, bool) {
+	encoded, ok := strings.CutPrefix(s, envelopePrefix)
+	if !ok {
+		return envelope{}, false
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < 1 {
+		return envelope{}, false
+	}
+	kidLen := int(data[0])
+	if kidLen == 0 || len(data) < 1+kidLen+2 {
+		return envelope{}, false
+	}
+	wrappedLen := int(binary.BigEndian.Uint16(data[1+kidLen:]))
+	headerLen := 1 + kidLen + 2 + wrappedLen
+	// The wrapped key and the value each carry a nonce and a GCM tag
+	if wrappedLen < 12+16+32 || len(data) < headerLen+12+16 {
+		return envelope{}, false
+	}
+	return envelope{
+		kid:        string(data[1 : 1+kidLen]),
+		header:     data[:headerLen],
+		wrapped:    data[1+kidLen+2 : headerLen],
+		ciphertext: data[headerLen:],
+	}, true
+}
+
+func (p *FieldEncryptor) Process(msg pipeline.Message) (pipeline.Message, error) {
+	for _, field := range p.Fields {
+		val := GetValue(msg.Data, field)
+		if val == nil {
+			continue
+		}
+		if s, ok := val.(string); ok {
+			if _, ok := parseEnvelope(s); ok {
+				continue // Already encrypted
+			}
+		}
+		if b, ok := val.([]byte); ok {
+			val = string(b)
+		}
+		plaintext, err := json.Marshal(val)
+		if err != nil {
+			return msg, fmt.Errorf("encrypt_fields '%s': %w", field, err)
+		}
+
+		dek, header, err := p.dataKey()
+		if err != nil {
+			return msg, fmt.Errorf("encrypt_fields: failed to create data key: %w", err)
+		}
+		ciphertext, err := sealAEAD(dek, plaintext, valueAAD(header, p.Context))
+		if err != nil {
+			return msg, fmt.Errorf("encrypt_fields '%s': %w", field, err)
+		}
+
+		envelope := make([]byte, 0, len(header)+len(ciphertext))
+		envelope = append(envelope, header...)
+		envelope = append(envelope, ciphertext...)
+		if err := SetValue(msg.Data, field, envelopePrefix+base64.StdEncoding.EncodeToString(envelope)); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// --- Decrypt Fields ---
+
+type FieldDecryptor struct {
+	Fields          []string
+	Context         string
+	SkipUnencrypted bool
+	keys            *keyring
+
+	mu   sync.Mutex
+	deks map[string]cipher.AEAD // Wrapped header -> unwrapped data key
+}
+
+// maxCachedDataKeys bounds the unwrapped data key cache of a decryptor.
+const maxCachedDataKeys = 1024
+
+func NewFieldDecryptor(config map[string]interface{}) (pipeline.Processor, error) {
+	fields := getStringSlice(config, "fields")
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("decrypt_fields: 'fields' is required")
+	}
+	keys, err := loadKeyring(getString(config, "keyfile"))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt_fields: %w", err)
+	}
+	return &FieldDecryptor{
+		Fields:          fields,
+		Context:         getString(config, "context"),
+		SkipUnencrypted: getBool(config, "skip_unencrypted", false),
+		keys:            keys,
+		deks:            make(map[string]cipher.AEAD),
+	}, nil
+}
+
+func (p *FieldDecryptor) Process(msg pipeline.Message) (pipeline.Message, error) {
+	for _, field := range p.Fields {
+		val := GetValue(msg.Data, field)
+		if val == nil {
+			continue
+		}
+		s, _ := val.(string)
+		env, ok := parseEnvelope(s)
+		if !ok {
+			if p.SkipUnencrypted {
+				continue
+			}
+			return msg, fmt.Errorf("decrypt_fields '%s': value is not an encrypted envelope", field)
+		}
+
+		plain, err := p.decrypt(env)
+		if err != nil {
+			return msg, fmt.Errorf("decrypt_fields '%s': %w", field, err)
+		}
+		var out interface{}
+		if err := json.Unmarshal(plain, &out); err != nil {
+			return msg, fmt.Errorf("decrypt_fields '%s': invalid plaintext: %w", field, err)
+		}
+		if err := SetValue(msg.Data, field, out); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+func (p *FieldDecryptor) decrypt(env envelope) ([]byte, error) {
+	dek, err := p.dataKey(env.kid, env.header, env.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(dek, env.ciphertext, valueAAD(env.header, p.Context))
+}
+
+// dataKey unwraps (or returns the cached) data key of an envelope.
+func (p *FieldDecryptor) dataKey(kid string, header, wrapped []byte) (cipher.AEAD, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if dek, ok := p.deks[string(header)]; ok {
+		return dek, nil
+	}
+	master, ok := p.keys.Keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("master key '%s' not found in keyfile", kid)
+	}
+	raw, err := openAEAD(master, wrapped, []byte(kid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	dek, err := newGCM(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.deks) >= maxCachedDataKeys {
+		p.deks = make(map[string]cipher.AEAD)
+	}
+	p.deks[string(header)] = dek
+	return dek, nil
+}
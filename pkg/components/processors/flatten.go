@@ -0,0 +1,204 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterProcessor("flatten", NewFlatten)
+	RegisterProcessor("unflatten", NewUnflatten)
+}
+
+// --- Flatten ---
+
+// Flatten turns nested maps (and arrays, unless KeepArrays) into top level
+// keys joined by Separator, e.g. {"a": {"b": 1}} becomes {"a.b": 1} and
+// {"tags": ["x"]} becomes {"tags.0": "x"}. Keys have at most MaxDepth
+// segments, deeper values are kept nested (0 means no limit). With Field set,
+// only that subtree is flattened, keeping the field path as the key prefix.
+type Flatten struct {
+	Field      string
+	Separator  string
+	MaxDepth   int
+	KeepArrays bool
+}
+
+func NewFlatten(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &Flatten{
+		Field:      getString(config, "field"),
+		Separator:  getString(config, "separator"),
+		MaxDepth:   getInt(config, "max_depth", 0),
+		KeepArrays: getBool(config, "keep_arrays", false),
+	}
+	if p.Separator == "" {
+		p.Separator = "."
+	}
+	if p.MaxDepth < 0 {
+		return nil, fmt.Errorf("flatten: 'max_depth' must not be negative")
+	}
+	return p, nil
+}
+
+func (p *Flatten) Process(msg pipeline.Message) (pipeline.Message, error) {
+	if p.Field == "" {
+		flat := make(map[string]interface{}, len(msg.Data))
+		for k, v := range msg.Data {
+			p.flatten(flat, k, v, 1)
+		}
+		msg.Data = flat
+		return msg, nil
+	}
+
+	val := GetValue(msg.Data, p.Field)
+	if val == nil {
+		return msg, nil
+	}
+	DeleteValue(msg.Data, p.Field)
+	prefix := strings.ReplaceAll(p.Field, ".", p.Separator)
+	p.flatten(msg.Data, prefix, val, strings.Count(p.Field, ".")+1)
+	return msg, nil
+}
+
+func (p *Flatten) flatten(out map[string]interface{}, key string, val interface{}, depth int) {
+	// Keys never have more than MaxDepth segments
+	if p.MaxDepth > 0 && depth >= p.MaxDepth {
+		out[key] = val
+		return
+	}
+	switch t := val.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			out[key] = t
+			return
+		}
+		for k, v := range t {
+			p.flatten(out, key+p.Separator+k, v, depth+1)
+		}
+	case []interface{}:
+		if p.KeepArrays || len(t) == 0 {
+			out[key] = t
+			return
+		}
+		for i, v := range t {
+			p.flatten(out, key+p.Separator+strconv.Itoa(i), v, depth+1)
+		}
+	default:
+		out[key] = val
+	}
+}
+
+// --- Unflatten ---
+
+// Unflatten is the reverse of Flatten: keys containing Separator become
+// nested maps, e.g. {"a.b": 1} becomes {"a": {"b": 1}}. With Arrays set,
+// maps whose keys are exactly 0..n-1 are turned back into arrays, as Flatten
+// produced them; it is off by default since objects legitimately keyed by
+// numbers would otherwise become arrays. With Field set, only keys starting
+// with that prefix are nested.
+type Unflatten struct {
+	Field     string
+	Separator string
+	Arrays    bool
+}
+
+func NewUnflatten(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &Unflatten{
+		Field:     getString(config, "field"),
+		Separator: getString(config, "separator"),
+		Arrays:    getBool(config, "arrays", false),
+	}
+	if p.Separator == "" {
+		p.Separator = "."
+	}
+	return p, nil
+}
+
+func (p *Unflatten) Process(msg pipeline.Message) (pipeline.Message, error) {
+	prefix := ""
+	if p.Field != "" {
+		prefix = strings.ReplaceAll(p.Field, ".", p.Separator)
+	}
+
+	// Sorted so that conflicts ("a" and "a.b") resolve the same way every time
+	keys := make([]string, 0, len(msg.Data))
+	for k := range msg.Data {
+		if strings.Contains(k, p.Separator) && (prefix == "" || k == prefix || strings.HasPrefix(k, prefix+p.Separator)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		val := msg.Data[k]
+		delete(msg.Data, k)
+		if err := p.set(msg.Data, strings.Split(k, p.Separator), val); err != nil {
+			return msg, fmt.Errorf("cannot unflatten '%s': %w", k, err)
+		}
+	}
+
+	if p.Arrays {
+		for k, v := range msg.Data {
+			if prefix == "" || k == strings.SplitN(prefix, p.Separator, 2)[0] {
+				msg.Data[k] = toArrays(v)
+			}
+		}
+	}
+	return msg, nil
+}
+
+func (p *Unflatten) set(data map[string]interface{}, parts []string, val interface{}) error {
+	current := data
+	for _, part := range parts[:len(parts)-1] {
+		next, exists := current[part]
+		if !exists {
+			m := make(map[string]interface{})
+			current[part] = m
+			current = m
+			continue
+		}
+		m, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("'%s' is already a value", part)
+		}
+		current = m
+	}
+	last := parts[len(parts)-1]
+	if existing, ok := current[last].(map[string]interface{}); ok {
+		if m, ok := val.(map[string]interface{}); ok {
+			for k, v := range m {
+				existing[k] = v
+			}
+			return nil
+		}
+		return fmt.Errorf("'%s' is already an object", last)
+	}
+	current[last] = val
+	return nil
+}
+
+// toArrays replaces maps keyed 0..n-1 with arrays, recursively.
+func toArrays(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	for k, child := range m {
+		m[k] = toArrays(child)
+	}
+	if len(m) == 0 {
+		return m
+	}
+	arr := make([]interface{}, len(m))
+	for i := range arr {
+		child, ok := m[strconv.Itoa(i)]
+		if !ok {
+			return m
+		}
+		arr[i] = child
+	}
+	return arr
+}
@@ -0,0 +1,196 @@
+package processors
+
+import (
+	"bufio"
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	RegisterProcessor("grok", NewGrok)
+}
+
+// --- Grok ---
+
+// grokReference matches %{SYNTAX}, %{SYNTAX:field} and %{SYNTAX:field:type}.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([\w.@-]+))?(?::(\w+))?\}`)
+
+type grokCapture struct {
+	Field string
+	Type  string
+}
+
+type grokExpression struct {
+	Source   string
+	Regex    *regexp.Regexp
+	Captures map[string]grokCapture // Regex group name -> field
+}
+
+// Grok extracts fields from unstructured text using grok expressions.
+// Patterns are tried in order and the first match wins.
+type Grok struct {
+	Field       string
+	Target      string
+	Expressions []*grokExpression
+}
+
+func NewGrok(config map[string]interface{}) (pipeline.Processor, error) {
+	field := getString(config, "field")
+	if field == "" {
+		field = "raw"
+	}
+	patterns := getStringSlice(config, "patterns")
+	if p := getString(config, "pattern"); p != "" {
+		patterns = append(patterns, p)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("grok: at least one pattern is required")
+	}
+
+	// Bundled library, then pattern files, then inline definitions (last wins)
+	defs := make(map[string]string, len(grokPatterns))
+	for k, v := range grokPatterns {
+		defs[k] = v
+	}
+	for _, path := range getStringSlice(config, "pattern_files") {
+		if err := loadGrokPatternFile(path, defs); err != nil {
+			return nil, fmt.Errorf("grok: %w", err)
+		}
+	}
+	for k, v := range getStringMap(config, "pattern_definitions") {
+		defs[k] = v
+	}
+
+	g := &Grok{Field: field, Target: getString(config, "target")}
+	for _, pattern := range patterns {
+		expr, err := compileGrok(pattern, defs)
+		if err != nil {
+			return nil, fmt.Errorf("grok: pattern '%s': %w", pattern, err)
+		}
+		g.Expressions = append(g.Expressions, expr)
+	}
+	return g, nil
+}
+
+func (p *Grok) Process(msg pipeline.Message) (pipeline.Message, error) {
+	raw := GetValue(msg.Data, p.Field)
+	if raw == nil {
+		return msg, fmt.Errorf("field '%s' not found in message data", p.Field)
+	}
+	text, ok := toText(raw)
+	if !ok {
+		return msg, fmt.Errorf("field '%s' is not []byte or string", p.Field)
+	}
+
+	for _, expr := range p.Expressions {
+		match := expr.Regex.FindStringSubmatchIndex(text)
+		if match == nil {
+			continue
+		}
+		for i, name := range expr.Regex.SubexpNames() {
+			if name == "" || match[2*i] < 0 {
+				continue
+			}
+			capture, ok := expr.Captures[name]
+			if !ok {
+				// Plain (?P<name>...) group written directly in the pattern
+				capture = grokCapture{Field: name}
+			}
+			value, err := convertValue(text[match[2*i]:match[2*i+1]], capture.Type)
+			if err != nil {
+				return msg, fmt.Errorf("grok field '%s': %w", capture.Field, err)
+			}
+			if err := SetValue(msg.Data, joinPath(p.Target, capture.Field), value); err != nil {
+				return msg, err
+			}
+		}
+		return msg, nil
+	}
+
+	return msg, fmt.Errorf("no grok pattern matched field '%s'", p.Field)
+}
+
+// compileGrok expands every %{...} reference recursively and compiles the result.
+func compileGrok(pattern string, defs map[string]string) (*grokExpression, error) {
+	expr := &grokExpression{Source: pattern, Captures: make(map[string]grokCapture)}
+	expanded, err := expandGrok(pattern, defs, expr.Captures, nil)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, err
+	}
+	expr.Regex = re
+	return expr, nil
+}
+
+func expandGrok(pattern string, defs map[string]string, captures map[string]grokCapture, stack []string) (string, error) {
+	var expandErr error
+	result := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if expandErr != nil {
+			return ""
+		}
+		parts := grokReference.FindStringSubmatch(ref)
+		name, field, typ := parts[1], parts[2], parts[3]
+
+		for _, s := range stack {
+			if s == name {
+				expandErr = fmt.Errorf("recursive pattern reference '%s'", name)
+				return ""
+			}
+		}
+		def, ok := defs[name]
+		if !ok {
+			expandErr = fmt.Errorf("unknown pattern '%s'", name)
+			return ""
+		}
+		if typ != "" && !validType(typ) {
+			expandErr = fmt.Errorf("unsupported type '%s' for field '%s'", typ, field)
+			return ""
+		}
+
+		inner, err := expandGrok(def, defs, captures, append(stack, name))
+		if err != nil {
+			expandErr = err
+			return ""
+		}
+		if field == "" {
+			return "(?:" + inner + ")"
+		}
+		group := fmt.Sprintf("grok%d", len(captures))
+		captures[group] = grokCapture{Field: field, Type: typ}
+		return "(?P<" + group + ">" + inner + ")"
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return result, nil
+}
+
+// loadGrokPatternFile reads "NAME regex" definitions, one per line.
+// Blank lines and lines starting with '#' are ignored.
+func loadGrokPatternFile(path string, defs map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open pattern file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, def, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected 'NAME pattern'", path, lineNo)
+		}
+		defs[name] = strings.TrimSpace(def)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,140 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	RegisterProcessor("kv_parser", NewKVParser)
+}
+
+// --- Key/Value Parser ---
+
+// KVParser parses `key=value key2="quoted value"` style text into fields.
+// FieldSplit is a set of characters separating pairs; ValueSplit separates a
+// key from its value. Values may be wrapped in double or single quotes.
+type KVParser struct {
+	Field       string
+	Target      string
+	FieldSplit  string
+	ValueSplit  string
+	Prefix      string
+	IncludeKeys map[string]bool
+	ExcludeKeys map[string]bool
+	Types       map[string]string
+}
+
+func NewKVParser(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &KVParser{
+		Field:      getString(config, "field"),
+		Target:     getString(config, "target"),
+		FieldSplit: getString(config, "field_split"),
+		ValueSplit: getString(config, "value_split"),
+		Prefix:     getString(config, "prefix"),
+		Types:      getStringMap(config, "types"),
+	}
+	if p.Field == "" {
+		p.Field = "raw"
+	}
+	if p.FieldSplit == "" {
+		p.FieldSplit = " \t"
+	}
+	if p.ValueSplit == "" {
+		p.ValueSplit = "="
+	}
+	if strings.ContainsAny(p.ValueSplit, p.FieldSplit) {
+		return nil, fmt.Errorf("kv_parser: value_split must not contain field_split characters")
+	}
+	if keys := getStringSlice(config, "include_keys"); len(keys) > 0 {
+		p.IncludeKeys = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			p.IncludeKeys[k] = true
+		}
+	}
+	if keys := getStringSlice(config, "exclude_keys"); len(keys) > 0 {
+		p.ExcludeKeys = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			p.ExcludeKeys[k] = true
+		}
+	}
+	for key, typ := range p.Types {
+		if !validType(typ) {
+			return nil, fmt.Errorf("kv_parser: key '%s' has unsupported type '%s'", key, typ)
+		}
+	}
+	return p, nil
+}
+
+func (p *KVParser) Process(msg pipeline.Message) (pipeline.Message, error) {
+	raw := GetValue(msg.Data, p.Field)
+	if raw == nil {
+		return msg, fmt.Errorf("field '%s' not found in message data", p.Field)
+	}
+	text, ok := toText(raw)
+	if !ok {
+		return msg, fmt.Errorf("field '%s' is not []byte or string", p.Field)
+	}
+
+	for _, token := range p.split(text) {
+		key, value, ok := strings.Cut(token, p.ValueSplit)
+		if !ok || key == "" {
+			continue
+		}
+		if p.IncludeKeys != nil && !p.IncludeKeys[key] {
+			continue
+		}
+		if p.ExcludeKeys[key] {
+			continue
+		}
+		typed, err := convertValue(unquote(value), p.Types[key])
+		if err != nil {
+			return msg, fmt.Errorf("kv key '%s': %w", key, err)
+		}
+		if err := SetValue(msg.Data, joinPath(p.Target, p.Prefix+key), typed); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// split breaks text on FieldSplit characters, keeping quoted sections intact.
+func (p *KVParser) split(text string) []string {
+	var tokens []string
+	var current strings.Builder
+	var quote rune
+
+	for _, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			current.WriteRune(r)
+		case (r == '"' || r == '\'') && strings.HasSuffix(current.String(), p.ValueSplit):
+			// Quotes only open right after the key/value separator
+			quote = r
+			current.WriteRune(r)
+		case strings.ContainsRune(p.FieldSplit, r):
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// unquote removes a matching pair of surrounding double or single quotes.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
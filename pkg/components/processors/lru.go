@@ -0,0 +1,117 @@
+package processors
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a size bounded, concurrency safe LRU cache whose entries
+// expire after a TTL. A zero TTL disables expiration.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	items    map[string]*list.Element
+	order    *list.List // Front is the most recently used
+	now      func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(capacity int, ttl time.Duration) *lruCache {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &lruCache{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get returns the cached value and whether it was present and fresh.
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if c.ttl > 0 && c.now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// Add stores a value, evicting the least recently used entry when full.
+// It reports whether the key was already present and fresh.
+func (c *lruCache) Add(key string, value interface{}) bool {
+	return c.AddUntil(key, value, c.now().Add(c.ttl))
+}
+
+// AddUntil is like Add but with an explicit expiration time.
+func (c *lruCache) AddUntil(key string, value interface{}, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry)
+		fresh := c.ttl <= 0 || !c.now().After(entry.expires)
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(el)
+		return fresh
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+	return false
+}
+
+// Remove deletes key, if present.
+func (c *lruCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// Each calls fn for every fresh entry, from most to least recently used.
+func (c *lruCache) Each(fn func(key string, value interface{}, expires time.Time)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*lruEntry)
+		if c.ttl > 0 && now.After(entry.expires) {
+			continue
+		}
+		fn(entry.key, entry.value, entry.expires)
+	}
+}
+
+// Len returns the number of cached entries, including expired ones not yet evicted.
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
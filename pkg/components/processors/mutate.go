@@ -0,0 +1,249 @@
+package processors
+
+import (
+	"bytes"
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+func init() {
+	RegisterProcessor("mutate", NewMutate)
+}
+
+// --- Mutate ---
+
+// Mutate shapes documents with a set of field operations, applied in this order:
+// copy, add, defaults, lowercase, uppercase, trim, remove and keep_only.
+//
+// String values in add and defaults are interpolated: "${ref}" is resolved
+// by pipeline.LookupRef and values containing "{{" are Go templates executed
+// with .Data, .Metadata and .ID. Templates print numbers like "${ref}" does
+// (without exponent) and fail the message on a missing key; optional fields
+// are read with {{ get .Data "path" }}, which renders "" when missing.
+type Mutate struct {
+	Copy      map[string]string // Source -> Target
+	Add       map[string]*mutateValue
+	Defaults  map[string]*mutateValue
+	Lowercase []string
+	Uppercase []string
+	Trim      []string
+	Remove    []string // Dot paths, segments may be glob patterns
+	KeepOnly  []string
+}
+
+type mutateValue struct {
+	Literal  interface{}
+	Interp   string
+	Template *template.Template
+}
+
+func NewMutate(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &Mutate{
+		Copy:      getStringMap(config, "copy"),
+		Lowercase: getStringSlice(config, "lowercase"),
+		Uppercase: getStringSlice(config, "uppercase"),
+		Trim:      getStringSlice(config, "trim"),
+		Remove:    getStringSlice(config, "remove"),
+		KeepOnly:  getStringSlice(config, "keep_only"),
+	}
+
+	var err error
+	if p.Add, err = parseMutateValues(config, "add"); err != nil {
+		return nil, err
+	}
+	if p.Defaults, err = parseMutateValues(config, "defaults"); err != nil {
+		return nil, err
+	}
+	for _, pattern := range p.Remove {
+		for _, segment := range strings.Split(pattern, ".") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("mutate: invalid remove pattern '%s': %w", pattern, err)
+			}
+		}
+	}
+	return p, nil
+}
+
+func parseMutateValues(config map[string]interface{}, key string) (map[string]*mutateValue, error) {
+	values := make(map[string]*mutateValue)
+	raw, ok := config[key].(map[string]interface{})
+	if !ok {
+		return values, nil
+	}
+	for field, v := range raw {
+		s, isString := v.(string)
+		switch {
+		case isString && strings.Contains(s, "{{"):
+			tmpl, err := template.New(field).Option("missingkey=error").Funcs(templateFuncs).Parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("mutate: invalid template for '%s': %w", field, err)
+			}
+			values[field] = &mutateValue{Template: tmpl}
+		case isString && pipeline.Placeholder.MatchString(s):
+			values[field] = &mutateValue{Interp: s}
+		default:
+			values[field] = &mutateValue{Literal: v}
+		}
+	}
+	return values, nil
+}
+
+func (v *mutateValue) resolve(msg pipeline.Message) (interface{}, error) {
+	switch {
+	case v.Template != nil:
+		var buf bytes.Buffer
+		data := map[string]interface{}{"Data": templateView(msg.Data), "Metadata": msg.Metadata, "ID": msg.ID}
+		if err := v.Template.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	case v.Interp != "":
+		return interpolate(v.Interp, msg), nil
+	default:
+		return deepCopy(v.Literal), nil
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	// get reads a dotted path, or "" when it is missing
+	"get": func(data map[string]interface{}, path string) interface{} {
+		if v := GetValue(data, path); v != nil {
+			return v
+		}
+		return ""
+	},
+}
+
+// templateNumber prints a JSON number without exponent in templates, while
+// comparisons still see a float.
+type templateNumber float64
+
+func (n templateNumber) String() string {
+	return pipeline.ValueText(float64(n))
+}
+
+// templateView copies v with its float64 numbers as templateNumber.
+func templateView(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			out[k] = templateView(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, item := range t {
+			out[i] = templateView(item)
+		}
+		return out
+	case float64:
+		return templateNumber(t)
+	}
+	return v
+}
+
+func (p *Mutate) Process(msg pipeline.Message) (pipeline.Message, error) {
+	for _, src := range sortedKeys(p.Copy) {
+		dst := p.Copy[src]
+		if val := GetValue(msg.Data, src); val != nil {
+			if err := SetValue(msg.Data, dst, deepCopy(val)); err != nil {
+				return msg, err
+			}
+		}
+	}
+
+	for _, field := range sortedKeys(p.Add) {
+		val, err := p.Add[field].resolve(msg)
+		if err != nil {
+			return msg, fmt.Errorf("mutate add '%s': %w", field, err)
+		}
+		if err := SetValue(msg.Data, field, val); err != nil {
+			return msg, err
+		}
+	}
+
+	for _, field := range sortedKeys(p.Defaults) {
+		if GetValue(msg.Data, field) != nil {
+			continue
+		}
+		val, err := p.Defaults[field].resolve(msg)
+		if err != nil {
+			return msg, fmt.Errorf("mutate default '%s': %w", field, err)
+		}
+		if err := SetValue(msg.Data, field, val); err != nil {
+			return msg, err
+		}
+	}
+
+	if err := p.mapStrings(msg.Data, p.Lowercase, strings.ToLower); err != nil {
+		return msg, err
+	}
+	if err := p.mapStrings(msg.Data, p.Uppercase, strings.ToUpper); err != nil {
+		return msg, err
+	}
+	if err := p.mapStrings(msg.Data, p.Trim, strings.TrimSpace); err != nil {
+		return msg, err
+	}
+
+	for _, pattern := range p.Remove {
+		removeMatching(msg.Data, strings.Split(pattern, "."))
+	}
+
+	if len(p.KeepOnly) > 0 {
+		kept := make(map[string]interface{})
+		for _, field := range p.KeepOnly {
+			if val := GetValue(msg.Data, field); val != nil {
+				if err := SetValue(kept, field, val); err != nil {
+					return msg, err
+				}
+			}
+		}
+		msg.Data = kept
+	}
+
+	return msg, nil
+}
+
+func (p *Mutate) mapStrings(data map[string]interface{}, fields []string, fn func(string) string) error {
+	for _, field := range fields {
+		if s, ok := GetValue(data, field).(string); ok {
+			if err := SetValue(data, field, fn(s)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeMatching deletes every path matching the glob segments.
+func removeMatching(data map[string]interface{}, segments []string) {
+	segment := segments[0]
+	for key, val := range data {
+		if matched, _ := path.Match(segment, key); !matched {
+			continue
+		}
+		if len(segments) == 1 {
+			delete(data, key)
+			continue
+		}
+		if nested, ok := val.(map[string]interface{}); ok {
+			removeMatching(nested, segments[1:])
+		}
+	}
+}
+
+// sortedKeys returns map keys in a stable order so that fields depending on
+// each other resolve the same way on every message.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,412 @@
+package processors
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"datapipeline/pkg/pipeline"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+func init() {
+	RegisterProcessor("pii", NewPII)
+}
+
+// --- PII ---
+
+// PII protects personal data field by field. Strategies:
+//   - hash: keyed HMAC-SHA256 (hex), stable across messages so values stay joinable
+//   - tokenize: deterministic keyed token that keeps the original format
+//     (digits stay digits, letters stay letters, punctuation is kept)
+//   - mask: replaces characters with MaskChar, keeping the first/last N
+//   - redact: replaces the whole value
+//   - detect: finds CPF, CNPJ, e-mail and phone numbers inside free text and
+//     applies Action (one of the strategies above) to each finding
+//
+// Keys are identified by an ID. The active key ID is written to
+// Metadata[KeyIDMetadata]; when a message already carries a known key ID
+// (e.g. on reprocessing) that key is used instead, so keys can be rotated.
+type PII struct {
+	Rules         []*piiRule
+	Keys          map[string][]byte
+	ActiveKey     string
+	KeyIDMetadata string
+}
+
+type piiRule struct {
+	Field      string
+	Strategy   string
+	Action     string // For detect
+	Detectors  []string
+	KeepFirst  int
+	KeepLast   int
+	MaskChar   rune
+	RedactText string
+	Prefix     bool // Prefix hashes and tokens with "<key id>:"
+}
+
+type piiDetector struct {
+	Name     string
+	Pattern  *regexp.Regexp
+	Validate func(string) bool
+}
+
+// piiDetectors are applied in priority order; overlapping findings keep the first.
+var piiDetectors = []piiDetector{
+	{Name: "email", Pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{Name: "cnpj", Pattern: regexp.MustCompile(`\b\d{2}\.?\d{3}\.?\d{3}/?\d{4}-?\d{2}\b`), Validate: validCNPJ},
+	{Name: "cpf", Pattern: regexp.MustCompile(`\b\d{3}\.?\d{3}\.?\d{3}-?\d{2}\b`), Validate: validCPF},
+	// Phones need a +55, an area code or a hyphen, so numeric IDs don't match
+	{Name: "phone", Pattern: regexp.MustCompile(`\+55\s?(?:\(\d{2}\)|\d{2})\s?9?\d{4}[-\s]?\d{4}\b|(?:\(\d{2}\)\s?|\b\d{2}[\s-])9?\d{4}[-\s]?\d{4}\b|\b9?\d{4}-\d{4}\b`)},
+}
+
+func NewPII(config map[string]interface{}) (pipeline.Processor, error) {
+	p := &PII{
+		Keys:          make(map[string][]byte),
+		ActiveKey:     getString(config, "active_key"),
+		KeyIDMetadata: getString(config, "key_id_metadata"),
+	}
+	if p.KeyIDMetadata == "" {
+		p.KeyIDMetadata = "pii_key_id"
+	}
+	// Secrets may reference environment variables ($VAR or ${VAR})
+	for id, secret := range getStringMap(config, "keys") {
+		p.Keys[id] = []byte(os.ExpandEnv(secret))
+	}
+
+	rules, ok := config["fields"].([]interface{})
+	if !ok || len(rules) == 0 {
+		return nil, fmt.Errorf("pii: 'fields' is required")
+	}
+	needsKey := false
+	for _, r := range rules {
+		rMap, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("pii: each entry in 'fields' must be a map")
+		}
+		rule, err := newPIIRule(rMap)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Strategy == "hash" || rule.Strategy == "tokenize" || rule.Action == "hash" || rule.Action == "tokenize" {
+			needsKey = true
+		}
+		p.Rules = append(p.Rules, rule)
+	}
+
+	if needsKey {
+		if p.ActiveKey == "" && len(p.Keys) == 1 {
+			for id := range p.Keys {
+				p.ActiveKey = id
+			}
+		}
+		key, ok := p.Keys[p.ActiveKey]
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("pii: hash/tokenize strategies require a non-empty key for active_key '%s'", p.ActiveKey)
+		}
+	}
+	return p, nil
+}
+
+func newPIIRule(config map[string]interface{}) (*piiRule, error) {
+	rule := &piiRule{
+		Field:      getString(config, "field"),
+		Strategy:   getString(config, "strategy"),
+		Action:     getString(config, "action"),
+		Detectors:  getStringSlice(config, "detectors"),
+		KeepFirst:  getInt(config, "keep_first", 0),
+		KeepLast:   getInt(config, "keep_last", 0),
+		MaskChar:   '*',
+		RedactText: getString(config, "redact_text"),
+		Prefix:     getBool(config, "prefix_key_id", false),
+	}
+	if rule.Field == "" {
+		return nil, fmt.Errorf("pii: 'field' is required")
+	}
+	if mc := []rune(getString(config, "mask_char")); len(mc) > 0 {
+		rule.MaskChar = mc[0]
+	}
+	if rule.RedactText == "" {
+		rule.RedactText = "[REDACTED]"
+	}
+
+	switch rule.Strategy {
+	case "hash", "tokenize", "mask", "redact":
+	case "detect":
+		if rule.Action == "" {
+			rule.Action = "mask"
+		}
+		switch rule.Action {
+		case "hash", "tokenize", "mask", "redact":
+		default:
+			return nil, fmt.Errorf("pii: field '%s': unknown action '%s'", rule.Field, rule.Action)
+		}
+		if len(rule.Detectors) == 0 {
+			for _, d := range piiDetectors {
+				rule.Detectors = append(rule.Detectors, d.Name)
+			}
+		}
+		for _, name := range rule.Detectors {
+			if findPIIDetector(name) == nil {
+				return nil, fmt.Errorf("pii: field '%s': unknown detector '%s'", rule.Field, name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("pii: field '%s': unknown strategy '%s'", rule.Field, rule.Strategy)
+	}
+	return rule, nil
+}
+
+func findPIIDetector(name string) *piiDetector {
+	for i := range piiDetectors {
+		if piiDetectors[i].Name == name {
+			return &piiDetectors[i]
+		}
+	}
+	return nil
+}
+
+func (p *PII) Process(msg pipeline.Message) (pipeline.Message, error) {
+	keyID := p.ActiveKey
+	if id, ok := msg.Metadata[p.KeyIDMetadata]; ok {
+		if _, known := p.Keys[id]; known {
+			keyID = id
+		}
+	}
+	key := p.Keys[keyID]
+
+	applied := false
+	for _, rule := range p.Rules {
+		val := GetValue(msg.Data, rule.Field)
+		if val == nil {
+			continue
+		}
+		text := scalarText(val)
+
+		var out string
+		if rule.Strategy == "detect" {
+			out = p.detect(rule, text, keyID, key)
+		} else {
+			out = p.apply(rule, rule.Strategy, "", text, keyID, key)
+		}
+		if err := SetValue(msg.Data, rule.Field, out); err != nil {
+			return msg, err
+		}
+		applied = true
+	}
+
+	if applied && keyID != "" {
+		if msg.Metadata == nil {
+			msg.Metadata = make(map[string]string)
+		}
+		msg.Metadata[p.KeyIDMetadata] = keyID
+	}
+	return msg, nil
+}
+
+// apply runs a single strategy on a value. kind is the detector name for
+// findings inside free text and empty for whole fields.
+func (p *PII) apply(rule *piiRule, strategy, kind, value, keyID string, key []byte) string {
+	switch strategy {
+	case "hash":
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+		sum := hex.EncodeToString(mac.Sum(nil))
+		if rule.Prefix {
+			return keyID + ":" + sum
+		}
+		return sum
+	case "tokenize":
+		token := tokenize(value, key)
+		if rule.Prefix {
+			return keyID + ":" + token
+		}
+		return token
+	case "mask":
+		if kind == "email" {
+			// Keep the domain, it carries no personal data and helps analytics
+			if at := strings.LastIndex(value, "@"); at > 0 {
+				return maskString(value[:at], rule.KeepFirst, rule.KeepLast, rule.MaskChar) + value[at:]
+			}
+		}
+		return maskString(value, rule.KeepFirst, rule.KeepLast, rule.MaskChar)
+	default:
+		if kind != "" {
+			return "[" + strings.ToUpper(kind) + "]"
+		}
+		return rule.RedactText
+	}
+}
+
+type piiFinding struct {
+	Start, End int
+	Kind       string
+}
+
+// detect replaces every detector finding in text, resolving overlaps in detector order.
+func (p *PII) detect(rule *piiRule, text, keyID string, key []byte) string {
+	var findings []piiFinding
+	for _, d := range piiDetectors {
+		if !containsString(rule.Detectors, d.Name) {
+			continue
+		}
+		for _, loc := range d.Pattern.FindAllStringIndex(text, -1) {
+			if d.Validate != nil && !d.Validate(text[loc[0]:loc[1]]) {
+				continue
+			}
+			overlaps := false
+			for _, f := range findings {
+				if loc[0] < f.End && f.Start < loc[1] {
+					overlaps = true
+					break
+				}
+			}
+			if !overlaps {
+				findings = append(findings, piiFinding{Start: loc[0], End: loc[1], Kind: d.Name})
+			}
+		}
+	}
+	if len(findings) == 0 {
+		return text
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+
+	var b strings.Builder
+	last := 0
+	for _, f := range findings {
+		b.WriteString(text[last:f.Start])
+		b.WriteString(p.apply(rule, rule.Action, f.Kind, text[f.Start:f.End], keyID, key))
+		last = f.End
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// maskString masks letters and digits, keeping the first and last characters
+// requested. Separators such as '.', '-' and '@' are kept to preserve the format.
+func maskString(s string, keepFirst, keepLast int, maskChar rune) string {
+	runes := []rune(s)
+	var positions []int
+	for i, r := range runes {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			positions = append(positions, i)
+		}
+	}
+	for n, i := range positions {
+		if n < keepFirst || n >= len(positions)-keepLast {
+			continue
+		}
+		runes[i] = maskChar
+	}
+	return string(runes)
+}
+
+// tokenize derives a deterministic token with the same shape as the value:
+// every digit is replaced by a digit and every letter by a letter of the same
+// case, driven by an HMAC-SHA256 keystream.
+func tokenize(value string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	seed := mac.Sum(nil)
+
+	var stream []byte
+	block := uint32(0)
+	next := func() byte {
+		if len(stream) == 0 {
+			m := hmac.New(sha256.New, key)
+			m.Write(seed)
+			var counter [4]byte
+			binary.BigEndian.PutUint32(counter[:], block)
+			m.Write(counter[:])
+			stream = m.Sum(nil)
+			block++
+		}
+		b := stream[0]
+		stream = stream[1:]
+		return b
+	}
+
+	runes := []rune(value)
+	for i, r := range runes {
+		switch {
+		case r >= '0' && r <= '9':
+			runes[i] = rune('0' + next()%10)
+		case r >= 'a' && r <= 'z':
+			runes[i] = rune('a' + next()%26)
+		case r >= 'A' && r <= 'Z':
+			runes[i] = rune('A' + next()%26)
+		case unicode.IsLetter(r):
+			runes[i] = rune('a' + next()%26)
+		}
+	}
+	return string(runes)
+}
+
+func onlyDigits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// validCPF checks the two CPF check digits.
+func validCPF(s string) bool {
+	d := onlyDigits(s)
+	if len(d) != 11 || strings.Count(d, d[:1]) == 11 {
+		return false
+	}
+	for _, n := range []int{9, 10} {
+		sum := 0
+		for i := 0; i < n; i++ {
+			sum += int(d[i]-'0') * (n + 1 - i)
+		}
+		check := sum * 10 % 11 % 10
+		if check != int(d[n]-'0') {
+			return false
+		}
+	}
+	return true
+}
+
+// validCNPJ checks the two CNPJ check digits.
+func validCNPJ(s string) bool {
+	d := onlyDigits(s)
+	if len(d) != 14 || strings.Count(d, d[:1]) == 14 {
+		return false
+	}
+	weights := []int{6, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}
+	for _, n := range []int{12, 13} {
+		sum := 0
+		for i := 0; i < n; i++ {
+			sum += int(d[i]-'0') * weights[len(weights)-n+i]
+		}
+		check := sum % 11
+		if check < 2 {
+			check = 0
+		} else {
+			check = 11 - check
+		}
+		if check != int(d[n]-'0') {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,41 @@
 package processors
 
 import (
+	"context"
 	"datapipeline/pkg/pipeline"
+	"datapipeline/pkg/remote"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"google.golang.org/grpc"
 )
 
+// closeCounter is a no-op processor counting its Close calls, to check that
+// composite processors release what they built.
+type closeCounter struct{}
+
+var closedCounters atomic.Int32
+
+func init() {
+	RegisterProcessor("test_close_counter", func(map[string]interface{}) (pipeline.Processor, error) {
+		return closeCounter{}, nil
+	})
+}
+
+func (closeCounter) Process(msg pipeline.Message) (pipeline.Message, error) { return msg, nil }
+func (closeCounter) Close() error                                           { closedCounters.Add(1); return nil }
+
 func TestProcessors(t *testing.T) {
 	// 1. Test JSON Parser
 	t.Run("JSONParser", func(t *testing.T) {
@@ -78,4 +109,1277 @@ func TestProcessors(t *testing.T) {
 			t.Error("should fail")
 		}
 	})
+
+	// 5. Test CSV Parser
+	t.Run("CSVParser", func(t *testing.T) {
+		p, err := NewCSVParser(map[string]interface{}{
+			"delimiter": ";",
+			"headers":   []interface{}{"customer_id", "amount", "note"},
+			"types":     map[string]interface{}{"amount": "float"},
+			"trim":      true,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		msg := pipeline.Message{
+			Data: map[string]interface{}{"raw": []byte(`CUST-1; 10.5 ;"a;b ""quoted"""`)},
+		}
+		res, err := p.Process(msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Data["customer_id"] != "CUST-1" || res.Data["amount"] != 10.5 {
+			t.Errorf("unexpected parsed fields: %v", res.Data)
+		}
+		if res.Data["note"] != `a;b "quoted"` {
+			t.Errorf("expected quoted note, got %v", res.Data["note"])
+		}
+
+		// Column count mismatch
+		msg2 := pipeline.Message{Data: map[string]interface{}{"raw": "CUST-2;1.0"}}
+		if _, err := p.Process(msg2); err == nil {
+			t.Error("expected column count error")
+		}
+
+		// Header from first record, several rows into target
+		p2, _ := NewCSVParser(map[string]interface{}{
+			"header_from_first_record": true,
+			"target":                   "rows",
+		})
+		msg3 := pipeline.Message{Data: map[string]interface{}{"raw": "a,b\n1,2\n3,4\n"}}
+		res3, err := p2.Process(msg3)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rows, ok := res3.Data["rows"].([]interface{})
+		if !ok || len(rows) != 2 || rows[1].(map[string]interface{})["a"] != "3" {
+			t.Errorf("unexpected rows: %v", res3.Data["rows"])
+		}
+	})
+
+	// 6. Test Grok
+	t.Run("Grok", func(t *testing.T) {
+		for name := range grokPatterns {
+			if _, err := compileGrok("%{"+name+"}", grokPatterns); err != nil {
+				t.Errorf("bundled pattern %s does not compile: %v", name, err)
+			}
+		}
+
+		p, err := NewGrok(map[string]interface{}{
+			"patterns": []interface{}{
+				"%{ORDERREF:ref} failed",
+				"%{COMMONAPACHELOG}",
+			},
+			"pattern_definitions": map[string]interface{}{
+				"ORDERREF": "ORD-[0-9]+",
+			},
+			"target": "http",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		line := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`
+		res, err := p.Process(pipeline.Message{Data: map[string]interface{}{"raw": []byte(line)}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if GetValue(res.Data, "http.clientip") != "127.0.0.1" || GetValue(res.Data, "http.verb") != "GET" {
+			t.Errorf("unexpected grok fields: %v", res.Data["http"])
+		}
+		if GetValue(res.Data, "http.response") != "200" || GetValue(res.Data, "http.auth") != "frank" {
+			t.Errorf("unexpected grok fields: %v", res.Data["http"])
+		}
+
+		res2, err := p.Process(pipeline.Message{Data: map[string]interface{}{"raw": "ORD-42 failed"}})
+		if err != nil || GetValue(res2.Data, "http.ref") != "ORD-42" {
+			t.Errorf("expected custom pattern match, got %v (%v)", res2.Data, err)
+		}
+
+		if _, err := p.Process(pipeline.Message{Data: map[string]interface{}{"raw": "nothing"}}); err == nil {
+			t.Error("expected no match error")
+		}
+
+		// Typed capture
+		p2, _ := NewGrok(map[string]interface{}{"pattern": "took %{NUMBER:took_ms:float}ms"})
+		res3, err := p2.Process(pipeline.Message{Data: map[string]interface{}{"raw": "request took 12.5ms"}})
+		if err != nil || res3.Data["took_ms"] != 12.5 {
+			t.Errorf("expected typed capture, got %v (%v)", res3.Data["took_ms"], err)
+		}
+	})
+
+	// 7. Test KV Parser
+	t.Run("KVParser", func(t *testing.T) {
+		p, _ := NewKVParser(map[string]interface{}{
+			"target":       "kv",
+			"exclude_keys": []interface{}{"secret"},
+			"types":        map[string]interface{}{"qty": "int"},
+		})
+		msg := pipeline.Message{
+			Data: map[string]interface{}{"raw": `level=info msg="order created" qty=3 secret=x`},
+		}
+		res, err := p.Process(msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if GetValue(res.Data, "kv.msg") != "order created" || GetValue(res.Data, "kv.level") != "info" {
+			t.Errorf("unexpected kv fields: %v", res.Data["kv"])
+		}
+		if GetValue(res.Data, "kv.qty") != int64(3) {
+			t.Errorf("expected typed qty, got %v", GetValue(res.Data, "kv.qty"))
+		}
+		if GetValue(res.Data, "kv.secret") != nil {
+			t.Error("excluded key should not be set")
+		}
+	})
+
+	// 8. Test Date
+	t.Run("Date", func(t *testing.T) {
+		p, err := NewDate(map[string]interface{}{
+			"field":    "timestamp",
+			"formats":  []interface{}{"unix", "dd/MM/yyyy HH:mm"},
+			"timezone": "America/Sao_Paulo",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		res, err := p.Process(pipeline.Message{Data: map[string]interface{}{"timestamp": 1700000000.0}})
+		if err != nil || res.Data["@timestamp"] != "2023-11-14T22:13:20Z" {
+			t.Errorf("expected unix conversion, got %v (%v)", res.Data["@timestamp"], err)
+		}
+
+		res2, err := p.Process(pipeline.Message{Data: map[string]interface{}{"timestamp": "25/12/2024 10:30"}})
+		if err != nil || res2.Data["@timestamp"] != "2024-12-25T13:30:00Z" {
+			t.Errorf("expected brazilian date in UTC, got %v (%v)", res2.Data["@timestamp"], err)
+		}
+
+		if _, err := p.Process(pipeline.Message{Data: map[string]interface{}{"timestamp": "yesterday"}}); err == nil {
+			t.Error("expected parse error")
+		}
+
+		// Fallback to the Kafka timestamp, epoch output
+		p2, _ := NewDate(map[string]interface{}{
+			"field":                "missing",
+			"target":               "ts",
+			"output_format":        "unix_ms",
+			"fallback_to_metadata": true,
+		})
+		msg := pipeline.Message{
+			Data:     map[string]interface{}{},
+			Metadata: map[string]string{"timestamp": "2024-01-02T03:04:05Z"},
+		}
+		res3, err := p2.Process(msg)
+		if err != nil || res3.Data["ts"] != int64(1704164645000) {
+			t.Errorf("expected metadata fallback, got %v (%v)", res3.Data["ts"], err)
+		}
+	})
+
+	// 9. Test Mutate
+	t.Run("Mutate", func(t *testing.T) {
+		p, err := NewMutate(map[string]interface{}{
+			"copy": map[string]interface{}{"usuario.email": "contact.email"},
+			"add": map[string]interface{}{
+				"source":   "${Metadata.topic}-${Metadata.partition}",
+				"amount":   "${Amount}",
+				"ref":      "order-${OrderID}",
+				"customer": "{{ .Data.CustomerID }}/{{ .ID }}",
+			},
+			"defaults":  map[string]interface{}{"country": "BR", "CustomerID": "unknown"},
+			"uppercase": []interface{}{"country"},
+			"trim":      []interface{}{"contact.email"},
+			"remove":    []interface{}{"raw", "tmp_*", "usuario.*"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		msg := pipeline.Message{
+			ID: "k1",
+			Data: map[string]interface{}{
+				"raw":        []byte("{}"),
+				"tmp_a":      1,
+				"tmp_b":      2,
+				"CustomerID": "CUST-1",
+				"Amount":     12.5,
+				"OrderID":    1500000.0,
+				"usuario":    map[string]interface{}{"email": " john@example.com "},
+			},
+			Metadata: map[string]string{"topic": "orders", "partition": "3"},
+		}
+		res, err := p.Process(msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Data["source"] != "orders-3" || res.Data["amount"] != 12.5 || res.Data["customer"] != "CUST-1/k1" {
+			t.Errorf("unexpected added fields: %v", res.Data)
+		}
+		if res.Data["ref"] != "order-1500000" {
+			t.Errorf("expected the id without exponent, got %v", res.Data["ref"])
+		}
+		if res.Data["country"] != "BR" || res.Data["CustomerID"] != "CUST-1" {
+			t.Errorf("unexpected defaults: %v", res.Data)
+		}
+		if GetValue(res.Data, "contact.email") != "john@example.com" {
+			t.Errorf("expected copied and trimmed email, got %v", GetValue(res.Data, "contact.email"))
+		}
+		if _, ok := res.Data["raw"]; ok || res.Data["tmp_a"] != nil || GetValue(res.Data, "usuario.email") != nil {
+			t.Errorf("expected removed fields, got %v", res.Data)
+		}
+
+		// Templates print numbers without exponent and fail on missing keys
+		tmpl, err := NewMutate(map[string]interface{}{
+			"add": map[string]interface{}{
+				"ref":  "order-{{ .Data.OrderID }}",
+				"late": `{{ if gt .Data.OrderID 1000.0 }}yes{{ end }}{{ get .Data "missing" }}{{ get .Data "OrderID" }}`,
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err = tmpl.Process(pipeline.Message{Data: map[string]interface{}{"OrderID": 1500000.0}})
+		if err != nil || res.Data["ref"] != "order-1500000" || res.Data["OrderID"] != 1500000.0 {
+			t.Errorf("expected the id without exponent, got %v (%v)", res.Data, err)
+		}
+		if res.Data["late"] != "yes1500000" {
+			t.Errorf("expected an optional field to render empty, got %q", res.Data["late"])
+		}
+		if _, err := tmpl.Process(pipeline.Message{Data: map[string]interface{}{}}); err == nil {
+			t.Error("expected an error for a missing key")
+		}
+
+		p2, _ := NewMutate(map[string]interface{}{"keep_only": []interface{}{"a", "b.c"}})
+		res2, _ := p2.Process(pipeline.Message{Data: map[string]interface{}{
+			"a": 1, "x": 2, "b": map[string]interface{}{"c": 3, "d": 4},
+		}})
+		if len(res2.Data) != 2 || GetValue(res2.Data, "b.c") != 3 || GetValue(res2.Data, "b.d") != nil {
+			t.Errorf("unexpected keep_only result: %v", res2.Data)
+		}
+	})
+
+	// 10. Test Regex Extractor
+	t.Run("RegexExtractor", func(t *testing.T) {
+		p, err := NewRegexExtractor(map[string]interface{}{
+			"field":    "reference",
+			"pattern":  `ORD-(?P<number>\d+)-(?P<region>[A-Z]{2})`,
+			"target":   "order",
+			"captures": map[string]interface{}{"region": "geo.region"},
+			"types":    map[string]interface{}{"number": "int"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err := p.Process(pipeline.Message{Data: map[string]interface{}{"reference": "ref ORD-123-SP"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if GetValue(res.Data, "order.number") != int64(123) || GetValue(res.Data, "geo.region") != "SP" {
+			t.Errorf("unexpected extracted fields: %v", res.Data)
+		}
+
+		// No match passes by default
+		if _, err := p.Process(pipeline.Message{Data: map[string]interface{}{"reference": "none"}}); err != nil {
+			t.Errorf("expected pass on no match: %v", err)
+		}
+
+		p2, _ := NewRegexExtractor(map[string]interface{}{
+			"field":       "tags",
+			"pattern":     `#(?P<tag>\w+)`,
+			"multiple":    true,
+			"on_no_match": "fail",
+		})
+		res2, err := p2.Process(pipeline.Message{Data: map[string]interface{}{"tags": "#a #b"}})
+		if tags, ok := res2.Data["tag"].([]interface{}); err != nil || !ok || len(tags) != 2 || tags[1] != "b" {
+			t.Errorf("expected all matches, got %v (%v)", res2.Data["tag"], err)
+		}
+		if _, err := p2.Process(pipeline.Message{Data: map[string]interface{}{"tags": "none"}}); err == nil {
+			t.Error("expected failure on no match")
+		}
+
+		// Optional groups stay index-aligned across matches
+		p3, _ := NewRegexExtractor(map[string]interface{}{
+			"field":    "orders",
+			"pattern":  `(?P<order>\d+)(?:@(?P<region>[A-Z]{2}))?`,
+			"multiple": true,
+		})
+		res4, err := p3.Process(pipeline.Message{Data: map[string]interface{}{"orders": "1@SP 2 3@RJ"}})
+		if err != nil || !reflect.DeepEqual(res4.Data["region"], []interface{}{"SP", nil, "RJ"}) ||
+			!reflect.DeepEqual(res4.Data["order"], []interface{}{"1", "2", "3"}) {
+			t.Errorf("expected aligned captures, got %v (%v)", res4.Data, err)
+		}
+
+		// regex_replace over several fields
+		r, _ := NewRegexReplacer(map[string]interface{}{
+			"fields":      []interface{}{"a", "b.c"},
+			"pattern":     `\d`,
+			"replacement": "#",
+		})
+		res3, _ := r.Process(pipeline.Message{Data: map[string]interface{}{
+			"a": "a1", "b": map[string]interface{}{"c": "22"},
+		}})
+		if res3.Data["a"] != "a#" || GetValue(res3.Data, "b.c") != "##" {
+			t.Errorf("unexpected replaced fields: %v", res3.Data)
+		}
+
+		// A path in both field and fields is replaced once
+		r2, _ := NewRegexReplacer(map[string]interface{}{
+			"field":       "a",
+			"fields":      []interface{}{"a", "a"},
+			"pattern":     `x`,
+			"replacement": "xx",
+		})
+		res5, _ := r2.Process(pipeline.Message{Data: map[string]interface{}{"a": "x"}})
+		if res5.Data["a"] != "xx" {
+			t.Errorf("expected a single replacement, got %v", res5.Data["a"])
+		}
+		if fields := r2.(*RegexReplacer).Fields; len(fields) != 0 {
+			t.Errorf("expected duplicate paths dropped when built, got %v", fields)
+		}
+	})
+
+	// 11. Test PII
+	t.Run("PII", func(t *testing.T) {
+		p, err := NewPII(map[string]interface{}{
+			"keys":       map[string]interface{}{"k1": "secret-1", "k2": "secret-2"},
+			"active_key": "k2",
+			"fields": []interface{}{
+				map[string]interface{}{"field": "usuario.email", "strategy": "hash"},
+				map[string]interface{}{"field": "document", "strategy": "tokenize"},
+				map[string]interface{}{"field": "card", "strategy": "mask", "keep_last": 4},
+				map[string]interface{}{"field": "password", "strategy": "redact"},
+				map[string]interface{}{"field": "notes", "strategy": "detect"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		newMsg := func() pipeline.Message {
+			return pipeline.Message{
+				Data: map[string]interface{}{
+					"usuario":  map[string]interface{}{"email": "john@example.com"},
+					"document": "529.982.247-25",
+					"card":     "4111 1111 1111 1234",
+					"password": "hunter2",
+					"notes":    "cpf 529.982.247-25, mail john@example.com, tel (11) 98765-4321",
+				},
+				Metadata: map[string]string{},
+			}
+		}
+
+		res, err := p.Process(newMsg())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		hash := GetValue(res.Data, "usuario.email").(string)
+		if len(hash) != 64 || hash == "john@example.com" {
+			t.Errorf("expected hmac hash, got %v", hash)
+		}
+		token := res.Data["document"].(string)
+		if len(token) != 14 || token[3] != '.' || token[11] != '-' || token == "529.982.247-25" {
+			t.Errorf("expected format preserving token, got %v", token)
+		}
+		if res.Data["card"] != "**** **** **** 1234" || res.Data["password"] != "[REDACTED]" {
+			t.Errorf("unexpected masking: %v / %v", res.Data["card"], res.Data["password"])
+		}
+		if res.Data["notes"] != "cpf ***.***.***-**, mail ****@example.com, tel (**) *****-****" {
+			t.Errorf("unexpected detection result: %v", res.Data["notes"])
+		}
+		// Bare digit runs such as order IDs are not phones
+		ids := newMsg()
+		ids.Data["notes"] = "pedido 123456789, conta 98765432, tel +5511987654321"
+		if res, _ := p.Process(ids); res.Data["notes"] != "pedido 123456789, conta 98765432, tel +*************" {
+			t.Errorf("unexpected detection in numeric ids: %v", res.Data["notes"])
+		}
+		if res.Metadata["pii_key_id"] != "k2" {
+			t.Errorf("expected key id in metadata, got %v", res.Metadata)
+		}
+
+		// Deterministic for the same key, different for a rotated key
+		res2, _ := p.Process(newMsg())
+		if GetValue(res2.Data, "usuario.email") != hash || res2.Data["document"] != token {
+			t.Error("expected deterministic hash and token")
+		}
+		old := newMsg()
+		old.Metadata["pii_key_id"] = "k1"
+		res3, _ := p.Process(old)
+		if GetValue(res3.Data, "usuario.email") == hash {
+			t.Error("expected a different hash for key k1")
+		}
+
+		// Numbers decoded from JSON are masked digit by digit, not in exponent form
+		var num map[string]interface{}
+		json.Unmarshal([]byte(`{"card":4111111111111234,"password":1234}`), &num)
+		res4, err := p.Process(pipeline.Message{Data: num, Metadata: map[string]string{}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res4.Data["card"] != "************1234" {
+			t.Errorf("expected numeric card masked without exponent, got %v", res4.Data["card"])
+		}
+
+		if !validCNPJ("11.222.333/0001-81") || validCNPJ("11.222.333/0001-82") || validCPF("111.111.111-11") {
+			t.Error("unexpected document validation result")
+		}
+	})
+
+	// 12. Test Field Encryption
+	t.Run("FieldCrypto", func(t *testing.T) {
+		dir := t.TempDir()
+		oldKeys := filepath.Join(dir, "old.json")
+		newKeys := filepath.Join(dir, "new.json")
+		os.WriteFile(oldKeys, []byte(`{"active":"k1","keys":{"k1":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}}`), 0600)
+		os.WriteFile(newKeys, []byte(`{"active":"k2","keys":{
+			"k1":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+			"k2":"ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="}}`), 0600)
+
+		enc, err := NewFieldEncryptor(map[string]interface{}{
+			"fields":  []interface{}{"document", "address"},
+			"keyfile": oldKeys,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		msg := pipeline.Message{Data: map[string]interface{}{
+			"document": "529.982.247-25",
+			"address":  map[string]interface{}{"street": "Rua A", "number": 10.0},
+		}}
+		res, err := enc.Process(msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		doc, _ := res.Data["document"].(string)
+		if !strings.HasPrefix(doc, "enc:v1:") {
+			t.Fatalf("expected envelope, got %v", res.Data["document"])
+		}
+
+		// Decrypt with the rotated keyfile (new active key, old key kept)
+		dec, err := NewFieldDecryptor(map[string]interface{}{
+			"fields":  []interface{}{"document", "address"},
+			"keyfile": newKeys,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res2, err := dec.Process(res)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res2.Data["document"] != "529.982.247-25" || GetValue(res2.Data, "address.number") != 10.0 {
+			t.Errorf("unexpected decrypted data: %v", res2.Data)
+		}
+
+		// Tampered ciphertext must not decrypt
+		tampered := pipeline.Message{Data: map[string]interface{}{"document": doc[:len(doc)-4] + "AAAA"}}
+		if _, err := dec.Process(tampered); err == nil {
+			t.Error("expected error for tampered envelope")
+		}
+		if _, err := dec.Process(pipeline.Message{Data: map[string]interface{}{"document": "plain"}}); err == nil {
+			t.Error("expected error for plaintext value")
+		}
+
+		// Envelopes still decrypt after being moved to another field...
+		moved := pipeline.Message{Data: map[string]interface{}{"customer_document": doc}}
+		decMoved, _ := NewFieldDecryptor(map[string]interface{}{
+			"fields":  []interface{}{"customer_document"},
+			"keyfile": newKeys,
+		})
+		if res3, err := decMoved.Process(moved); err != nil || res3.Data["customer_document"] != "529.982.247-25" {
+			t.Errorf("expected a moved envelope to decrypt, got %v (%v)", res3.Data, err)
+		}
+
+		// ...but are bound to their context
+		encCtx, _ := NewFieldEncryptor(map[string]interface{}{
+			"fields":  []interface{}{"document"},
+			"keyfile": oldKeys,
+			"context": "customers.v1",
+		})
+		bound, err := encCtx.Process(pipeline.Message{Data: map[string]interface{}{"document": "529.982.247-25"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := dec.Process(bound); err == nil {
+			t.Error("expected error for an envelope of another context")
+		}
+		decCtx, _ := NewFieldDecryptor(map[string]interface{}{
+			"fields":  []interface{}{"document"},
+			"keyfile": newKeys,
+			"context": "customers.v1",
+		})
+		if res3, err := decCtx.Process(bound); err != nil || res3.Data["document"] != "529.982.247-25" {
+			t.Errorf("expected the envelope to decrypt in its context, got %v (%v)", res3.Data, err)
+		}
+
+		// Only valid envelopes count as encrypted
+		res4, err := enc.Process(pipeline.Message{Data: map[string]interface{}{"document": doc, "address": "enc:v1:street"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res4.Data["document"] != doc {
+			t.Error("expected an encrypted value to be left as is")
+		}
+		res5, err := dec.Process(res4)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res5.Data["address"] != "enc:v1:street" {
+			t.Errorf("expected a prefixed plaintext to round-trip, got %v", res5.Data["address"])
+		}
+	})
+
+	// 13. Test Enrich
+	t.Run("Enrich", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "customers.csv")
+		os.WriteFile(path, []byte("customer_id;segment;region\nCUST-1;gold;SP\nCUST-2;silver;RJ\n"), 0600)
+
+		p, err := NewEnrich(map[string]interface{}{
+			"key": "CustomerID",
+			"source": map[string]interface{}{
+				"type":       "csv",
+				"path":       path,
+				"key_column": "customer_id",
+				"delimiter":  ";",
+			},
+			"columns": map[string]interface{}{"segment": "customer.segment", "region": "customer.region"},
+			"on_miss": "drop",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer p.(*Enrich).Close()
+
+		res, err := p.Process(pipeline.Message{Data: map[string]interface{}{"CustomerID": "CUST-1"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if GetValue(res.Data, "customer.segment") != "gold" || GetValue(res.Data, "customer.region") != "SP" {
+			t.Errorf("unexpected enrichment: %v", res.Data)
+		}
+
+		_, err = p.Process(pipeline.Message{Data: map[string]interface{}{"CustomerID": "CUST-9"}})
+		if !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected drop on miss, got %v", err)
+		}
+
+		// A refreshed table applies at once, to missed keys too
+		os.WriteFile(path, []byte("customer_id;segment;region\nCUST-1;silver;SP\nCUST-9;gold;MG\n"), 0600)
+		if err := p.(*Enrich).table.refresh(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err = p.Process(pipeline.Message{Data: map[string]interface{}{"CustomerID": "CUST-9"}})
+		if err != nil || GetValue(res.Data, "customer.segment") != "gold" {
+			t.Errorf("expected the new customer, got %v (%v)", res.Data, err)
+		}
+		res, _ = p.Process(pipeline.Message{Data: map[string]interface{}{"CustomerID": "CUST-1"}})
+		if GetValue(res.Data, "customer.segment") != "silver" {
+			t.Errorf("expected the updated customer, got %v", res.Data)
+		}
+
+		// JSON source with whole row under target and defaults on miss
+		jsonPath := filepath.Join(t.TempDir(), "customers.json")
+		os.WriteFile(jsonPath, []byte(`[{"id": 1, "segment": "gold"}]`), 0600)
+		p2, err := NewEnrich(map[string]interface{}{
+			"key":      "customer_id",
+			"source":   map[string]interface{}{"type": "json", "path": jsonPath, "key_column": "id"},
+			"target":   "customer",
+			"on_miss":  "default",
+			"defaults": map[string]interface{}{"segment": "unknown"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res2, _ := p2.Process(pipeline.Message{Data: map[string]interface{}{"customer_id": 1.0}})
+		if GetValue(res2.Data, "customer.segment") != "gold" {
+			t.Errorf("unexpected enrichment: %v", res2.Data)
+		}
+		res3, _ := p2.Process(pipeline.Message{Data: map[string]interface{}{"customer_id": 2.0}})
+		if GetValue(res3.Data, "customer.segment") != "unknown" {
+			t.Errorf("expected defaults on miss, got %v", res3.Data)
+		}
+
+		// Large numeric keys read from JSON match their text form in a CSV source
+		csvPath := filepath.Join(t.TempDir(), "accounts.csv")
+		os.WriteFile(csvPath, []byte("account,segment\n1234567,gold\n"), 0600)
+		p3, err := NewEnrich(map[string]interface{}{
+			"key":     "account",
+			"source":  map[string]interface{}{"type": "csv", "path": csvPath, "key_column": "account"},
+			"columns": map[string]interface{}{"segment": "segment"},
+			"on_miss": "drop",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(`{"account": 1234567}`), &doc)
+		res4, err := p3.Process(pipeline.Message{Data: doc})
+		if err != nil || res4.Data["segment"] != "gold" {
+			t.Errorf("expected numeric key to match, got %v (%v)", res4.Data, err)
+		}
+
+		// Closing twice, e.g. by an error path and the engine, is harmless
+		for i := 0; i < 2; i++ {
+			if err := p3.(*Enrich).Close(); err != nil {
+				t.Errorf("unexpected close error: %v", err)
+			}
+		}
+	})
+
+	// 14. Test Dedupe
+	t.Run("Dedupe", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dedupe.log")
+		config := map[string]interface{}{
+			"fields":       []interface{}{"order_id"},
+			"ttl":          "1h",
+			"persist_path": path,
+		}
+		p, err := NewDedupe(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		newMsg := func() pipeline.Message {
+			return pipeline.Message{Data: map[string]interface{}{"order_id": 42.0}}
+		}
+
+		first, err := p.Process(newMsg())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// A second copy in the same batch is dropped while the first is in flight
+		if _, err := p.Process(newMsg()); !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected in-flight duplicate drop, got %v", err)
+		}
+
+		// The batch failed: the redelivery must pass
+		p.(pipeline.FailureObserver).OnBatchFailed([]pipeline.Message{first})
+		first, err = p.Process(newMsg())
+		if err != nil {
+			t.Errorf("unwritten message should not be a duplicate: %v", err)
+		}
+
+		p.(pipeline.WriteObserver).OnBatchWritten([]pipeline.Message{first})
+		if _, err := p.Process(newMsg()); !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected duplicate drop, got %v", err)
+		}
+		if p.(*Dedupe).Duplicates() != 2 {
+			t.Errorf("expected 2 duplicates, got %d", p.(*Dedupe).Duplicates())
+		}
+		p.(*Dedupe).Close()
+
+		// Keys survive a restart
+		p2, err := NewDedupe(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer p2.(*Dedupe).Close()
+		if _, err := p2.Process(newMsg()); !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected duplicate after reload, got %v", err)
+		}
+		if _, err := p2.Process(pipeline.Message{Data: map[string]interface{}{"order_id": 43.0}}); err != nil {
+			t.Errorf("unexpected error for new key: %v", err)
+		}
+	})
+
+	// 15. Test Aggregate
+	t.Run("Aggregate", func(t *testing.T) {
+		p, err := NewAggregate(map[string]interface{}{
+			"group_by":   []interface{}{"CustomerID"},
+			"time_field": "timestamp",
+			"window":     map[string]interface{}{"type": "tumbling", "size": "1m"},
+			"aggregates": []interface{}{
+				map[string]interface{}{"type": "count", "target": "orders"},
+				map[string]interface{}{"type": "sum", "field": "Amount", "target": "total"},
+				map[string]interface{}{"type": "max", "field": "Amount"},
+				map[string]interface{}{"type": "distinct_count", "field": "usuario.email", "target": "emails"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		agg := p.(*Aggregate)
+		order := func(customer string, ts, amount float64, email string) {
+			_, err := p.Process(pipeline.Message{Data: map[string]interface{}{
+				"CustomerID": customer,
+				"timestamp":  ts,
+				"Amount":     amount,
+				"usuario":    map[string]interface{}{"email": email},
+			}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		order("CUST-1", 1700000000, 10, "a@x.com") // window 22:13:00-22:14:00
+		order("CUST-1", 1700000010, 5, "a@x.com")
+		order("CUST-2", 1700000020, 7, "b@x.com")
+		if msgs := agg.Emit(false); len(msgs) != 0 {
+			t.Fatalf("no window should be closed yet, got %v", msgs)
+		}
+
+		order("CUST-1", 1700000100, 1, "c@x.com") // next window, closes the first one
+		msgs := agg.Emit(false)
+		if len(msgs) != 2 {
+			t.Fatalf("expected 2 closed windows, got %d", len(msgs))
+		}
+		for _, m := range msgs {
+			if m.Data["CustomerID"] == "CUST-1" {
+				if m.Data["orders"] != int64(2) || m.Data["total"] != 15.0 || m.Data["max_Amount"] != 10.0 || m.Data["emails"] != int64(1) {
+					t.Errorf("unexpected window result: %v", m.Data)
+				}
+				if m.Data["window_start"] != "2023-11-14T22:13:00Z" {
+					t.Errorf("unexpected window start: %v", m.Data["window_start"])
+				}
+			}
+		}
+
+		// Late event for a closed window is ignored
+		order("CUST-1", 1700000001, 100, "a@x.com")
+		if agg.Late() != 1 {
+			t.Errorf("expected 1 late event, got %d", agg.Late())
+		}
+
+		// Shutdown flushes the open window
+		if msgs := agg.Emit(true); len(msgs) != 1 || msgs[0].Data["orders"] != int64(1) {
+			t.Errorf("expected final open window, got %v", msgs)
+		}
+
+		// Session windows merge events closer than the gap
+		s, _ := NewAggregate(map[string]interface{}{
+			"group_by":   []interface{}{"CustomerID"},
+			"time_field": "timestamp",
+			"window":     map[string]interface{}{"type": "session", "gap": "30s"},
+			"aggregates": []interface{}{map[string]interface{}{"type": "count"}},
+		})
+		for _, ts := range []float64{1000, 1020, 1010, 1100} {
+			s.Process(pipeline.Message{Data: map[string]interface{}{"CustomerID": "C", "timestamp": ts}})
+		}
+		sessions := s.(*Aggregate).Emit(true)
+		if len(sessions) != 2 || sessions[0].Data["count"] != int64(3) || sessions[1].Data["count"] != int64(1) {
+			t.Errorf("unexpected sessions: %v", sessions)
+		}
+	})
+
+	// 16. Test Script
+	t.Run("Script", func(t *testing.T) {
+		p, err := NewScript(map[string]interface{}{
+			"source": `
+RATE = 1.1
+
+def process(msg):
+    data = msg["data"]
+    if data.get("skip"):
+        return None
+    if "items" in data:
+        return [{"data": {"sku": sku}, "metadata": msg["metadata"]} for sku in data["items"]]
+    data["total"] = data["Amount"] * RATE
+    data["tags"] = [t.upper() for t in data.get("tags", [])]
+    data["count"] = len(data["tags"]) + 1
+    msg["metadata"]["scripted"] = "yes"
+    return msg
+`,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err := p.Process(pipeline.Message{
+			Data:     map[string]interface{}{"Amount": 10.0, "tags": []interface{}{"a"}},
+			Metadata: map[string]string{},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total, _ := res.Data["total"].(float64); total < 10.99 || total > 11.01 {
+			t.Errorf("unexpected total: %v", res.Data["total"])
+		}
+		if tags := res.Data["tags"].([]interface{}); tags[0] != "A" || res.Data["count"] != 2.0 || res.Metadata["scripted"] != "yes" {
+			t.Errorf("unexpected script result: %v %v", res.Data, res.Metadata)
+		}
+
+		if _, err := p.Process(pipeline.Message{Data: map[string]interface{}{"skip": true}}); !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected drop, got %v", err)
+		}
+
+		parts, err := p.(pipeline.Splitter).ProcessMulti(pipeline.Message{
+			Data: map[string]interface{}{"items": []interface{}{"x", "y"}},
+		})
+		if err != nil || len(parts) != 2 || parts[1].Data["sku"] != "y" {
+			t.Errorf("expected split, got %v (%v)", parts, err)
+		}
+
+		slow, err := NewScript(map[string]interface{}{
+			"source":  "def process(msg):\n    while True:\n        pass\n",
+			"timeout": "50ms",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := slow.Process(pipeline.Message{Data: map[string]interface{}{}}); err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("expected timeout error, got %v", err)
+		}
+
+		// Pooled threads start every call with no steps counted
+		steps, err := NewScript(map[string]interface{}{
+			"source":    "def process(msg):\n    for i in range(100):\n        pass\n    return msg\n",
+			"max_steps": 1000,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		steps.(pipeline.WorkerAware).SetWorkerCount(2)
+		for i := 0; i < 10; i++ {
+			if _, err := steps.Process(pipeline.Message{Data: map[string]interface{}{}}); err != nil {
+				t.Fatalf("call %d: unexpected error: %v", i, err)
+			}
+		}
+	})
+
+	// 17. Test Remote
+	t.Run("Remote", func(t *testing.T) {
+		var requests, largest atomic.Int64
+		handler := remote.Counting(remote.Failing(remote.MockHandler, 1), func(n int) {
+			requests.Add(1)
+			if int64(n) > largest.Load() {
+				largest.Store(int64(n))
+			}
+		})
+		server := httptest.NewServer(remote.NewHTTPHandler(handler))
+		defer server.Close()
+
+		p, err := NewRemote(map[string]interface{}{
+			"url":           server.URL,
+			"target":        "ml",
+			"batch_size":    4,
+			"batch_timeout": "50ms",
+			"retry_backoff": "1ms",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer p.(*Remote).Close()
+
+		// The first request fails and is retried; concurrent calls are batched
+		var wg sync.WaitGroup
+		results := make([]pipeline.Message, 4)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res, err := p.Process(pipeline.Message{ID: string(rune('a' + i)), Data: map[string]interface{}{"n": i}})
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				results[i] = res
+			}(i)
+		}
+		wg.Wait()
+		for i, res := range results {
+			if GetValue(res.Data, "ml.mock_id") != string(rune('a'+i)) {
+				t.Errorf("unexpected result %d: %v", i, res.Data)
+			}
+		}
+		if largest.Load() < 2 {
+			t.Errorf("expected micro-batched requests, largest had %d messages", largest.Load())
+		}
+
+		if _, err := p.Process(pipeline.Message{Data: map[string]interface{}{"_mock_drop": true}}); !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected drop, got %v", err)
+		}
+		if _, err := p.Process(pipeline.Message{Data: map[string]interface{}{"_mock_error": "bad input"}}); err == nil || !strings.Contains(err.Error(), "bad input") {
+			t.Errorf("expected remote error, got %v", err)
+		}
+
+		// Fallback when the remote is down
+		down := httptest.NewServer(nil)
+		down.Close()
+		fallback, err := NewRemote(map[string]interface{}{
+			"url":               down.URL,
+			"on_failure":        "pass",
+			"retries":           1,
+			"retry_backoff":     "1ms",
+			"breaker_threshold": 1,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			res, err := fallback.Process(pipeline.Message{Data: map[string]interface{}{"a": 1}})
+			if err != nil || res.Metadata["remote_error"] == "" || len(res.Data) != 1 {
+				t.Errorf("expected pass-through with remote_error, got %v %v (%v)", res.Data, res.Metadata, err)
+			}
+		}
+		if res, _ := fallback.Process(pipeline.Message{Data: map[string]interface{}{}}); !strings.Contains(res.Metadata["remote_error"], "circuit open") {
+			t.Errorf("expected open circuit, got %v", res.Metadata)
+		}
+
+		// Rejected requests don't open the circuit
+		rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}))
+		defer rejecting.Close()
+		strict, err := NewRemote(map[string]interface{}{"url": rejecting.URL, "breaker_threshold": 1})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := strict.Process(pipeline.Message{Data: map[string]interface{}{}}); err == nil || !strings.Contains(err.Error(), "400") {
+				t.Errorf("expected the 400 error, got %v", err)
+			}
+		}
+
+		// Batches respect max_concurrency, and Close fails calls instead of hanging
+		var inFlight, peak atomic.Int64
+		slow := httptest.NewServer(remote.NewHTTPHandler(func(ctx context.Context, req *remote.Request) (*remote.Response, error) {
+			if n := inFlight.Add(1); n > peak.Load() {
+				peak.Store(n)
+			}
+			defer inFlight.Add(-1)
+			time.Sleep(20 * time.Millisecond)
+			return remote.MockHandler(ctx, req)
+		}))
+		defer slow.Close()
+		limited, err := NewRemote(map[string]interface{}{
+			"url":             slow.URL,
+			"batch_size":      2,
+			"batch_timeout":   "1ms",
+			"max_concurrency": 1,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := limited.Process(pipeline.Message{Data: map[string]interface{}{}}); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if peak.Load() != 1 {
+			t.Errorf("expected 1 request at a time, got %d", peak.Load())
+		}
+		limited.(*Remote).Close()
+		if _, err := limited.Process(pipeline.Message{Data: map[string]interface{}{}}); !errors.Is(err, errRemoteClosed) {
+			t.Errorf("expected closed error, got %v", err)
+		}
+
+		// Same protocol over gRPC
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		grpcServer := grpc.NewServer()
+		remote.RegisterGRPC(grpcServer, remote.MockHandler)
+		go grpcServer.Serve(lis)
+		defer grpcServer.Stop()
+
+		g, err := NewRemote(map[string]interface{}{"protocol": "grpc", "url": lis.Addr().String()})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer g.(*Remote).Close()
+		res, err := g.Process(pipeline.Message{ID: "g1", Data: map[string]interface{}{"x": 1}})
+		if err != nil || res.Data["mock_id"] != "g1" {
+			t.Errorf("unexpected grpc result: %v (%v)", res.Data, err)
+		}
+	})
+
+	// 18. Test Conditionals
+	t.Run("Conditionals", func(t *testing.T) {
+		p, err := NewIf(map[string]interface{}{
+			"field":    "country",
+			"operator": "!=",
+			"value":    "BR",
+			"processors": []interface{}{
+				map[string]interface{}{"type": "regex_replace", "config": map[string]interface{}{
+					"field": "email", "pattern": "^[^@]+", "replacement": "***",
+				}},
+			},
+			"else": []interface{}{
+				map[string]interface{}{"type": "mutate", "config": map[string]interface{}{
+					"add": map[string]interface{}{"local": true},
+				}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err := p.Process(pipeline.Message{Data: map[string]interface{}{"country": "US", "email": "john@example.com"}})
+		if err != nil || res.Data["email"] != "***@example.com" {
+			t.Errorf("expected masked email, got %v (%v)", res.Data, err)
+		}
+		res, err = p.Process(pipeline.Message{Data: map[string]interface{}{"country": "BR", "email": "joao@example.com"}})
+		if err != nil || res.Data["email"] != "joao@example.com" || res.Data["local"] != true {
+			t.Errorf("expected else branch, got %v (%v)", res.Data, err)
+		}
+
+		sw, err := NewSwitch(map[string]interface{}{
+			"field": "event_type",
+			"cases": map[string]interface{}{
+				"login": []interface{}{
+					map[string]interface{}{"type": "mutate", "config": map[string]interface{}{
+						"add": map[string]interface{}{"kind": "auth"},
+					}},
+				},
+				"purchase": []interface{}{
+					map[string]interface{}{"type": "if", "config": map[string]interface{}{
+						"all": []interface{}{
+							map[string]interface{}{"field": "amount", "operator": ">=", "value": 100},
+							map[string]interface{}{"field": "Metadata.source", "operator": "in", "value": []interface{}{"web", "app"}},
+						},
+						"processors": []interface{}{
+							map[string]interface{}{"type": "script", "config": map[string]interface{}{
+								"source": "def process(msg):\n    return None\n",
+							}},
+						},
+					}},
+				},
+			},
+			"default": []interface{}{
+				map[string]interface{}{"type": "filter", "config": map[string]interface{}{
+					"field": "missing", "operator": "==", "value": "x",
+				}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err = sw.Process(pipeline.Message{Data: map[string]interface{}{"event_type": "login"}})
+		if err != nil || res.Data["kind"] != "auth" {
+			t.Errorf("expected login case, got %v (%v)", res.Data, err)
+		}
+
+		// Drops from nested chains propagate as drops, errors as errors
+		big := pipeline.Message{
+			Data:     map[string]interface{}{"event_type": "purchase", "amount": 150.0},
+			Metadata: map[string]string{"source": "web"},
+		}
+		if _, err := sw.Process(big); !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected drop, got %v", err)
+		}
+		small := pipeline.Message{Data: map[string]interface{}{"event_type": "purchase", "amount": 10.0}}
+		if res, err := sw.Process(small); err != nil || res.Data["amount"] != 10.0 {
+			t.Errorf("expected pass-through, got %v (%v)", res.Data, err)
+		}
+		if _, err := sw.Process(pipeline.Message{Data: map[string]interface{}{"event_type": "other"}}); err == nil || errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected error from default case, got %v", err)
+		}
+
+		// Large JSON integers match their cases and values without exponent
+		plan, err := NewSwitch(map[string]interface{}{
+			"field": "plan_id",
+			"cases": map[string]interface{}{
+				"1500000": []interface{}{
+					map[string]interface{}{"type": "mutate", "config": map[string]interface{}{
+						"add": map[string]interface{}{"plan": "gold"},
+					}},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err = plan.Process(pipeline.Message{Data: map[string]interface{}{"plan_id": 1500000.0}})
+		if err != nil || res.Data["plan"] != "gold" {
+			t.Errorf("expected the 1500000 case, got %v (%v)", res.Data, err)
+		}
+		for _, c := range []map[string]interface{}{
+			{"field": "ids", "operator": "contains", "value": "1500000"},
+			{"field": "ref", "operator": "contains", "value": 1500000.0},
+		} {
+			cond, err := parseCondition(c)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			msg := pipeline.Message{Data: map[string]interface{}{
+				"ids": []interface{}{1500000.0},
+				"ref": "order-1500000",
+			}}
+			if !cond.Match(msg) {
+				t.Errorf("expected %v to match", c)
+			}
+		}
+
+		if _, err := NewIf(map[string]interface{}{"field": "a", "operator": "~", "processors": []interface{}{}}); err == nil {
+			t.Error("expected error for unknown operator")
+		}
+
+		// A branch failing to build closes the processors already built
+		counter := map[string]interface{}{"type": "test_close_counter"}
+		broken := map[string]interface{}{"type": "unknown"}
+		closedCounters.Store(0)
+		if _, err := NewIf(map[string]interface{}{
+			"field": "a", "operator": "exists",
+			"processors": []interface{}{counter},
+			"else":       []interface{}{counter, broken},
+		}); err == nil {
+			t.Error("expected error for the broken else branch")
+		}
+		if _, err := NewSwitch(map[string]interface{}{
+			"field":   "a",
+			"cases":   map[string]interface{}{"x": []interface{}{counter}},
+			"default": []interface{}{broken},
+		}); err == nil {
+			t.Error("expected error for the broken default")
+		}
+		if n := closedCounters.Load(); n != 3 {
+			t.Errorf("expected 3 processors closed, got %d", n)
+		}
+	})
+
+	// 19. Test Flatten / Unflatten
+	t.Run("Flatten", func(t *testing.T) {
+		nested := func() map[string]interface{} {
+			return map[string]interface{}{
+				"id": 1.0,
+				"usuario": map[string]interface{}{
+					"email":   "a@b.com",
+					"address": map[string]interface{}{"city": "SP"},
+				},
+				"tags": []interface{}{"x", "y"},
+			}
+		}
+
+		p, _ := NewFlatten(map[string]interface{}{})
+		res, err := p.Process(pipeline.Message{Data: nested()})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Data["usuario.address.city"] != "SP" || res.Data["tags.1"] != "y" || len(res.Data) != 5 {
+			t.Errorf("unexpected flattened data: %v", res.Data)
+		}
+		if GetValue(res.Data, "usuario.email") != "a@b.com" {
+			t.Errorf("dotted lookup should find flattened keys: %v", res.Data)
+		}
+
+		u, _ := NewUnflatten(map[string]interface{}{"arrays": true})
+		back, err := u.Process(res)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(back.Data, nested()) {
+			t.Errorf("round trip mismatch: %v", back.Data)
+		}
+
+		p, _ = NewFlatten(map[string]interface{}{"separator": "_", "max_depth": 2, "keep_arrays": true})
+		res, _ = p.Process(pipeline.Message{Data: nested()})
+		if res.Data["usuario_email"] != "a@b.com" || res.Data["usuario_address"] == nil || res.Data["tags"] == nil {
+			t.Errorf("unexpected flattened data: %v", res.Data)
+		}
+
+		p, _ = NewFlatten(map[string]interface{}{"field": "usuario.address"})
+		res, _ = p.Process(pipeline.Message{Data: nested()})
+		if res.Data["usuario.address.city"] != "SP" || GetValue(res.Data, "usuario.email") != "a@b.com" {
+			t.Errorf("unexpected flattened field: %v", res.Data)
+		}
+
+		// Masking a flattened field replaces the literal key instead of adding a
+		// nested copy next to the raw value
+		mask, _ := NewPII(map[string]interface{}{
+			"fields": []interface{}{map[string]interface{}{"field": "usuario.email", "strategy": "redact"}},
+		})
+		flat, _ := NewFlatten(map[string]interface{}{})
+		res, _ = flat.Process(pipeline.Message{Data: nested()})
+		res, err = mask.Process(res)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.Data["usuario.email"] != "[REDACTED]" || res.Data["usuario"] != nil {
+			t.Errorf("expected the flattened key masked in place, got %v", res.Data)
+		}
+		if !DeleteValue(res.Data, "usuario.address.city") || res.Data["usuario.address.city"] != nil {
+			t.Errorf("expected the flattened key deleted, got %v", res.Data)
+		}
+
+		// Numeric keys stay object keys unless arrays is set
+		plain, _ := NewUnflatten(map[string]interface{}{})
+		res, _ = plain.Process(pipeline.Message{Data: map[string]interface{}{"codes.0": "x", "codes.1": "y"}})
+		if codes, ok := res.Data["codes"].(map[string]interface{}); !ok || codes["1"] != "y" {
+			t.Errorf("expected an object, got %v", res.Data["codes"])
+		}
+
+		if _, err := u.Process(pipeline.Message{Data: map[string]interface{}{"a": 1, "a.b": 2}}); err == nil {
+			t.Error("expected conflict error")
+		}
+	})
+
+	// 20. Test Wasm (testdata/fixture.wat)
+	t.Run("Wasm", func(t *testing.T) {
+		newWasm := func(extra map[string]interface{}) *Wasm {
+			config := map[string]interface{}{"file": filepath.Join("testdata", "fixture.wasm")}
+			for k, v := range extra {
+				config[k] = v
+			}
+			p, err := NewWasm(config)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			t.Cleanup(func() { p.(*Wasm).Close() })
+			return p.(*Wasm)
+		}
+		p := newWasm(map[string]interface{}{"timeout": "100ms", "max_calls": 1000})
+		call := func(id string, data map[string]interface{}) (pipeline.Message, error) {
+			return p.Process(pipeline.Message{ID: id, Data: data, Metadata: map[string]string{"k": "v"}})
+		}
+
+		res, err := call("transform", map[string]interface{}{"Amount": 10.0})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.ID != "Transform" || res.Data["Amount"] != 10.0 || res.Metadata["k"] != "v" {
+			t.Errorf("unexpected wasm result: %+v", res)
+		}
+
+		if _, err := call("drop", map[string]interface{}{}); !errors.Is(err, pipeline.ErrDropMessage) {
+			t.Errorf("expected drop, got %v", err)
+		}
+		if _, err := call("error", map[string]interface{}{}); err == nil || err.Error() != "rejected" {
+			t.Errorf("expected the module's error, got %v", err)
+		}
+
+		if _, err := call("loop", map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "aborted after 100ms") {
+			t.Errorf("expected timeout error, got %v", err)
+		}
+		if _, err := call("fuel", map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "exceeded 1000 function calls") {
+			t.Errorf("expected max_calls error, got %v", err)
+		}
+		// Broken instances were replaced
+		if res, err := call("again", map[string]interface{}{}); err != nil || res.ID != "Again" {
+			t.Errorf("expected a working instance after failures, got %v (%v)", res.ID, err)
+		}
+
+		// Concurrent calls get instances of their own, one per worker is kept
+		p.SetWorkerCount(2)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := call("parallel", map[string]interface{}{}); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if len(p.idle) > 2 {
+			t.Errorf("expected at most 2 idle instances, got %d", len(p.idle))
+		}
+
+		// Growing past max_memory_pages fails the message, not the processor
+		small := newWasm(map[string]interface{}{"max_memory_pages": 2})
+		big := pipeline.Message{ID: "big", Data: map[string]interface{}{"blob": strings.Repeat("x", 200000)}}
+		if _, err := small.Process(big); err == nil {
+			t.Error("expected an error past the memory limit")
+		}
+		if _, err := small.Process(pipeline.Message{ID: "small", Data: map[string]interface{}{}}); err != nil {
+			t.Errorf("unexpected error after the memory limit: %v", err)
+		}
+
+		// Output aliasing the input is read before the buffer is freed, and
+		// freed once: strict.wasm zeroes freed memory and traps on a double free
+		strict := newWasm(map[string]interface{}{"file": filepath.Join("testdata", "strict.wasm")})
+		for i := 0; i < 2; i++ {
+			res, err := strict.Process(pipeline.Message{ID: "echo", Data: map[string]interface{}{"n": 1.0}})
+			if err != nil || res.ID != "echo" || res.Data["n"] != 1.0 {
+				t.Errorf("unexpected echo result: %+v (%v)", res, err)
+			}
+		}
+	})
 }
@@ -0,0 +1,137 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"regexp"
+)
+
+func init() {
+	RegisterProcessor("regex_extract", NewRegexExtractor)
+}
+
+// --- Regex Extractor ---
+
+// RegexExtractor applies a pattern with named groups to a field and writes
+// each group to its own field. Groups go to Target.<group> unless Captures
+// maps the group to an explicit path. With Multiple set every match is
+// collected and each field receives an array of values, with nil where an
+// optional group did not participate in a match.
+type RegexExtractor struct {
+	Field      string
+	Pattern    *regexp.Regexp
+	Target     string
+	Captures   map[string]string // Group -> path
+	Types      map[string]string // Group -> string, int, float, bool
+	Multiple   bool
+	FailOnMiss bool
+}
+
+func NewRegexExtractor(config map[string]interface{}) (pipeline.Processor, error) {
+	field := getString(config, "field")
+	if field == "" {
+		return nil, fmt.Errorf("regex_extract: 'field' is required")
+	}
+	re, err := regexp.Compile(getString(config, "pattern"))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]bool)
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			groups[name] = true
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("regex_extract: pattern has no named groups")
+	}
+
+	p := &RegexExtractor{
+		Field:    field,
+		Pattern:  re,
+		Target:   getString(config, "target"),
+		Captures: getStringMap(config, "captures"),
+		Types:    getStringMap(config, "types"),
+		Multiple: getBool(config, "multiple", false),
+	}
+	for group := range p.Captures {
+		if !groups[group] {
+			return nil, fmt.Errorf("regex_extract: pattern has no group named '%s'", group)
+		}
+	}
+	for group, typ := range p.Types {
+		if !validType(typ) {
+			return nil, fmt.Errorf("regex_extract: group '%s' has unsupported type '%s'", group, typ)
+		}
+	}
+
+	switch onNoMatch := getString(config, "on_no_match"); onNoMatch {
+	case "", "pass":
+	case "fail":
+		p.FailOnMiss = true
+	default:
+		return nil, fmt.Errorf("regex_extract: on_no_match must be 'pass' or 'fail', got '%s'", onNoMatch)
+	}
+	return p, nil
+}
+
+func (p *RegexExtractor) Process(msg pipeline.Message) (pipeline.Message, error) {
+	val := GetValue(msg.Data, p.Field)
+	text, ok := toText(val)
+	if !ok {
+		if p.FailOnMiss {
+			return msg, fmt.Errorf("regex_extract field '%s' missing or not a string", p.Field)
+		}
+		return msg, nil
+	}
+
+	limit := 1
+	if p.Multiple {
+		limit = -1
+	}
+	matches := p.Pattern.FindAllStringSubmatchIndex(text, limit)
+	if len(matches) == 0 {
+		if p.FailOnMiss {
+			return msg, fmt.Errorf("regex_extract pattern did not match field '%s'", p.Field)
+		}
+		return msg, nil
+	}
+
+	for i, name := range p.Pattern.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		var values []interface{}
+		matched := false
+		for _, m := range matches {
+			if m[2*i] < 0 {
+				// nil keeps the values of every group aligned with the matches
+				values = append(values, nil)
+				continue
+			}
+			v, err := convertValue(text[m[2*i]:m[2*i+1]], p.Types[name])
+			if err != nil {
+				return msg, fmt.Errorf("regex_extract group '%s': %w", name, err)
+			}
+			values = append(values, v)
+			matched = true
+		}
+		if !matched {
+			continue
+		}
+
+		path, ok := p.Captures[name]
+		if !ok {
+			path = joinPath(p.Target, name)
+		}
+		var out interface{} = values
+		if !p.Multiple {
+			out = values[0]
+		}
+		if err := SetValue(msg.Data, path, out); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
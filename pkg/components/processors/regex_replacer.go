@@ -12,13 +12,16 @@ func init() {
 // --- Regex Replacer ---
 
 type RegexReplacer struct {
-	Field       string
+	Field       string   // Single path, the "field" config key
+	Fields      []string // Further paths; Field is skipped if listed again
 	Pattern     *regexp.Regexp
 	Replacement string
 }
 
 func NewRegexReplacer(config map[string]interface{}) (pipeline.Processor, error) {
+	// "field" takes a single path, "fields" a list of paths
 	field := getString(config, "field")
+	fields := getStringSlice(config, "fields")
 	pattern := getString(config, "pattern")
 	replacement := getString(config, "replacement")
 
@@ -26,26 +29,45 @@ func NewRegexReplacer(config map[string]interface{}) (pipeline.Processor, error)
 	if err != nil {
 		return nil, err
 	}
+	// A path listed twice is replaced once
+	var paths []string
+	for _, f := range fields {
+		if f != field && !containsString(paths, f) {
+			paths = append(paths, f)
+		}
+	}
 	return &RegexReplacer{
 		Field:       field,
+		Fields:      paths,
 		Pattern:     re,
 		Replacement: replacement,
 	}, nil
 }
 
 func (p *RegexReplacer) Process(msg pipeline.Message) (pipeline.Message, error) {
-	val := GetValue(msg.Data, p.Field)
-	if val != nil {
-		if strVal, ok := val.(string); ok {
-			newVal := p.Pattern.ReplaceAllString(strVal, p.Replacement)
-			if err := SetValue(msg.Data, p.Field, newVal); err != nil {
-				return msg, err
-			}
+	if p.Field != "" {
+		if err := p.replace(msg.Data, p.Field); err != nil {
+			return msg, err
+		}
+	}
+	for _, field := range p.Fields {
+		if field == p.Field {
+			continue
+		}
+		if err := p.replace(msg.Data, field); err != nil {
+			return msg, err
 		}
 	}
 	return msg, nil
 }
 
+func (p *RegexReplacer) replace(data map[string]interface{}, field string) error {
+	if strVal, ok := GetValue(data, field).(string); ok {
+		return SetValue(data, field, p.Pattern.ReplaceAllString(strVal, p.Replacement))
+	}
+	return nil
+}
+
 // Helper function to safely get string from map
 func getString(m map[string]interface{}, key string) string {
 	if v, ok := m[key]; ok {
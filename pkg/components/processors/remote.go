@@ -0,0 +1,436 @@
+package processors
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"datapipeline/pkg/pipeline"
+	"datapipeline/pkg/remote"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	RegisterProcessor("remote", NewRemote)
+}
+
+// --- Remote ---
+
+// Remote sends messages to an external service speaking the sidecar protocol
+// of package remote (over HTTP or gRPC) and merges the returned data into
+// msg.Data, at Target or at the root.
+//
+// With BatchSize > 1, concurrent calls are grouped into micro-batches of up
+// to BatchSize messages, waiting at most BatchTimeout for a batch to fill.
+// Requests are bounded by MaxConcurrency and retried with exponential backoff
+// on transport errors, HTTP 429/5xx and transient gRPC codes.
+//
+// When the remote keeps failing, OnFailure decides what happens to the
+// message: "error" (default) fails it, "drop" drops it and "pass" lets it
+// through unchanged with the error in Metadata["remote_error"]. After
+// BreakerThreshold consecutive failed requests the remote is considered down
+// for BreakerCooldown and calls fail fast instead of waiting on timeouts.
+// Only failures showing the remote is down count: transport errors, HTTP 5xx
+// and unavailable gRPC codes, not rejected requests or throttling.
+type Remote struct {
+	Protocol         string // "http" or "grpc"
+	URL              string // HTTP URL or gRPC address
+	Target           string
+	Timeout          time.Duration
+	Retries          int
+	RetryBackoff     time.Duration
+	MaxConcurrency   int
+	BatchSize        int
+	BatchTimeout     time.Duration
+	OnFailure        string
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	headers map[string]string
+	client  *http.Client
+	conn    *grpc.ClientConn
+	sem     chan struct{}
+	pending chan *remoteCall
+	done    chan struct{}
+	wg      sync.WaitGroup // batchLoop and the batches it dispatched
+
+	closeMu sync.RWMutex // Orders enqueued calls before Close drains them
+	closed  bool
+
+	mu        sync.Mutex // Guards the circuit breaker
+	failures  int
+	openUntil time.Time
+}
+
+type remoteCall struct {
+	msg    remote.Message
+	result chan remoteOutcome
+}
+
+type remoteOutcome struct {
+	res remote.Result
+	err error
+}
+
+// errRemoteUnavailable is returned while the circuit breaker is open.
+var errRemoteUnavailable = errors.New("remote unavailable (circuit open)")
+
+// errRemoteClosed is returned for calls made or still queued after Close.
+var errRemoteClosed = errors.New("remote processor closed")
+
+// errPermanent marks request errors that retrying cannot fix.
+type errPermanent struct{ err error }
+
+func (e errPermanent) Error() string { return e.err.Error() }
+func (e errPermanent) Unwrap() error { return e.err }
+
+// errThrottled marks requests the remote refused for now (HTTP 429, gRPC
+// ResourceExhausted): they are retried but don't trip the circuit breaker.
+type errThrottled struct{ err error }
+
+func (e errThrottled) Error() string { return e.err.Error() }
+func (e errThrottled) Unwrap() error { return e.err }
+
+func NewRemote(config map[string]interface{}) (pipeline.Processor, error) {
+	timeout, err := getDuration(config, "timeout", 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("remote: %w", err)
+	}
+	backoff, err := getDuration(config, "retry_backoff", 100*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("remote: %w", err)
+	}
+	batchTimeout, err := getDuration(config, "batch_timeout", 10*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("remote: %w", err)
+	}
+	cooldown, err := getDuration(config, "breaker_cooldown", 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("remote: %w", err)
+	}
+
+	p := &Remote{
+		Protocol:         getString(config, "protocol"),
+		URL:              getString(config, "url"),
+		Target:           getString(config, "target"),
+		Timeout:          timeout,
+		Retries:          getInt(config, "retries", 2),
+		RetryBackoff:     backoff,
+		MaxConcurrency:   getInt(config, "max_concurrency", 4),
+		BatchSize:        getInt(config, "batch_size", 1),
+		BatchTimeout:     batchTimeout,
+		OnFailure:        getString(config, "on_failure"),
+		BreakerThreshold: getInt(config, "breaker_threshold", 5),
+		BreakerCooldown:  cooldown,
+		headers:          getStringMap(config, "headers"),
+		done:             make(chan struct{}),
+	}
+	if p.Protocol == "" {
+		p.Protocol = "http"
+	}
+	if p.OnFailure == "" {
+		p.OnFailure = "error"
+	}
+	if p.MaxConcurrency <= 0 {
+		p.MaxConcurrency = 1
+	}
+	if p.URL == "" {
+		return nil, fmt.Errorf("remote: 'url' is required")
+	}
+	switch p.OnFailure {
+	case "error", "drop", "pass":
+	default:
+		return nil, fmt.Errorf("remote: unknown on_failure %q", p.OnFailure)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: getBool(config, "insecure_skip_verify", false)}
+	switch p.Protocol {
+	case "http":
+		p.client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: p.MaxConcurrency,
+		}}
+	case "grpc":
+		creds := insecure.NewCredentials()
+		if getBool(config, "tls", false) {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		if p.conn, err = grpc.NewClient(p.URL, grpc.WithTransportCredentials(creds)); err != nil {
+			return nil, fmt.Errorf("remote: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("remote: unknown protocol %q", p.Protocol)
+	}
+
+	p.sem = make(chan struct{}, p.MaxConcurrency)
+	if p.BatchSize > 1 {
+		p.pending = make(chan *remoteCall, p.BatchSize)
+		p.wg.Add(1)
+		go p.batchLoop()
+	}
+	return p, nil
+}
+
+func (p *Remote) Process(msg pipeline.Message) (pipeline.Message, error) {
+	call := &remoteCall{
+		msg:    remote.Message{ID: msg.ID, Data: msg.Data, Metadata: msg.Metadata},
+		result: make(chan remoteOutcome, 1),
+	}
+	if p.pending != nil {
+		if !p.enqueue(call) {
+			call.result <- remoteOutcome{err: errRemoteClosed}
+		}
+	} else {
+		p.sem <- struct{}{}
+		p.dispatch([]*remoteCall{call})
+		<-p.sem
+	}
+	out := <-call.result
+
+	if out.err != nil {
+		switch p.OnFailure {
+		case "drop":
+			return msg, fmt.Errorf("%w: %v", pipeline.ErrDropMessage, out.err)
+		case "pass":
+			if msg.Metadata == nil {
+				msg.Metadata = make(map[string]string)
+			}
+			msg.Metadata["remote_error"] = out.err.Error()
+			return msg, nil
+		default:
+			return msg, out.err
+		}
+	}
+
+	if msg.Data == nil {
+		msg.Data = make(map[string]interface{})
+	}
+	switch {
+	case out.res.Error != "":
+		return msg, fmt.Errorf("remote error: %s", out.res.Error)
+	case out.res.Drop:
+		return msg, fmt.Errorf("%w: dropped by remote", pipeline.ErrDropMessage)
+	case p.Target != "":
+		if err := SetValue(msg.Data, p.Target, out.res.Data); err != nil {
+			return msg, fmt.Errorf("failed to set target field: %w", err)
+		}
+	default:
+		for k, v := range out.res.Data {
+			msg.Data[k] = v
+		}
+	}
+	return msg, nil
+}
+
+// enqueue hands call to batchLoop, reporting false once Close was called.
+func (p *Remote) enqueue(call *remoteCall) bool {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.pending <- call:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// batchLoop groups pending calls into micro-batches.
+func (p *Remote) batchLoop() {
+	defer p.wg.Done()
+	for {
+		var first *remoteCall
+		select {
+		case first = <-p.pending:
+		case <-p.done:
+			return
+		}
+
+		batch := []*remoteCall{first}
+		timer := time.NewTimer(p.BatchTimeout)
+	fill:
+		for len(batch) < p.BatchSize {
+			select {
+			case call := <-p.pending:
+				batch = append(batch, call)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+
+		p.sem <- struct{}{} // Don't pile up batches beyond the concurrency limit
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() { <-p.sem }()
+			p.dispatch(batch)
+		}()
+	}
+}
+
+// dispatch sends calls as one request and delivers each call's outcome. The
+// caller holds a slot of sem.
+func (p *Remote) dispatch(calls []*remoteCall) {
+	req := &remote.Request{Messages: make([]remote.Message, len(calls))}
+	for i, c := range calls {
+		req.Messages[i] = c.msg
+	}
+	resp, err := p.send(req)
+	for i, c := range calls {
+		if err != nil {
+			c.result <- remoteOutcome{err: err}
+		} else {
+			c.result <- remoteOutcome{res: resp.Results[i]}
+		}
+	}
+}
+
+// send performs the request with retries, honouring the circuit breaker.
+func (p *Remote) send(req *remote.Request) (*remote.Response, error) {
+	if !p.available() {
+		return nil, errRemoteUnavailable
+	}
+
+	var err error
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.RetryBackoff << (attempt - 1))
+		}
+		var resp *remote.Response
+		if resp, err = p.do(req); err == nil {
+			if len(resp.Results) != len(req.Messages) {
+				err = errPermanent{fmt.Errorf("remote returned %d results for %d messages", len(resp.Results), len(req.Messages))}
+				break
+			}
+			p.record(true)
+			return resp, nil
+		}
+		var perm errPermanent
+		if errors.As(err, &perm) {
+			break
+		}
+	}
+	// The remote answered a rejected or throttled request: it isn't down
+	var perm errPermanent
+	var throttled errThrottled
+	if !errors.As(err, &perm) && !errors.As(err, &throttled) {
+		p.record(false)
+	}
+	return nil, err
+}
+
+func (p *Remote) do(req *remote.Request) (*remote.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+
+	var resp remote.Response
+	if p.conn != nil {
+		err := p.conn.Invoke(ctx, remote.GRPCMethod, req, &resp, grpc.ForceCodec(remote.Codec{}))
+		if err != nil {
+			switch status.Code(err) {
+			case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+				return nil, err
+			case codes.ResourceExhausted:
+				return nil, errThrottled{err}
+			default:
+				return nil, errPermanent{err}
+			}
+		}
+		return &resp, nil
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errPermanent{err}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errPermanent{err}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		httpReq.Header.Set(k, v)
+	}
+	httpResp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		err := fmt.Errorf("remote returned %s: %s", httpResp.Status, bytes.TrimSpace(msg))
+		switch {
+		case httpResp.StatusCode == http.StatusTooManyRequests:
+			return nil, errThrottled{err}
+		case httpResp.StatusCode >= 500:
+			return nil, err
+		}
+		return nil, errPermanent{err}
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid remote response: %w", err)
+	}
+	return &resp, nil
+}
+
+func (p *Remote) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().After(p.openUntil)
+}
+
+// record updates the circuit breaker with the outcome of a request.
+func (p *Remote) record(ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if p.BreakerThreshold > 0 && p.failures >= p.BreakerThreshold {
+		p.openUntil = time.Now().Add(p.BreakerCooldown)
+		p.failures = 0
+	}
+}
+
+func (p *Remote) Close() error {
+	p.closeMu.Lock()
+	if p.closed {
+		p.closeMu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.closeMu.Unlock()
+
+	close(p.done)
+	p.wg.Wait()
+	// Fail the calls still queued: no batch will pick them up
+drain:
+	for {
+		select {
+		case call := <-p.pending:
+			call.result <- remoteOutcome{err: errRemoteClosed}
+		default:
+			break drain
+		}
+	}
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package processors
+
+import (
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/lib/math"
+	starlarktime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+func init() {
+	RegisterProcessor("script", NewScript)
+}
+
+// --- Script ---
+
+// Script runs a user supplied Starlark (Python dialect) script on every
+// message. The script must define process(msg), where msg is a dict with
+// "id", "data" and "metadata". The function returns:
+//   - a message dict (the same one, modified, or a new one)
+//   - a list of message dicts to split the message
+//   - None to drop the message
+//
+// The json, math and time modules are predeclared. The script is initialized
+// once and its globals frozen, so every worker calls the same process. Calls
+// run with Timeout on a pool of pre-warmed starlark.Threads, one per engine
+// worker (see pipeline.WorkerAware).
+type Script struct {
+	Timeout  time.Duration
+	MaxSteps uint64
+	process  starlark.Callable
+	threads  chan *starlark.Thread // Idle threads
+}
+
+var scriptOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+	Recursion:       true,
+}
+
+var scriptPredeclared = starlark.StringDict{
+	"json": json.Module,
+	"math": math.Module,
+	"time": starlarktime.Module,
+}
+
+func NewScript(config map[string]interface{}) (pipeline.Processor, error) {
+	source := getString(config, "source")
+	filename := "inline.star"
+	if path := getString(config, "file"); path != "" {
+		if source != "" {
+			return nil, fmt.Errorf("script: 'source' and 'file' are mutually exclusive")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("script: %w", err)
+		}
+		source, filename = string(data), path
+	}
+	if source == "" {
+		return nil, fmt.Errorf("script: 'source' or 'file' is required")
+	}
+
+	timeout, err := getDuration(config, "timeout", time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("script: %w", err)
+	}
+	_, program, err := starlark.SourceProgramOptions(scriptOptions, filename, source, scriptPredeclared.Has)
+	if err != nil {
+		return nil, fmt.Errorf("script: %w", err)
+	}
+
+	p := &Script{
+		Timeout:  timeout,
+		MaxSteps: uint64(getInt(config, "max_steps", 0)),
+	}
+	// Frozen globals are safe for concurrent use from many threads
+	globals, err := program.Init(p.newThread(), scriptPredeclared)
+	if err != nil {
+		return nil, fmt.Errorf("script: %w", err)
+	}
+	globals.Freeze()
+	fn, ok := globals["process"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("script: script must define a process(msg) function")
+	}
+	p.process = fn
+	p.SetWorkerCount(1)
+	return p, nil
+}
+
+// SetWorkerCount pre-warms one thread per worker.
+func (p *Script) SetWorkerCount(n int) {
+	if n < 1 {
+		n = 1
+	}
+	p.threads = make(chan *starlark.Thread, n)
+	for i := 0; i < n; i++ {
+		p.threads <- p.newThread()
+	}
+}
+
+// release returns thread to the pool, dropping it if the pool is full.
+func (p *Script) release(thread *starlark.Thread) {
+	select {
+	case p.threads <- thread:
+	default:
+	}
+}
+
+func (p *Script) newThread() *starlark.Thread {
+	thread := &starlark.Thread{
+		Name:  "script",
+		Print: func(_ *starlark.Thread, msg string) { log.Printf("script: %s", msg) },
+	}
+	if p.MaxSteps > 0 {
+		thread.SetMaxExecutionSteps(p.MaxSteps)
+	}
+	return thread
+}
+
+// Process runs the script for engines or chains that cannot split; a script
+// returning several messages is an error here.
+func (p *Script) Process(msg pipeline.Message) (pipeline.Message, error) {
+	msgs, err := p.ProcessMulti(msg)
+	if err != nil {
+		return msg, err
+	}
+	switch len(msgs) {
+	case 0:
+		return msg, fmt.Errorf("%w: script returned None", pipeline.ErrDropMessage)
+	case 1:
+		return msgs[0], nil
+	default:
+		return msg, fmt.Errorf("script returned %d messages but the chain cannot split here", len(msgs))
+	}
+}
+
+func (p *Script) ProcessMulti(msg pipeline.Message) ([]pipeline.Message, error) {
+	input, err := messageToStarlark(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := <-p.threads
+	thread.Uncancel()
+	thread.Steps = 0
+	timer := time.AfterFunc(p.Timeout, func() { thread.Cancel("timeout") })
+	result, err := starlark.Call(thread, p.process, starlark.Tuple{input}, nil)
+	if timer.Stop() {
+		p.release(thread)
+	} else {
+		// The timeout may cancel the thread at any time now: replace it
+		p.release(p.newThread())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("script error: %w", err)
+	}
+
+	switch r := result.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.List:
+		out := make([]pipeline.Message, 0, r.Len())
+		for i := 0; i < r.Len(); i++ {
+			m, err := messageFromStarlark(r.Index(i), msg)
+			if err != nil {
+				return nil, fmt.Errorf("script result %d: %w", i, err)
+			}
+			out = append(out, m)
+		}
+		return out, nil
+	default:
+		m, err := messageFromStarlark(result, msg)
+		if err != nil {
+			return nil, err
+		}
+		return []pipeline.Message{m}, nil
+	}
+}
+
+func messageToStarlark(msg pipeline.Message) (*starlark.Dict, error) {
+	data, err := toStarlark(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	meta := starlark.NewDict(len(msg.Metadata))
+	for k, v := range msg.Metadata {
+		meta.SetKey(starlark.String(k), starlark.String(v))
+	}
+	d := starlark.NewDict(3)
+	d.SetKey(starlark.String("id"), starlark.String(msg.ID))
+	d.SetKey(starlark.String("data"), data)
+	d.SetKey(starlark.String("metadata"), meta)
+	return d, nil
+}
+
+// messageFromStarlark converts a returned message dict. Parts of a split keep
+// the original message reference so their offsets are committed.
+func messageFromStarlark(v starlark.Value, orig pipeline.Message) (pipeline.Message, error) {
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return orig, fmt.Errorf("expected a message dict, got %s", v.Type())
+	}
+	out := pipeline.Message{ID: orig.ID, OriginalMessage: orig.OriginalMessage, Metadata: map[string]string{}}
+
+	if id, found, _ := d.Get(starlark.String("id")); found {
+		if s, ok := starlark.AsString(id); ok {
+			out.ID = s
+		}
+	}
+	dataVal, found, _ := d.Get(starlark.String("data"))
+	if !found {
+		return orig, fmt.Errorf("message dict has no 'data'")
+	}
+	data, err := fromStarlark(dataVal)
+	if err != nil {
+		return orig, err
+	}
+	if out.Data, ok = data.(map[string]interface{}); !ok {
+		return orig, fmt.Errorf("message 'data' must be a dict")
+	}
+	if metaVal, found, _ := d.Get(starlark.String("metadata")); found {
+		if meta, ok := metaVal.(*starlark.Dict); ok {
+			for _, item := range meta.Items() {
+				k, _ := starlark.AsString(item[0])
+				if s, ok := starlark.AsString(item[1]); ok {
+					out.Metadata[k] = s
+				} else {
+					out.Metadata[k] = item[1].String()
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// toStarlark converts decoded JSON style values to Starlark values.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch t := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(t), nil
+	case string:
+		return starlark.String(t), nil
+	case []byte:
+		return starlark.Bytes(t), nil
+	case int:
+		return starlark.MakeInt(t), nil
+	case int64:
+		return starlark.MakeInt64(t), nil
+	case float64:
+		return starlark.Float(t), nil
+	case float32:
+		return starlark.Float(t), nil
+	case []interface{}:
+		elems := make([]starlark.Value, len(t))
+		for i, e := range t {
+			sv, err := toStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = sv
+		}
+		return starlark.NewList(elems), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := starlark.NewDict(len(t))
+		for _, k := range keys {
+			sv, err := toStarlark(t[k])
+			if err != nil {
+				return nil, err
+			}
+			d.SetKey(starlark.String(k), sv)
+		}
+		return d, nil
+	default:
+		return starlark.String(fmt.Sprint(t)), nil
+	}
+}
+
+// maxExactFloat is the largest integer every smaller one of which float64
+// represents exactly.
+const maxExactFloat = 1 << 53
+
+// fromStarlark converts Starlark values back to JSON style Go values.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch t := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(t), nil
+	case starlark.String:
+		return string(t), nil
+	case starlark.Bytes:
+		return []byte(t), nil
+	case starlark.Int:
+		// Numbers are float64 as in decoded JSON, unless that loses precision
+		if i, ok := t.Int64(); ok {
+			if i >= -maxExactFloat && i <= maxExactFloat {
+				return float64(i), nil
+			}
+			return i, nil
+		}
+		f, _ := new(big.Float).SetInt(t.BigInt()).Float64()
+		return f, nil
+	case starlark.Float:
+		return float64(t), nil
+	case *starlark.List:
+		out := make([]interface{}, t.Len())
+		for i := 0; i < t.Len(); i++ {
+			e, err := fromStarlark(t.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = e
+		}
+		return out, nil
+	case starlark.Tuple:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			ge, err := fromStarlark(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ge
+		}
+		return out, nil
+	case *starlark.Dict:
+		out := make(map[string]interface{}, t.Len())
+		for _, item := range t.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", item[0].Type())
+			}
+			e, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			out[k] = e
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported script value of type %s", v.Type())
+	}
+}
@@ -0,0 +1,50 @@
+;; Test module for the wasm processor. The first character of the message ID
+;; picks the behavior:
+;;   d  drop the message
+;;   e  fail it with {"error":"rejected"}
+;;   l  loop forever without calling functions (only the timeout stops it)
+;;   f  loop forever calling a function (max_calls runs out)
+;;   otherwise echo the message with that character uppercased
+;; alloc is a bump allocator growing the memory as needed, so large messages
+;; hit the memory limit. Rebuild with: wat2wasm fixture.wat -o fixture.wasm
+(module
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 1024))
+  (data (i32.const 16) "{\"error\":\"rejected\"}")
+
+  (func $tick)
+
+  (func (export "alloc") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $heap))
+    (global.set $heap (i32.add (local.get $ptr) (local.get $size)))
+    (if (i32.gt_u (global.get $heap) (i32.shl (memory.size) (i32.const 16)))
+      (then
+        (if (i32.eq
+              (memory.grow (i32.add
+                (i32.shr_u
+                  (i32.sub (global.get $heap) (i32.shl (memory.size) (i32.const 16)))
+                  (i32.const 16))
+                (i32.const 1)))
+              (i32.const -1))
+          (then unreachable))))
+    (local.get $ptr))
+
+  (func (export "dealloc") (param i32 i32)
+    (global.set $heap (i32.const 1024)))
+
+  (func (export "process") (param $ptr i32) (param $len i32) (result i64)
+    (local $c i32)
+    (local.set $c (i32.load8_u offset=7 (local.get $ptr))) ;; {"id":"
+    (if (i32.eq (local.get $c) (i32.const 100)) ;; d
+      (then (return (i64.const 0))))
+    (if (i32.eq (local.get $c) (i32.const 101)) ;; e: 16 << 32 | 20
+      (then (return (i64.const 68719476756))))
+    (if (i32.eq (local.get $c) (i32.const 108)) ;; l
+      (then (loop $spin (br $spin))))
+    (if (i32.eq (local.get $c) (i32.const 102)) ;; f
+      (then (loop $burn (call $tick) (br $burn))))
+    (i32.store8 offset=7 (local.get $ptr) (i32.sub (local.get $c) (i32.const 32)))
+    (i64.or
+      (i64.shl (i64.extend_i32_u (local.get $ptr)) (i64.const 32))
+      (i64.extend_i32_u (local.get $len)))))
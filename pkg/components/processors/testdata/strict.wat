@@ -0,0 +1,26 @@
+;; Test module for the wasm processor's buffer ownership. process echoes the
+;; message, returning its input buffer. alloc tags every block as live and
+;; dealloc traps on a block that is not (a double free or a foreign pointer),
+;; then zeroes it, so reading a freed buffer yields invalid JSON.
+;; Rebuild with: wat2wasm strict.wat -o strict.wasm
+(module
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 1024))
+
+  (func (export "alloc") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (i32.add (global.get $heap) (i32.const 4)))
+    (i32.store (global.get $heap) (i32.const 1))
+    (global.set $heap (i32.add (local.get $ptr) (local.get $size)))
+    (local.get $ptr))
+
+  (func (export "dealloc") (param $ptr i32) (param $len i32)
+    (if (i32.ne (i32.load (i32.sub (local.get $ptr) (i32.const 4))) (i32.const 1))
+      (then unreachable))
+    (i32.store (i32.sub (local.get $ptr) (i32.const 4)) (i32.const 0))
+    (memory.fill (local.get $ptr) (i32.const 0) (local.get $len)))
+
+  (func (export "process") (param $ptr i32) (param $len i32) (result i64)
+    (i64.or
+      (i64.shl (i64.extend_i32_u (local.get $ptr)) (i64.const 32))
+      (i64.extend_i32_u (local.get $len)))))
@@ -1,32 +1,27 @@
 package processors
 
 import (
+	"datapipeline/pkg/pipeline"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// GetValue retrieves a value from a nested map using dot notation.
+// GetValue retrieves a value from a nested map using dot notation
+// (see pipeline.GetValue).
 func GetValue(data map[string]interface{}, path string) interface{} {
-	keys := strings.Split(path, ".")
-	var current interface{} = data
-
-	for _, key := range keys {
-		if m, ok := current.(map[string]interface{}); ok {
-			if val, exists := m[key]; exists {
-				current = val
-			} else {
-				return nil
-			}
-		} else {
-			return nil
-		}
-	}
-	return current
+	return pipeline.GetValue(data, path)
 }
 
 // SetValue sets a value in a nested map using dot notation.
-// It creates intermediate maps if they don't exist.
+// It creates intermediate maps if they don't exist. An existing literal
+// dotted key (see GetValue) is overwritten in place.
 func SetValue(data map[string]interface{}, path string, value interface{}) error {
+	if _, exists := data[path]; exists {
+		data[path] = value
+		return nil
+	}
 	keys := strings.Split(path, ".")
 	if len(keys) == 0 {
 		return fmt.Errorf("empty path")
@@ -52,3 +47,190 @@ func SetValue(data map[string]interface{}, path string, value interface{}) error
 	current[keys[len(keys)-1]] = value
 	return nil
 }
+
+// getBool safely gets a bool from a config map, returning def when absent.
+func getBool(m map[string]interface{}, key string, def bool) bool {
+	if v, ok := m[key]; ok {
+		if b, ok := v.(bool); ok {
+			return b
+		}
+	}
+	return def
+}
+
+// getInt safely gets an integer from a config map, returning def when absent.
+// YAML decodes whole numbers as int, but JSON-sourced configs use float64.
+func getInt(m map[string]interface{}, key string, def int) int {
+	if v, ok := m[key]; ok {
+		switch n := v.(type) {
+		case int:
+			return n
+		case int64:
+			return int(n)
+		case float64:
+			return int(n)
+		}
+	}
+	return def
+}
+
+// getDuration safely gets a duration from a config map. Strings use Go
+// duration syntax ("5m", "1h30m"); numbers are seconds.
+func getDuration(m map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	switch v := m[key].(type) {
+	case nil:
+		return def, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration for '%s': %w", key, err)
+		}
+		return d, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	default:
+		return 0, fmt.Errorf("invalid duration for '%s': %v", key, v)
+	}
+}
+
+// getStringSlice safely gets a list of strings from a config map.
+// A single string is accepted as a one-element list.
+func getStringSlice(m map[string]interface{}, key string) []string {
+	var res []string
+	switch v := m[key].(type) {
+	case string:
+		res = append(res, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				res = append(res, s)
+			}
+		}
+	case []string:
+		res = append(res, v...)
+	}
+	return res
+}
+
+// getStringMap safely gets a map of strings from a config map.
+func getStringMap(m map[string]interface{}, key string) map[string]string {
+	res := make(map[string]string)
+	if v, ok := m[key].(map[string]interface{}); ok {
+		for k, val := range v {
+			if s, ok := val.(string); ok {
+				res[k] = s
+			}
+		}
+	}
+	return res
+}
+
+// toText converts a raw payload value ([]byte or string) to a string.
+func toText(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case []byte:
+		return string(t), true
+	}
+	return "", false
+}
+
+// scalarText renders any scalar as text (see pipeline.ValueText).
+func scalarText(v interface{}) string {
+	return pipeline.ValueText(v)
+}
+
+// validType reports whether typ is accepted by convertValue.
+func validType(typ string) bool {
+	switch typ {
+	case "", "string", "int", "integer", "float", "number", "bool", "boolean":
+		return true
+	}
+	return false
+}
+
+// convertValue converts a textual value to the given type name.
+// Supported types are "string", "int", "float" and "bool"; an empty type keeps the string.
+func convertValue(s string, typ string) (interface{}, error) {
+	switch typ {
+	case "", "string":
+		return s, nil
+	case "int", "integer":
+		return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	case "float", "number":
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	case "bool", "boolean":
+		return strconv.ParseBool(strings.TrimSpace(s))
+	default:
+		return nil, fmt.Errorf("unsupported type '%s'", typ)
+	}
+}
+
+// joinPath joins a target prefix and a dot path.
+func joinPath(prefix, path string) string {
+	if prefix == "" {
+		return path
+	}
+	return prefix + "." + path
+}
+
+// DeleteValue removes a value from a nested map using dot notation.
+// It reports whether the value existed. An existing literal dotted key (see
+// GetValue) is the one removed.
+func DeleteValue(data map[string]interface{}, path string) bool {
+	if _, exists := data[path]; exists {
+		delete(data, path)
+		return true
+	}
+	keys := strings.Split(path, ".")
+	current := data
+	for i := 0; i < len(keys)-1; i++ {
+		m, ok := current[keys[i]].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		current = m
+	}
+	last := keys[len(keys)-1]
+	if _, ok := current[last]; !ok {
+		return false
+	}
+	delete(current, last)
+	return true
+}
+
+// deepCopy copies nested maps and slices so the copy can be mutated independently.
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = deepCopy(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, val := range t {
+			s[i] = deepCopy(val)
+		}
+		return s
+	case []byte:
+		return append([]byte(nil), t...)
+	default:
+		return v
+	}
+}
+
+// interpolate replaces every ${ref} in tmpl with its value from the message
+// (see pipeline.Interpolate). When tmpl is exactly one reference the
+// referenced value is returned as is, keeping its type.
+func interpolate(tmpl string, msg pipeline.Message) interface{} {
+	if m := pipeline.Placeholder.FindStringSubmatchIndex(tmpl); m != nil && m[0] == 0 && m[1] == len(tmpl) {
+		return pipeline.LookupRef(msg, tmpl[m[2]:m[3]])
+	}
+	out, _ := pipeline.Interpolate(tmpl, msg)
+	return out
+}
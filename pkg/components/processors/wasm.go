@@ -0,0 +1,316 @@
+package processors
+
+import (
+	"context"
+	"datapipeline/pkg/pipeline"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func init() {
+	RegisterProcessor("wasm", NewWasm)
+}
+
+// --- Wasm ---
+
+// Wasm runs a WebAssembly module on every message, so processors can be
+// written in any language that compiles to wasm. Modules are run by wazero
+// (pure Go) and must follow this ABI:
+//
+//	memory                       exported linear memory
+//	alloc(size i32) -> i32       returns a buffer of size bytes for the host
+//	process(ptr i32, len i32) -> i64
+//
+// The host writes the message as JSON ({"id", "data", "metadata"}) into a
+// buffer from alloc and calls process. The result packs the output pointer in
+// the high 32 bits and its length in the low 32 bits. A zero length drops
+// the message; otherwise the output is the transformed message JSON, or
+// {"error": "..."} to fail it. The output may be the input buffer itself
+// (e.g. a module editing the message in place) or a buffer from alloc; the
+// host copies it before freeing anything. An optional dealloc(ptr i32,
+// len i32) export is then called once per distinct buffer. WASI is available for modules that need it.
+// Data is encoded as JSON, so []byte fields reach the guest base64-encoded
+// and come back as strings.
+//
+// MaxMemoryPages caps each instance's memory (64KiB pages). MaxCalls bounds
+// the guest function calls of one message (0: unlimited). It is not
+// instruction fuel: wazero can't meter single instructions, so a loop that
+// makes no calls is only stopped by Timeout, which bounds the wall clock. An
+// instance that fails a call is closed and a new one is created on the next
+// call.
+//
+// Instances are not safe for concurrent use. Each call takes an idle
+// instance or creates one, and at most one idle instance per engine worker
+// is kept for reuse (see pipeline.WorkerAware).
+type Wasm struct {
+	Timeout        time.Duration
+	MaxMemoryPages uint32
+	MaxCalls       int64
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+
+	mu      sync.Mutex
+	idle    []api.Module
+	maxIdle int
+}
+
+type wasmMessage struct {
+	ID       string                 `json:"id"`
+	Data     map[string]interface{} `json:"data"`
+	Metadata map[string]string      `json:"metadata"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+func NewWasm(config map[string]interface{}) (pipeline.Processor, error) {
+	path := getString(config, "file")
+	if path == "" {
+		return nil, fmt.Errorf("wasm: 'file' is required")
+	}
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+	timeout, err := getDuration(config, "timeout", time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+
+	p := &Wasm{
+		Timeout:        timeout,
+		MaxMemoryPages: uint32(getInt(config, "max_memory_pages", 256)), // 16MiB
+		MaxCalls:       int64(getInt(config, "max_calls", 10000000)),
+		maxIdle:        1,
+	}
+	ctx := context.Background()
+	if p.MaxCalls > 0 {
+		// Listeners are attached when the module is compiled
+		ctx = experimental.WithFunctionListenerFactory(ctx, callMeter{})
+	}
+	p.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(p.MaxMemoryPages).
+		WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, p.runtime); err != nil {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+	if p.compiled, err = p.runtime.CompileModule(ctx, code); err != nil {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm: failed to compile %s: %w", path, err)
+	}
+
+	// The first instance checks the ABI up front
+	mod, err := p.instantiate(ctx)
+	if err != nil {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+	p.idle = append(p.idle, mod)
+	return p, nil
+}
+
+// callsKey carries the call budget of the running message in its context.
+type callsKey struct{}
+
+type wasmCalls struct {
+	left      int64
+	exhausted bool
+	cancel    context.CancelFunc
+}
+
+// callMeter charges the message's budget once per guest function call and
+// cancels the call when it runs out; the runtime then closes the instance.
+type callMeter struct{}
+
+func (callMeter) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return callMeter{}
+}
+
+func (callMeter) Before(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	if calls, ok := ctx.Value(callsKey{}).(*wasmCalls); ok {
+		if calls.left--; calls.left < 0 && !calls.exhausted {
+			calls.exhausted = true
+			calls.cancel()
+		}
+	}
+}
+
+func (callMeter) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (callMeter) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
+
+// SetWorkerCount caps the idle instances at one per worker.
+func (p *Wasm) SetWorkerCount(n int) {
+	if n < 1 {
+		n = 1
+	}
+	p.mu.Lock()
+	p.maxIdle = n
+	p.mu.Unlock()
+}
+
+// acquire takes an idle instance, or creates one when all are busy.
+func (p *Wasm) acquire() (api.Module, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		mod := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return mod, nil
+	}
+	p.mu.Unlock()
+	return p.instantiate(context.Background())
+}
+
+// release keeps mod for reuse, or closes it when the pool is full.
+func (p *Wasm) release(mod api.Module) {
+	p.mu.Lock()
+	if len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, mod)
+		mod = nil
+	}
+	p.mu.Unlock()
+	if mod != nil {
+		mod.Close(context.Background())
+	}
+}
+
+// instantiate creates an instance and checks that it implements the ABI.
+func (p *Wasm) instantiate(ctx context.Context) (api.Module, error) {
+	// Anonymous instances, so several can coexist in the runtime
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize", "_start"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"alloc", "process"} {
+		if mod.ExportedFunction(name) == nil {
+			mod.Close(ctx)
+			return nil, fmt.Errorf("module does not export %q", name)
+		}
+	}
+	if mod.Memory() == nil {
+		mod.Close(ctx)
+		return nil, fmt.Errorf("module does not export its memory")
+	}
+	return mod, nil
+}
+
+func (p *Wasm) Process(msg pipeline.Message) (pipeline.Message, error) {
+	input, err := json.Marshal(wasmMessage{ID: msg.ID, Data: msg.Data, Metadata: msg.Metadata})
+	if err != nil {
+		return msg, fmt.Errorf("failed to encode message for wasm: %w", err)
+	}
+
+	mod, err := p.acquire()
+	if err != nil {
+		return msg, fmt.Errorf("failed to create wasm instance: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	calls := &wasmCalls{left: p.MaxCalls, cancel: cancel}
+	if p.MaxCalls > 0 {
+		ctx = context.WithValue(ctx, callsKey{}, calls)
+	}
+	output, err := p.call(ctx, mod, input)
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	cancel()
+	if err != nil {
+		// A failed call may leave the instance closed or its state broken:
+		// drop it, the next call creates a fresh one
+		mod.Close(context.Background())
+		switch {
+		case calls.exhausted:
+			return msg, fmt.Errorf("wasm call exceeded %d function calls", p.MaxCalls)
+		case timedOut:
+			return msg, fmt.Errorf("wasm call aborted after %s", p.Timeout)
+		}
+		return msg, err
+	}
+	p.release(mod)
+
+	if len(output) == 0 {
+		return msg, fmt.Errorf("%w: wasm module dropped the message", pipeline.ErrDropMessage)
+	}
+	var out wasmMessage
+	if err := json.Unmarshal(output, &out); err != nil {
+		return msg, fmt.Errorf("invalid wasm output: %w", err)
+	}
+	if out.Error != "" {
+		return msg, errors.New(out.Error)
+	}
+	if out.Data == nil {
+		return msg, fmt.Errorf("invalid wasm output: missing 'data'")
+	}
+	msg.Data = out.Data
+	if out.ID != "" {
+		msg.ID = out.ID
+	}
+	if out.Metadata != nil {
+		msg.Metadata = out.Metadata
+	}
+	return msg, nil
+}
+
+// call copies input into the instance, runs process and copies the output out.
+func (p *Wasm) call(ctx context.Context, mod api.Module, input []byte) ([]byte, error) {
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("wasm alloc failed: %w", err)
+	}
+	inPtr := uint32(res[0])
+	if !mod.Memory().Write(inPtr, input) {
+		return nil, fmt.Errorf("wasm alloc returned an out of range buffer")
+	}
+
+	res, err = mod.ExportedFunction("process").Call(ctx, uint64(inPtr), uint64(len(input)))
+	if err != nil {
+		// The instance is dropped, so its buffers need no dealloc
+		return nil, fmt.Errorf("wasm process failed: %w", err)
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	var output []byte
+	if outLen > 0 {
+		view, ok := mod.Memory().Read(outPtr, outLen)
+		if !ok {
+			return nil, fmt.Errorf("wasm process returned an out of range buffer")
+		}
+		output = append([]byte(nil), view...)
+	}
+
+	// The output is copied before freeing anything, as it may alias the input
+	if err := p.dealloc(ctx, mod, inPtr, uint32(len(input))); err != nil {
+		return nil, err
+	}
+	if outLen > 0 && outPtr != inPtr {
+		if err := p.dealloc(ctx, mod, outPtr, outLen); err != nil {
+			return nil, err
+		}
+	}
+	return output, nil
+}
+
+func (p *Wasm) dealloc(ctx context.Context, mod api.Module, ptr, size uint32) error {
+	if fn := mod.ExportedFunction("dealloc"); fn != nil {
+		if _, err := fn.Call(ctx, uint64(ptr), uint64(size)); err != nil {
+			return fmt.Errorf("wasm dealloc failed: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *Wasm) Close() error {
+	p.mu.Lock()
+	p.idle = nil
+	p.mu.Unlock()
+	return p.runtime.Close(context.Background())
+}
@@ -0,0 +1,305 @@
+package sqlserver
+
+import (
+	"context"
+	"database/sql"
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// typeFamilies groups SQL Server types whose values convert into each other
+// without surprises; a declared type is compatible with live columns of the
+// same family.
+var typeFamilies = map[string]string{
+	"bit":     "bit",
+	"tinyint": "integer", "smallint": "integer", "int": "integer", "bigint": "integer",
+	"decimal": "decimal", "numeric": "decimal", "money": "decimal", "smallmoney": "decimal",
+	"float": "float", "real": "float",
+	"char": "string", "varchar": "string", "nchar": "string", "nvarchar": "string", "text": "string", "ntext": "string",
+	"date": "time", "time": "time", "datetime": "time", "datetime2": "time", "smalldatetime": "time", "datetimeoffset": "time",
+	"binary": "binary", "varbinary": "binary", "image": "binary",
+	"uniqueidentifier": "uniqueidentifier",
+}
+
+var typePattern = regexp.MustCompile(`^\s*(\w+)\s*(?:\(\s*(\w+)\s*(?:,\s*\d+\s*)?\))?\s*$`)
+
+// liveColumn is a column of the target table, from INFORMATION_SCHEMA.
+type liveColumn struct {
+	dataType  string
+	maxLength int // Characters for strings, -1 for MAX
+}
+
+// ensureSchema validates the target table against the field mappings at
+// startup, creating it or adding missing columns when configured. Columns
+// whose type must be inferred are left for the first batch (see migrate).
+func (s *SQLServerSink) ensureSchema(ctx context.Context) error {
+	live, err := s.liveColumns(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(live) == 0 {
+		if !s.cfg.CreateTable {
+			return fmt.Errorf("table %s does not exist (set create_table to create it)", s.table)
+		}
+		s.tableMissing = true
+		s.pending = s.fields
+	} else if s.pending, s.addSoftDelete, err = validateSchema(s.table, s.cfg, live); err != nil {
+		return err
+	}
+	if (s.tableMissing || len(s.pending) > 0 || s.addSoftDelete) && hasTypes(s.pending) {
+		return s.migrate(ctx, nil)
+	}
+	return nil
+}
+
+// validateSchema checks the live columns of an existing table against cfg:
+// mapped columns must exist with a compatible type (or be added, returned as
+// pending), as must the key, version and soft delete columns. It reports
+// whether the soft delete column must be added.
+func validateSchema(table string, cfg Config, live map[string]liveColumn) ([]FieldMapping, bool, error) {
+	var pending []FieldMapping
+	var problems []string
+	for _, f := range cfg.Fields {
+		col, exists := live[strings.ToLower(f.Target)]
+		switch {
+		case !exists && isKeyColumn(cfg, f.Target):
+			// An added key column would be nullable and unindexed
+			problems = append(problems, fmt.Sprintf("key column %s is missing", f.Target))
+		case !exists && cfg.AddColumns:
+			pending = append(pending, f)
+		case !exists:
+			problems = append(problems, fmt.Sprintf("column %s is missing", f.Target))
+		case f.Type != "" && !compatibleType(f.Type, col):
+			problems = append(problems, fmt.Sprintf("column %s is %s, declared %s", f.Target, col, f.Type))
+		}
+	}
+
+	if col, exists := live[strings.ToLower(cfg.VersionColumn)]; exists {
+		switch typeFamilies[strings.ToLower(col.dataType)] {
+		case "bit", "binary", "uniqueidentifier":
+			problems = append(problems, fmt.Sprintf("version column %s is %s, which does not order versions", cfg.VersionColumn, col))
+		}
+	}
+
+	addSoftDelete := false
+	if cfg.SoftDeleteColumn != "" {
+		col, exists := live[strings.ToLower(cfg.SoftDeleteColumn)]
+		switch {
+		case !exists && cfg.AddColumns:
+			addSoftDelete = true
+		case !exists:
+			problems = append(problems, fmt.Sprintf("soft delete column %s is missing", cfg.SoftDeleteColumn))
+		case typeFamilies[strings.ToLower(col.dataType)] != "bit":
+			problems = append(problems, fmt.Sprintf("soft delete column %s is %s, expected bit", cfg.SoftDeleteColumn, col))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, false, fmt.Errorf("table %s does not match the field mappings: %s", table, strings.Join(problems, "; "))
+	}
+	return pending, addSoftDelete, nil
+}
+
+// liveColumns returns the columns of the target table by lowercase name,
+// none when it doesn't exist.
+func (s *SQLServerSink) liveColumns(ctx context.Context) (map[string]liveColumn, error) {
+	schema, name := "", s.table
+	if i := strings.LastIndex(s.table, "."); i >= 0 {
+		schema, name = s.table[:i], s.table[i+1:]
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT COLUMN_NAME, DATA_TYPE, COALESCE(CHARACTER_MAXIMUM_LENGTH, 0)
+FROM INFORMATION_SCHEMA.COLUMNS
+WHERE TABLE_NAME = @name AND TABLE_SCHEMA = COALESCE(NULLIF(@schema, ''), SCHEMA_NAME())`,
+		sql.Named("name", strings.Trim(name, "[]")), sql.Named("schema", strings.Trim(schema, "[]")))
+	if err != nil {
+		return nil, fmt.Errorf("error reading columns of %s: %w", s.table, err)
+	}
+	defer rows.Close()
+
+	live := map[string]liveColumn{}
+	for rows.Next() {
+		var colName string
+		var col liveColumn
+		if err := rows.Scan(&colName, &col.dataType, &col.maxLength); err != nil {
+			return nil, fmt.Errorf("error reading columns of %s: %w", s.table, err)
+		}
+		live[strings.ToLower(colName)] = col
+	}
+	return live, rows.Err()
+}
+
+// migrate creates the table or adds the pending columns, inferring the
+// types not declared from msgs. It runs outside the batch transaction, so
+// the schema stays in place if the batch fails.
+func (s *SQLServerSink) migrate(ctx context.Context, msgs []pipeline.Message) error {
+	defs := make([]string, len(s.pending))
+	for i, f := range s.pending {
+		key := isKeyColumn(s.cfg, f.Target)
+		sqlType := f.Type
+		if sqlType == "" {
+			var err error
+			if sqlType, err = inferType(msgs, f.Source, key); err != nil {
+				return fmt.Errorf("error migrating %s: %w", s.table, err)
+			}
+			log.Printf("Column %s of %s inferred as %s from field %s.", f.Target, s.table, sqlType, f.Source)
+		}
+		defs[i] = columnSQL(f.Target, sqlType, s.tableMissing && key)
+	}
+
+	var stmt string
+	if s.tableMissing {
+		stmt = createTableSQL(s.table, defs, s.cfg)
+	} else {
+		softDelete := ""
+		if s.addSoftDelete {
+			softDelete = s.cfg.SoftDeleteColumn
+		}
+		stmt = alterTableSQL(s.table, defs, softDelete)
+	}
+	if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("error migrating %s: %w", s.table, err)
+	}
+	log.Printf("Schema of %s updated: %s", s.table, stmt)
+	s.tableMissing, s.pending, s.addSoftDelete = false, nil, false
+	return nil
+}
+
+// columnSQL renders a column definition.
+func columnSQL(name, sqlType string, notNull bool) string {
+	if notNull {
+		return quoteIdent(name) + " " + sqlType + " NOT NULL"
+	}
+	return quoteIdent(name) + " " + sqlType + " NULL"
+}
+
+// softDeleteSQL renders the soft delete flag column, cleared for new rows.
+func softDeleteSQL(name string) string {
+	return quoteIdent(name) + " BIT NOT NULL DEFAULT 0"
+}
+
+// createTableSQL builds the CREATE TABLE for the column definitions, plus
+// the primary key of upserts and the soft delete column.
+func createTableSQL(table string, defs []string, cfg Config) string {
+	defs = append([]string{}, defs...)
+	if cfg.Mode == "upsert" {
+		keys := make([]string, len(cfg.KeyColumns))
+		for i, k := range cfg.KeyColumns {
+			keys[i] = quoteIdent(k)
+		}
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(keys, ", ")))
+	}
+	if cfg.SoftDeleteColumn != "" {
+		defs = append(defs, softDeleteSQL(cfg.SoftDeleteColumn))
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(table), strings.Join(defs, ", "))
+}
+
+// alterTableSQL builds the ALTER TABLE adding the column definitions and,
+// when softDelete is set, that soft delete column.
+func alterTableSQL(table string, defs []string, softDelete string) string {
+	if softDelete != "" {
+		defs = append(append([]string{}, defs...), softDeleteSQL(softDelete))
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD %s", quoteIdent(table), strings.Join(defs, ", "))
+}
+
+func isKeyColumn(cfg Config, column string) bool {
+	for _, k := range cfg.KeyColumns {
+		if strings.EqualFold(k, column) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTypes(fields []FieldMapping) bool {
+	for _, f := range fields {
+		if f.Type == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// inferType picks a column type from the first non null value of source in
+// msgs. JSON numbers are FLOAT, as decoded JSON doesn't tell integers apart:
+// declare a type for exact columns. Key columns get an indexable type: BIGINT
+// for numbers, which must then be whole in every message, as a FLOAT key
+// can't match exactly, and NVARCHAR(450) for the rest.
+func inferType(msgs []pipeline.Message, source string, key bool) (string, error) {
+	var value interface{}
+	for _, msg := range msgs {
+		if value = pipeline.GetValue(msg.Data, source); value != nil {
+			break
+		}
+	}
+	switch value.(type) {
+	case bool:
+		return "BIT", nil
+	case int, int32, int64:
+		return "BIGINT", nil
+	case float32, float64:
+		if key {
+			for _, msg := range msgs {
+				if f, ok := pipeline.GetValue(msg.Data, source).(float64); ok && f != math.Trunc(f) {
+					return "", fmt.Errorf("key field %s has fractional values, declare its type", source)
+				}
+			}
+			return "BIGINT", nil
+		}
+		return "FLOAT", nil
+	case time.Time:
+		return "DATETIME2", nil
+	case []byte:
+		return "VARBINARY(MAX)", nil
+	}
+	if key {
+		return "NVARCHAR(450)", nil
+	}
+	return "NVARCHAR(MAX)", nil
+}
+
+// compatibleType reports whether a declared type (e.g. "VARCHAR(100)") can
+// be written to a live column: same family and, for strings, no shorter.
+func compatibleType(declared string, live liveColumn) bool {
+	m := typePattern.FindStringSubmatch(declared)
+	if m == nil {
+		return false
+	}
+	base := strings.ToLower(m[1])
+	family, known := typeFamilies[base]
+	if !known {
+		return base == strings.ToLower(live.dataType)
+	}
+	if family != typeFamilies[strings.ToLower(live.dataType)] {
+		return false
+	}
+	if family != "string" || live.maxLength == -1 {
+		return true
+	}
+	length := 1 // char and varchar default to one character
+	switch {
+	case base == "text" || base == "ntext" || strings.EqualFold(m[2], "max"):
+		length = -1
+	case m[2] != "":
+		length, _ = strconv.Atoi(m[2])
+	}
+	return length != -1 && length <= live.maxLength
+}
+
+func (c liveColumn) String() string {
+	switch c.maxLength {
+	case 0:
+		return c.dataType
+	case -1:
+		return c.dataType + "(max)"
+	}
+	return fmt.Sprintf("%s(%d)", c.dataType, c.maxLength)
+}
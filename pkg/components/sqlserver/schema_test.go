@@ -0,0 +1,153 @@
+package sqlserver
+
+import (
+	"datapipeline/pkg/pipeline"
+	"strings"
+	"testing"
+)
+
+func TestCompatibleType(t *testing.T) {
+	tests := []struct {
+		declared string
+		live     liveColumn
+		want     bool
+	}{
+		{"INT", liveColumn{dataType: "bigint"}, true},
+		{"DECIMAL(10, 2)", liveColumn{dataType: "decimal"}, true},
+		{"DECIMAL(10,2)", liveColumn{dataType: "int"}, false},
+		{"VARCHAR(50)", liveColumn{dataType: "varchar", maxLength: 100}, true},
+		{"NVARCHAR(200)", liveColumn{dataType: "varchar", maxLength: 100}, false},
+		{"NVARCHAR(MAX)", liveColumn{dataType: "nvarchar", maxLength: 100}, false},
+		{"NVARCHAR(MAX)", liveColumn{dataType: "nvarchar", maxLength: -1}, true},
+		{"datetime2", liveColumn{dataType: "datetime"}, true},
+		{"xml", liveColumn{dataType: "xml"}, true},
+		{"xml", liveColumn{dataType: "nvarchar", maxLength: -1}, false},
+		{"VARCHAR(", liveColumn{dataType: "varchar", maxLength: 10}, false},
+	}
+	for _, tt := range tests {
+		if got := compatibleType(tt.declared, tt.live); got != tt.want {
+			t.Errorf("compatibleType(%q, %s) = %v, want %v", tt.declared, tt.live, got, tt.want)
+		}
+	}
+}
+
+func TestInferType(t *testing.T) {
+	msgs := []pipeline.Message{
+		{Data: map[string]interface{}{"id": "a1", "order": 1.0, "amount": 10.0, "active": true}},
+		{Data: map[string]interface{}{"id": "a2", "order": 2.0, "amount": 10.5, "qty": 3.0, "nested": map[string]interface{}{"n": 1.0}}},
+	}
+	tests := []struct {
+		source string
+		key    bool
+		want   string
+	}{
+		{"id", true, "NVARCHAR(450)"},
+		{"id", false, "NVARCHAR(MAX)"},
+		{"amount", false, "FLOAT"},
+		{"qty", false, "FLOAT"},
+		{"active", false, "BIT"},
+		{"nested.n", false, "FLOAT"},
+		{"missing", false, "NVARCHAR(MAX)"},
+		{"order", true, "BIGINT"},
+		{"order", false, "FLOAT"},
+	}
+	for _, tt := range tests {
+		if got, err := inferType(msgs, tt.source, tt.key); err != nil || got != tt.want {
+			t.Errorf("inferType(%q) = %s (%v), want %s", tt.source, got, err, tt.want)
+		}
+	}
+
+	// A FLOAT primary key can't match exactly: fractional keys need a declared type
+	if _, err := inferType(msgs, "amount", true); err == nil {
+		t.Error("expected an error for a fractional key")
+	}
+}
+
+func TestSchemaSQL(t *testing.T) {
+	defs := []string{columnSQL("order_id", "NVARCHAR(450)", true), columnSQL("total", "DECIMAL(10,2)", false)}
+
+	// 1. Upsert table with soft deletes
+	sql := createTableSQL("dbo.Orders", defs, Config{Mode: "upsert", KeyColumns: []string{"order_id"}, SoftDeleteColumn: "is_deleted"})
+	want := "CREATE TABLE [dbo].[Orders] ([order_id] NVARCHAR(450) NOT NULL, [total] DECIMAL(10,2) NULL, " +
+		"PRIMARY KEY ([order_id]), [is_deleted] BIT NOT NULL DEFAULT 0)"
+	if sql != want {
+		t.Errorf("unexpected CREATE:\n%s\nwant:\n%s", sql, want)
+	}
+
+	// 2. Insert table
+	sql = createTableSQL("Orders", defs[1:], Config{Mode: "insert"})
+	if want := "CREATE TABLE [Orders] ([total] DECIMAL(10,2) NULL)"; sql != want {
+		t.Errorf("unexpected CREATE:\n%s", sql)
+	}
+
+	// 3. New columns, with and without the soft delete flag
+	sql = alterTableSQL("Orders", defs[1:], "")
+	if want := "ALTER TABLE [Orders] ADD [total] DECIMAL(10,2) NULL"; sql != want {
+		t.Errorf("unexpected ALTER:\n%s", sql)
+	}
+	sql = alterTableSQL("Orders", nil, "is_deleted")
+	if want := "ALTER TABLE [Orders] ADD [is_deleted] BIT NOT NULL DEFAULT 0"; sql != want {
+		t.Errorf("unexpected ALTER:\n%s", sql)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	cfg := Config{
+		Mode: "upsert",
+		Fields: []FieldMapping{
+			{Source: "OrderID", Target: "order_id"},
+			{Source: "Amount", Target: "total", Type: "DECIMAL(10,2)"},
+			{Source: "Version", Target: "version"},
+			{Source: "Email", Target: "email"},
+		},
+		KeyColumns:       []string{"order_id"},
+		VersionColumn:    "version",
+		DeleteField:      "deleted",
+		SoftDeleteColumn: "is_deleted",
+	}
+	live := map[string]liveColumn{
+		"order_id":   {dataType: "nvarchar", maxLength: 450},
+		"total":      {dataType: "decimal"},
+		"version":    {dataType: "bigint"},
+		"email":      {dataType: "nvarchar", maxLength: -1},
+		"is_deleted": {dataType: "bit"},
+	}
+	if pending, add, err := validateSchema("Orders", cfg, live); err != nil || len(pending) > 0 || add {
+		t.Errorf("expected a matching table, got %v %v (%v)", pending, add, err)
+	}
+
+	// Missing columns are added when configured, except key columns
+	delete(live, "email")
+	delete(live, "is_deleted")
+	added := cfg
+	added.AddColumns = true
+	pending, add, err := validateSchema("Orders", added, live)
+	if err != nil || len(pending) != 1 || pending[0].Target != "email" || !add {
+		t.Errorf("expected email and is_deleted to be added, got %v %v (%v)", pending, add, err)
+	}
+
+	delete(live, "order_id")
+	live["total"] = liveColumn{dataType: "nvarchar", maxLength: 50}
+	live["version"] = liveColumn{dataType: "uniqueidentifier"}
+	_, _, err = validateSchema("Orders", cfg, live)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"table Orders does not match the field mappings: ",
+		"key column order_id is missing",
+		"column total is nvarchar(50), declared DECIMAL(10,2)",
+		"column email is missing",
+		"version column version is uniqueidentifier, which does not order versions",
+		"soft delete column is_deleted is missing",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in: %v", want, err)
+		}
+	}
+
+	live["is_deleted"] = liveColumn{dataType: "int"}
+	if _, _, err := validateSchema("Orders", cfg, live); err == nil || !strings.Contains(err.Error(), "soft delete column is_deleted is int, expected bit") {
+		t.Errorf("expected a soft delete type error, got %v", err)
+	}
+}
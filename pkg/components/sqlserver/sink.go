@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"datapipeline/pkg/pipeline"
 	"fmt"
-	"strings"
 
 	mssql "github.com/denisenkom/go-mssqldb"
 )
@@ -13,16 +12,65 @@ import (
 type FieldMapping struct {
 	Source string
 	Target string
+	Type   string // SQL type of Target, e.g. "DECIMAL(10,2)"; optional
+}
+
+// Config configures the SQL Server sink.
+type Config struct {
+	DSN    string
+	Table  string
+	Fields []FieldMapping
+
+	// Mode is "insert" (default, bulk insert) or "upsert": rows are bulk
+	// copied into a session temp table and merged into Table on KeyColumns,
+	// so redelivered batches update rows instead of duplicating them.
+	Mode       string
+	KeyColumns []string
+
+	// Upsert options. With VersionColumn (a mapped target), rows are only
+	// updated by newer versions. DeleteField is a source path flagging
+	// deletions, which delete the row, or set SoftDeleteColumn to 1 when it
+	// is set (upserts reset it to 0).
+	VersionColumn    string
+	DeleteField      string
+	SoftDeleteColumn string
+
+	// Table is checked at startup: every Target must exist, with a type
+	// compatible with its declared Type, as must the key columns, an
+	// ordered VersionColumn and a bit SoftDeleteColumn. CreateTable creates
+	// a missing table and AddColumns adds missing columns (nullable, except
+	// the soft delete flag), with the declared types or, for fields without
+	// one, types inferred from the first batch.
+	CreateTable bool
+	AddColumns  bool
 }
 
 type SQLServerSink struct {
 	db     *sql.DB
 	table  string
 	fields []FieldMapping
+	cfg    Config
+
+	// Schema changes waiting for the first batch to infer types
+	tableMissing  bool
+	pending       []FieldMapping
+	addSoftDelete bool
 }
 
-func NewSQLServerSink(dsn string, table string, fields []FieldMapping) (*SQLServerSink, error) {
-	db, err := sql.Open("sqlserver", dsn)
+func NewSQLServerSink(cfg Config) (*SQLServerSink, error) {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = "insert"
+	case "insert":
+	case "upsert":
+		if err := validateUpsert(cfg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+
+	db, err := sql.Open("sqlserver", cfg.DSN)
 	if err != nil {
 		return nil, err
 	}
@@ -32,11 +80,17 @@ func NewSQLServerSink(dsn string, table string, fields []FieldMapping) (*SQLServ
 		return nil, err
 	}
 
-	return &SQLServerSink{
+	s := &SQLServerSink{
 		db:     db,
-		table:  table,
-		fields: fields,
-	}, nil
+		table:  cfg.Table,
+		fields: cfg.Fields,
+		cfg:    cfg,
+	}
+	if err := s.ensureSchema(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *SQLServerSink) Write(ctx context.Context, msg pipeline.Message) error {
@@ -51,6 +105,12 @@ func (s *SQLServerSink) WriteBatch(ctx context.Context, msgs []pipeline.Message)
 		return fmt.Errorf("no mapped fields found")
 	}
 
+	if s.tableMissing || len(s.pending) > 0 || s.addSoftDelete {
+		if err := s.migrate(ctx, msgs); err != nil {
+			return err
+		}
+	}
+
 	// Build column list
 	cols := make([]string, len(s.fields))
 	for i, f := range s.fields {
@@ -68,8 +128,39 @@ func (s *SQLServerSink) WriteBatch(ctx context.Context, msgs []pipeline.Message)
 		}
 	}()
 
+	if s.cfg.Mode == "upsert" {
+		err = s.upsert(ctx, tx, cols, msgs)
+	} else {
+		err = copyRows(tx, s.table, cols, s.rows(msgs, nil))
+	}
+	if err != nil {
+		return err
+	}
+	// Commit transaction
+	return tx.Commit()
+}
+
+// rows builds the values of the mapped fields for each message, followed
+// by the values extra returns for it (if not nil).
+func (s *SQLServerSink) rows(msgs []pipeline.Message, extra func(i int, msg pipeline.Message) []interface{}) [][]interface{} {
+	rows := make([][]interface{}, len(msgs))
+	for i, msg := range msgs {
+		row := make([]interface{}, len(s.fields), len(s.fields)+2)
+		for j, field := range s.fields {
+			row[j] = pipeline.GetValue(msg.Data, field.Source)
+		}
+		if extra != nil {
+			row = append(row, extra(i, msg)...)
+		}
+		rows[i] = row
+	}
+	return rows
+}
+
+// copyRows bulk copies rows into table within tx.
+func copyRows(tx *sql.Tx, table string, cols []string, rows [][]interface{}) (err error) {
 	// Prepare bulk copy statement using CopyIn
-	stmt, err := tx.Prepare(mssql.CopyIn(s.table, mssql.BulkOptions{}, cols...))
+	stmt, err := tx.Prepare(mssql.CopyIn(table, mssql.BulkOptions{}, cols...))
 	if err != nil {
 		return err
 	}
@@ -81,39 +172,14 @@ func (s *SQLServerSink) WriteBatch(ctx context.Context, msgs []pipeline.Message)
 	}()
 
 	// Insert rows
-	for _, msg := range msgs {
-		row := make([]interface{}, len(s.fields))
-		for i, field := range s.fields {
-			row[i] = getValueFromMap(msg.Data, field.Source)
-		}
+	for _, row := range rows {
 		if _, err = stmt.Exec(row...); err != nil {
 			return err
 		}
 	}
 	// Finalize bulk copy
-	if _, err = stmt.Exec(); err != nil {
-		return err
-	}
-	// Commit transaction
-	return tx.Commit()
-}
-
-func getValueFromMap(data map[string]interface{}, path string) interface{} {
-	keys := strings.Split(path, ".")
-	var current interface{} = data
-
-	for _, key := range keys {
-		if m, ok := current.(map[string]interface{}); ok {
-			if val, exists := m[key]; exists {
-				current = val
-			} else {
-				return nil
-			}
-		} else {
-			return nil
-		}
-	}
-	return current
+	_, err = stmt.Exec()
+	return err
 }
 
 func (s *SQLServerSink) Close() error {
@@ -0,0 +1,173 @@
+package sqlserver
+
+import (
+	"context"
+	"database/sql"
+	"datapipeline/pkg/pipeline"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stageTable is the session temp table upserts are staged in. Besides the
+// mapped columns it has the batch position (the last message wins) and the
+// deletion flag.
+const (
+	stageTable   = "#pipeline_stage"
+	seqColumn    = "__seq"
+	deleteColumn = "__deleted"
+)
+
+func validateUpsert(cfg Config) error {
+	if len(cfg.KeyColumns) == 0 {
+		return fmt.Errorf("upsert mode requires key_columns")
+	}
+	mapped := map[string]bool{}
+	for _, f := range cfg.Fields {
+		mapped[f.Target] = true
+	}
+	for _, key := range cfg.KeyColumns {
+		if !mapped[key] {
+			return fmt.Errorf("key column %q is not a mapped target", key)
+		}
+	}
+	if cfg.VersionColumn != "" && !mapped[cfg.VersionColumn] {
+		return fmt.Errorf("version column %q is not a mapped target", cfg.VersionColumn)
+	}
+	if cfg.SoftDeleteColumn != "" && cfg.DeleteField == "" {
+		return fmt.Errorf("soft_delete_column requires delete_field")
+	}
+	if mapped[cfg.SoftDeleteColumn] {
+		return fmt.Errorf("soft delete column %q must not be mapped", cfg.SoftDeleteColumn)
+	}
+	return nil
+}
+
+// upsert stages msgs in a temp table and merges them into the target, all
+// within tx: the temp table lives in the transaction's session.
+func (s *SQLServerSink) upsert(ctx context.Context, tx *sql.Tx, cols []string, msgs []pipeline.Message) error {
+	if _, err := tx.ExecContext(ctx, stageSQL(s.table, cols)); err != nil {
+		return fmt.Errorf("error creating stage table: %w", err)
+	}
+
+	rows := s.rows(msgs, func(i int, msg pipeline.Message) []interface{} {
+		deleted := s.cfg.DeleteField != "" && truthy(pipeline.GetValue(msg.Data, s.cfg.DeleteField))
+		return []interface{}{i, deleted}
+	})
+	stageCols := append(append([]string{}, cols...), seqColumn, deleteColumn)
+	if err := copyRows(tx, stageTable, stageCols, rows); err != nil {
+		return fmt.Errorf("error staging rows: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, mergeSQL(s.table, cols, s.cfg)); err != nil {
+		return fmt.Errorf("error merging rows: %w", err)
+	}
+	_, err := tx.ExecContext(ctx, "DROP TABLE "+stageTable)
+	return err
+}
+
+// stageSQL (re)creates the stage table with the types of the target's
+// mapped columns. SELECT INTO would copy an IDENTITY column's property too,
+// rejecting the staged values; it doesn't when the SELECT is a UNION.
+func stageSQL(table string, cols []string) string {
+	quoted := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = quoteIdent(c)
+	}
+	selectCols := fmt.Sprintf("SELECT TOP 0 %s, CAST(0 AS INT) AS %s, CAST(0 AS BIT) AS %s",
+		strings.Join(quoted, ", "), seqColumn, deleteColumn)
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s; %s INTO %s FROM %s UNION ALL %s FROM %s",
+		stageTable, selectCols, stageTable, quoteIdent(table), selectCols, quoteIdent(table))
+}
+
+// mergeSQL builds the MERGE of the stage table into table. Only the last
+// row per key is merged (the newest, with a version column), and with a
+// version column matched rows are only changed by newer versions.
+func mergeSQL(table string, cols []string, cfg Config) string {
+	isKey := map[string]bool{}
+	on := make([]string, len(cfg.KeyColumns))
+	partition := make([]string, len(cfg.KeyColumns))
+	for i, key := range cfg.KeyColumns {
+		isKey[key] = true
+		on[i] = fmt.Sprintf("t.%s = s.%s", quoteIdent(key), quoteIdent(key))
+		partition[i] = quoteIdent(key)
+	}
+
+	order := seqColumn + " DESC"
+	newer := ""
+	if cfg.VersionColumn != "" {
+		v := quoteIdent(cfg.VersionColumn)
+		order = v + " DESC, " + order
+		newer = fmt.Sprintf(" AND (t.%s IS NULL OR s.%s > t.%s)", v, v, v)
+	}
+
+	var set, insertCols, insertVals []string
+	for _, c := range cols {
+		q := quoteIdent(c)
+		insertCols = append(insertCols, q)
+		insertVals = append(insertVals, "s."+q)
+		if isKey[c] {
+			continue
+		}
+		if cfg.SoftDeleteColumn != "" && c != cfg.VersionColumn {
+			// A soft deletion only flags the row (and bumps its version)
+			set = append(set, fmt.Sprintf("t.%s = CASE WHEN s.%s = 1 THEN t.%s ELSE s.%s END", q, deleteColumn, q, q))
+		} else {
+			set = append(set, fmt.Sprintf("t.%s = s.%s", q, q))
+		}
+	}
+	if cfg.SoftDeleteColumn != "" {
+		q := quoteIdent(cfg.SoftDeleteColumn)
+		set = append(set, fmt.Sprintf("t.%s = s.%s", q, deleteColumn))
+		insertCols = append(insertCols, q)
+		insertVals = append(insertVals, "0")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "MERGE INTO %s WITH (HOLDLOCK) AS t\n", quoteIdent(table))
+	fmt.Fprintf(&b, "USING (SELECT * FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s) AS __rn FROM %s) AS latest WHERE __rn = 1) AS s\n",
+		strings.Join(partition, ", "), order, stageTable)
+	fmt.Fprintf(&b, "ON %s\n", strings.Join(on, " AND "))
+	if cfg.DeleteField != "" && cfg.SoftDeleteColumn == "" {
+		fmt.Fprintf(&b, "WHEN MATCHED AND s.%s = 1%s THEN DELETE\n", deleteColumn, newer)
+		if len(set) > 0 {
+			fmt.Fprintf(&b, "WHEN MATCHED AND s.%s = 0%s THEN UPDATE SET %s\n", deleteColumn, newer, strings.Join(set, ", "))
+		}
+	} else if len(set) > 0 {
+		fmt.Fprintf(&b, "WHEN MATCHED%s THEN UPDATE SET %s\n", newer, strings.Join(set, ", "))
+	}
+	fmt.Fprintf(&b, "WHEN NOT MATCHED BY TARGET AND s.%s = 0 THEN INSERT (%s) VALUES (%s);",
+		deleteColumn, strings.Join(insertCols, ", "), strings.Join(insertVals, ", "))
+	return b.String()
+}
+
+// quoteIdent brackets each part of a (possibly schema qualified) name.
+func quoteIdent(name string) string {
+	if strings.HasPrefix(name, "[") {
+		return name
+	}
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = "[" + strings.ReplaceAll(p, "]", "]]") + "]"
+	}
+	return strings.Join(parts, ".")
+}
+
+// truthy reads a deletion flag: booleans, "true"/"1" strings or non zero
+// numbers.
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		b, _ := strconv.ParseBool(t)
+		return b
+	case float64:
+		return t != 0
+	case int:
+		return t != 0
+	case int64:
+		return t != 0
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package sqlserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStageSQL(t *testing.T) {
+	sql := stageSQL("dbo.Orders", []string{"id", "total"})
+	want := "DROP TABLE IF EXISTS #pipeline_stage; " +
+		"SELECT TOP 0 [id], [total], CAST(0 AS INT) AS __seq, CAST(0 AS BIT) AS __deleted INTO #pipeline_stage FROM [dbo].[Orders] " +
+		"UNION ALL SELECT TOP 0 [id], [total], CAST(0 AS INT) AS __seq, CAST(0 AS BIT) AS __deleted FROM [dbo].[Orders]"
+	if sql != want {
+		t.Errorf("unexpected stage SQL:\n%s", sql)
+	}
+}
+
+func TestMergeSQL(t *testing.T) {
+	fields := []FieldMapping{
+		{Source: "OrderID", Target: "order_id"},
+		{Source: "Amount", Target: "total_value"},
+		{Source: "Version", Target: "version"},
+	}
+	cols := []string{"order_id", "total_value", "version"}
+
+	// 1. Plain upsert
+	sql := mergeSQL("dbo.Orders", cols, Config{Fields: fields, KeyColumns: []string{"order_id"}})
+	for _, want := range []string{
+		"MERGE INTO [dbo].[Orders] WITH (HOLDLOCK) AS t",
+		"PARTITION BY [order_id] ORDER BY __seq DESC",
+		"ON t.[order_id] = s.[order_id]",
+		"WHEN MATCHED THEN UPDATE SET t.[total_value] = s.[total_value], t.[version] = s.[version]",
+		"WHEN NOT MATCHED BY TARGET AND s.__deleted = 0 THEN INSERT ([order_id], [total_value], [version]) VALUES (s.[order_id], s.[total_value], s.[version]);",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("expected %q in:\n%s", want, sql)
+		}
+	}
+
+	// 2. Versioned, with hard deletes
+	sql = mergeSQL("Orders", cols, Config{
+		Fields:        fields,
+		KeyColumns:    []string{"order_id"},
+		VersionColumn: "version",
+		DeleteField:   "deleted",
+	})
+	for _, want := range []string{
+		"ORDER BY [version] DESC, __seq DESC",
+		"WHEN MATCHED AND s.__deleted = 1 AND (t.[version] IS NULL OR s.[version] > t.[version]) THEN DELETE",
+		"WHEN MATCHED AND s.__deleted = 0 AND (t.[version] IS NULL OR s.[version] > t.[version]) THEN UPDATE SET",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("expected %q in:\n%s", want, sql)
+		}
+	}
+
+	// 3. Soft deletes only flag the row
+	sql = mergeSQL("Orders", cols, Config{
+		Fields:           fields,
+		KeyColumns:       []string{"order_id"},
+		DeleteField:      "deleted",
+		SoftDeleteColumn: "is_deleted",
+	})
+	for _, want := range []string{
+		"t.[total_value] = CASE WHEN s.__deleted = 1 THEN t.[total_value] ELSE s.[total_value] END",
+		"t.[is_deleted] = s.__deleted",
+		"INSERT ([order_id], [total_value], [version], [is_deleted]) VALUES (s.[order_id], s.[total_value], s.[version], 0)",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("expected %q in:\n%s", want, sql)
+		}
+	}
+	if strings.Contains(sql, "DELETE") {
+		t.Errorf("expected no DELETE with soft deletes:\n%s", sql)
+	}
+}
+
+func TestValidateUpsert(t *testing.T) {
+	fields := []FieldMapping{{Source: "OrderID", Target: "order_id"}}
+	for _, cfg := range []Config{
+		{Fields: fields},
+		{Fields: fields, KeyColumns: []string{"id"}},
+		{Fields: fields, KeyColumns: []string{"order_id"}, VersionColumn: "version"},
+		{Fields: fields, KeyColumns: []string{"order_id"}, SoftDeleteColumn: "is_deleted"},
+	} {
+		if err := validateUpsert(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+	if err := validateUpsert(Config{Fields: fields, KeyColumns: []string{"order_id"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
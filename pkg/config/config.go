@@ -18,6 +18,7 @@ type PipelineConfig struct {
 	WorkerCount  int               `yaml:"worker_count"`
 	BatchSize    int               `yaml:"batch_size"`
 	BatchTimeout time.Duration     `yaml:"batch_timeout"`
+	DeadLetter   *ComponentConfig  `yaml:"dead_letter"` // Optional, for messages the sink rejects
 }
 
 type ComponentConfig struct {
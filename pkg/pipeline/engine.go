@@ -2,12 +2,18 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"sync"
 	"time"
 )
 
+// shutdownFlushTimeout bounds the final sink write when the engine stops,
+// which can no longer use the (already cancelled) run context.
+const shutdownFlushTimeout = 30 * time.Second
+
 type Engine struct {
 	Source       Source
 	Processors   []Processor
@@ -15,6 +21,7 @@ type Engine struct {
 	WorkerCount  int
 	BatchSize    int
 	BatchTimeout time.Duration
+	DeadLetter   DeadLetter // Optional, receives messages the sink rejected or the processors failed on
 }
 
 func NewEngine(source Source, processors []Processor, sink Sink, workerCount int, batchSize int, batchTimeout time.Duration) *Engine {
@@ -38,9 +45,22 @@ func NewEngine(source Source, processors []Processor, sink Sink, workerCount int
 }
 
 func (e *Engine) Run(ctx context.Context) error {
+	for _, p := range e.Processors {
+		if w, ok := p.(WorkerAware); ok {
+			w.SetWorkerCount(e.WorkerCount)
+		}
+	}
+
 	msgChan := make(chan Message, e.WorkerCount*2)
 	processedChan := make(chan Message, e.BatchSize*2)
+	// Messages dropped by the processors, committed with the next batch so
+	// sources tracking contiguous progress don't stall on them
+	skippedChan := make(chan Message, e.BatchSize*2)
+	// Messages the processors failed on, dead-lettered with the next batch and
+	// committed only once the dead letter has them
+	failedChan := make(chan FailedMessage, e.BatchSize*2)
 
+	// wg tracks the reader and the workers, which feed processedChan
 	var wg sync.WaitGroup
 
 	// 1. Source Reader
@@ -54,6 +74,10 @@ func (e *Engine) Run(ctx context.Context) error {
 				return
 			default:
 				msg, err := e.Source.Read(ctx)
+				if errors.Is(err, io.EOF) {
+					log.Println("Source exhausted.")
+					return
+				}
 				if err != nil {
 					log.Printf("Error reading from source: %v", err)
 					// Optional: backoff
@@ -75,83 +99,184 @@ func (e *Engine) Run(ctx context.Context) error {
 		go func(workerID int) {
 			defer wg.Done()
 			for msg := range msgChan {
-				var processErr error
-				for _, p := range e.Processors {
-					msg, processErr = p.Process(msg)
-					if processErr != nil {
-						log.Printf("Worker %d: Error processing message %s: %v", workerID, msg.ID, processErr)
-						break
-					}
+				out, processErr := RunProcessors(e.Processors, msg)
+				if processErr != nil && !errors.Is(processErr, ErrDropMessage) {
+					log.Printf("Worker %d: Error processing message %s: %v", workerID, msg.ID, processErr)
 				}
-				if processErr == nil {
+				// A Splitter may leave some parts valid even when another failed
+				for _, m := range out {
 					select {
-					case processedChan <- msg:
+					case processedChan <- m:
 					case <-ctx.Done():
 						return
 					}
-				} else {
-					// Handle processing error (DLQ, ignore, etc.)
-					// For now, we just drop it, but we should probably commit it as "processed with error"
-					// or send to DLQ to avoid stuck offsets if we were doing strict ordering (which we aren't exactly here)
-					// But since we are doing manual commit of batches, if we drop it, it won't be in the batch to commit.
-					// This might cause re-delivery if we don't commit it.
-					// Ideally, we should add it to a "to commit" list even if failed, or send to DLQ.
-					// For simplicity in this iteration: we drop it.
-					// WARNING: This means the offset for this message might NOT be committed if it was the only one,
-					// or if the commit logic depends on it.
-					// However, Kafka commits are usually "up to offset".
-					// But we are using explicit message commit in the Source implementation.
+				}
+				var partial *PartialProcessError
+				if errors.As(processErr, &partial) {
+					// The failed parts are dead-lettered, the original is committed
+					// with the parts written or once the dead letter has them
+					for _, f := range partial.Failed {
+						select {
+						case failedChan <- f:
+						case <-ctx.Done():
+							return
+						}
+					}
+				} else if len(out) == 0 {
+					// Nothing reaches the sink: commit a dropped message with the
+					// next batch, and dead-letter a failed one first
+					if processErr == nil || errors.Is(processErr, ErrDropMessage) {
+						select {
+						case skippedChan <- msg:
+						case <-ctx.Done():
+							return
+						}
+					} else {
+						select {
+						case failedChan <- FailedMessage{Message: msg, Index: -1, Reason: processErr.Error()}:
+						case <-ctx.Done():
+							return
+						}
+					}
 				}
 			}
 		}(i)
 	}
 
 	// 3. Batcher & Sink Writer
-	wg.Add(1)
+	batcherDone := make(chan struct{})
 	go func() {
-		defer wg.Done()
+		defer close(batcherDone)
 		batch := make([]Message, 0, e.BatchSize)
+		var skipped []Message
+		var failed []FailedMessage
 		ticker := time.NewTicker(e.BatchTimeout)
 		defer ticker.Stop()
 
-		flush := func() {
-			if len(batch) == 0 {
+		// collect gathers messages produced by Emitter processors (e.g. closed
+		// windows) and runs them through the processors that follow the emitter.
+		collect := func(final bool) {
+			for i, p := range e.Processors {
+				em, ok := p.(Emitter)
+				if !ok {
+					continue
+				}
+				for _, msg := range em.Emit(final) {
+					out, err := RunProcessors(e.Processors[i+1:], msg)
+					if err != nil && !errors.Is(err, ErrDropMessage) {
+						log.Printf("Error processing emitted message %s: %v", msg.ID, err)
+					}
+					batch = append(batch, out...)
+				}
+			}
+		}
+
+		flush := func(ctx context.Context) {
+			if len(batch) == 0 && len(skipped) == 0 && len(failed) == 0 {
 				return
 			}
+			dead := make([]Message, len(failed))
+			for i, f := range failed {
+				dead[i] = f.Message
+			}
 			// Write Batch
-			if err := e.Sink.WriteBatch(ctx, batch); err != nil {
+			written := batch
+			var err error
+			if len(batch) > 0 {
+				err = e.Sink.WriteBatch(ctx, batch)
+			}
+			var partial *PartialWriteError
+			if errors.As(err, &partial) {
+				// Rejected messages are dead-lettered, the rest of the batch was written
+				if err = e.deadLetter(ctx, partial.Failed); err == nil {
+					written = withoutFailed(batch, partial.Failed)
+					rejected := make([]Message, len(partial.Failed))
+					for i, f := range partial.Failed {
+						rejected[i] = f.Message
+					}
+					e.notifyFailed(rejected)
+				}
+			}
+			if err != nil {
 				log.Printf("Error writing batch to sink: %v", err)
+				e.notifyFailed(append(batch, dead...))
 				// ROLLBACK LOGIC: We do NOT commit.
 				// Kafka will eventually re-deliver these messages when the consumer group rebalances or restarts.
 				// In a real-world scenario, we might want to retry with backoff here before giving up.
 			} else {
-				// Commit Batch
-				if err := e.Source.Commit(ctx, batch); err != nil {
+				for _, p := range e.Processors {
+					if o, ok := p.(WriteObserver); ok {
+						o.OnBatchWritten(written)
+					}
+				}
+				// Failed messages are committed only if the dead letter took them,
+				// otherwise they are redelivered like an unwritten batch
+				if len(failed) > 0 {
+					if err := e.deadLetter(ctx, failed); err != nil {
+						log.Printf("Error dead-lettering failed messages: %v", err)
+					} else {
+						e.notifyFailed(dead)
+						skipped = append(skipped, dead...)
+					}
+				}
+				// Commit Batch, along with the messages that were skipped
+				if err := e.Source.Commit(ctx, append(batch, skipped...)); err != nil {
 					log.Printf("Error committing batch to source: %v", err)
+				} else if len(skipped) > 0 {
+					log.Printf("Batch of %d messages processed and committed (%d skipped).", len(batch), len(skipped))
 				} else {
 					log.Printf("Batch of %d messages processed and committed.", len(batch))
 				}
 			}
 			// Reset batch
 			batch = make([]Message, 0, e.BatchSize)
+			skipped = nil
+			failed = nil
+		}
+
+		// finalFlush emits pending processor state and writes the last batch
+		// with a fresh context, since the run context is already cancelled.
+		finalFlush := func() {
+			collect(true)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+			defer cancel()
+			flush(shutdownCtx)
 		}
 
 		for {
 			select {
 			case <-ctx.Done():
-				flush()
+				finalFlush()
 				return
 			case msg, ok := <-processedChan:
 				if !ok {
-					flush()
+					// The workers are done, so every skipped message was sent
+					for len(skippedChan) > 0 {
+						skipped = append(skipped, <-skippedChan)
+					}
+					for len(failedChan) > 0 {
+						failed = append(failed, <-failedChan)
+					}
+					finalFlush()
 					return
 				}
 				batch = append(batch, msg)
 				if len(batch) >= e.BatchSize {
-					flush()
+					flush(ctx)
+				}
+			case msg := <-skippedChan:
+				skipped = append(skipped, msg)
+				if len(skipped)+len(failed) >= e.BatchSize {
+					flush(ctx)
+				}
+			case f := <-failedChan:
+				failed = append(failed, f)
+				if len(skipped)+len(failed) >= e.BatchSize {
+					flush(ctx)
 				}
 			case <-ticker.C:
-				flush()
+				collect(false)
+				flush(ctx)
 			}
 		}
 	}()
@@ -163,11 +288,105 @@ func (e *Engine) Run(ctx context.Context) error {
 		close(processedChan)
 	}()
 
-	// Block until context is done
-	<-ctx.Done()
+	// Block until the context is done or the source is exhausted, and the
+	// final batch was written
+	<-batcherDone
 	return nil
 }
 
+// RunProcessors applies procs in order, stopping at the first error. When a
+// Splitter fans a message out, every part runs through the remaining
+// processors; parts that succeed are returned along with a
+// PartialProcessError holding those that failed. Composite processors use it
+// to run their nested chains.
+func RunProcessors(procs []Processor, msg Message) ([]Message, error) {
+	for i, p := range procs {
+		if s, ok := p.(Splitter); ok {
+			var failed []FailedMessage
+			parts, err := s.ProcessMulti(msg)
+			if err != nil {
+				failed, err = splitFailures(msg, err)
+				if err != nil {
+					return nil, err
+				}
+			}
+			var out []Message
+			for _, part := range parts {
+				res, err := RunProcessors(procs[i+1:], part)
+				if err != nil && !errors.Is(err, ErrDropMessage) {
+					f, _ := splitFailures(part, err)
+					failed = append(failed, f...)
+				}
+				out = append(out, res...)
+			}
+			if len(failed) > 0 {
+				return out, &PartialProcessError{Failed: failed}
+			}
+			return out, nil
+		}
+
+		var err error
+		if msg, err = p.Process(msg); err != nil {
+			return nil, err
+		}
+	}
+	return []Message{msg}, nil
+}
+
+// splitFailures returns the failed parts of a split message: those of a
+// PartialProcessError, or part itself for any other error. Without a
+// PartialProcessError err is also returned, for callers that stop on it.
+func splitFailures(part Message, err error) ([]FailedMessage, error) {
+	var partial *PartialProcessError
+	if errors.As(err, &partial) {
+		return partial.Failed, nil
+	}
+	return []FailedMessage{{Message: part, Index: -1, Reason: err.Error()}}, err
+}
+
+// deadLetter hands messages the sink rejected or the processors failed on to
+// the DeadLetter, or logs them when none is configured.
+func (e *Engine) deadLetter(ctx context.Context, failed []FailedMessage) error {
+	if e.DeadLetter == nil {
+		for _, f := range failed {
+			log.Printf("Message %s failed, dropping it: %s", f.Message.ID, f.Reason)
+		}
+		return nil
+	}
+	if err := e.DeadLetter.WriteFailed(ctx, failed); err != nil {
+		return fmt.Errorf("failed to dead-letter %d messages: %w", len(failed), err)
+	}
+	log.Printf("%d failed messages sent to dead letter.", len(failed))
+	return nil
+}
+
+// notifyFailed tells the FailureObserver processors that msgs were not written.
+func (e *Engine) notifyFailed(msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	for _, p := range e.Processors {
+		if o, ok := p.(FailureObserver); ok {
+			o.OnBatchFailed(msgs)
+		}
+	}
+}
+
+// withoutFailed returns the messages of batch that are not in failed.
+func withoutFailed(batch []Message, failed []FailedMessage) []Message {
+	rejected := make(map[int]bool, len(failed))
+	for _, f := range failed {
+		rejected[f.Index] = true
+	}
+	out := make([]Message, 0, len(batch)-len(failed))
+	for i, msg := range batch {
+		if !rejected[i] {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
 func (e *Engine) Close() error {
 	if err := e.Source.Close(); err != nil {
 		return fmt.Errorf("failed to close source: %w", err)
@@ -175,5 +394,17 @@ func (e *Engine) Close() error {
 	if err := e.Sink.Close(); err != nil {
 		return fmt.Errorf("failed to close sink: %w", err)
 	}
+	if e.DeadLetter != nil {
+		if err := e.DeadLetter.Close(); err != nil {
+			return fmt.Errorf("failed to close dead letter: %w", err)
+		}
+	}
+	for _, p := range e.Processors {
+		if c, ok := p.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return fmt.Errorf("failed to close processor: %w", err)
+			}
+		}
+	}
 	return nil
 }
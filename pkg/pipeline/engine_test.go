@@ -0,0 +1,302 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sliceSource returns its messages in order and then io.EOF.
+type sliceSource struct {
+	mu        sync.Mutex
+	msgs      []Message
+	committed []Message
+}
+
+func (s *sliceSource) Read(ctx context.Context) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.msgs) == 0 {
+		return Message{}, io.EOF
+	}
+	msg := s.msgs[0]
+	s.msgs = s.msgs[1:]
+	return msg, nil
+}
+
+func (s *sliceSource) Commit(ctx context.Context, msgs []Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed = append(s.committed, msgs...)
+	return nil
+}
+
+func (s *sliceSource) Close() error { return nil }
+
+// batchSink records every batch written to it.
+type batchSink struct {
+	mu      sync.Mutex
+	batches [][]Message
+}
+
+func (s *batchSink) Write(ctx context.Context, msg Message) error {
+	return s.WriteBatch(ctx, []Message{msg})
+}
+
+func (s *batchSink) WriteBatch(ctx context.Context, msgs []Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]Message(nil), msgs...))
+	return nil
+}
+
+func (s *batchSink) Close() error { return nil }
+
+// countEmitter passes messages through and emits their count on shutdown,
+// tagged like the aggregate processor tags its windows.
+type countEmitter struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *countEmitter) Process(msg Message) (Message, error) {
+	c.mu.Lock()
+	c.count++
+	c.mu.Unlock()
+	return msg, nil
+}
+
+func (c *countEmitter) Emit(final bool) []Message {
+	if !final {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []Message{{
+		ID:       "window",
+		Data:     map[string]interface{}{"count": c.count},
+		Metadata: map[string]string{"aggregate": "true"},
+	}}
+}
+
+// markProcessor sets Data["seen"], to check what runs after the emitter.
+type markProcessor struct{}
+
+func (markProcessor) Process(msg Message) (Message, error) {
+	msg.Data["seen"] = true
+	return msg, nil
+}
+
+func TestEngineEmittedMessagesShareTheBatch(t *testing.T) {
+	source := &sliceSource{}
+	for _, id := range []string{"a", "b", "c"} {
+		source.msgs = append(source.msgs, Message{ID: id, Data: map[string]interface{}{}, Metadata: map[string]string{}})
+	}
+	sink := &batchSink{}
+	engine := NewEngine(source, []Processor{&countEmitter{}, markProcessor{}}, sink, 2, 100, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := engine.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 4 {
+		t.Fatalf("expected one batch with 3 inputs and 1 window, got %v", sink.batches)
+	}
+	var raw, windows int
+	for _, msg := range sink.batches[0] {
+		if msg.Data["seen"] != true {
+			t.Errorf("expected processors after the emitter to run on %s", msg.ID)
+		}
+		if msg.Metadata["aggregate"] == "true" {
+			windows++
+			if msg.Data["count"] != 3 {
+				t.Errorf("expected a count of 3, got %v", msg.Data["count"])
+			}
+		} else {
+			raw++
+		}
+	}
+	if raw != 3 || windows != 1 {
+		t.Errorf("expected 3 inputs and 1 tagged window, got %d and %d", raw, windows)
+	}
+	if len(source.committed) != 4 {
+		t.Errorf("expected the batch to be committed, got %d messages", len(source.committed))
+	}
+}
+
+// failProcessor drops messages with ID "drop" and fails those with ID "fail".
+type failProcessor struct{}
+
+func (failProcessor) Process(msg Message) (Message, error) {
+	switch msg.ID {
+	case "drop":
+		return msg, ErrDropMessage
+	case "fail":
+		return msg, errors.New("bad message")
+	}
+	return msg, nil
+}
+
+// memoryDeadLetter records what it receives, or returns err.
+type memoryDeadLetter struct {
+	mu     sync.Mutex
+	failed []FailedMessage
+	err    error
+}
+
+func (d *memoryDeadLetter) WriteFailed(ctx context.Context, failed []FailedMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.failed = append(d.failed, failed...)
+	return nil
+}
+
+func (d *memoryDeadLetter) Close() error { return nil }
+
+func TestEngineFailedMessagesAreDeadLettered(t *testing.T) {
+	run := func(dl *memoryDeadLetter) []string {
+		source := &sliceSource{}
+		for _, id := range []string{"ok", "drop", "fail"} {
+			source.msgs = append(source.msgs, Message{ID: id, Data: map[string]interface{}{}})
+		}
+		engine := NewEngine(source, []Processor{failProcessor{}}, &batchSink{}, 1, 100, time.Hour)
+		engine.DeadLetter = dl
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := engine.Run(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var ids []string
+		for _, msg := range source.committed {
+			ids = append(ids, msg.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	dl := &memoryDeadLetter{}
+	if ids := run(dl); !reflect.DeepEqual(ids, []string{"drop", "fail", "ok"}) {
+		t.Errorf("expected every message committed, got %v", ids)
+	}
+	if len(dl.failed) != 1 || dl.failed[0].Message.ID != "fail" || dl.failed[0].Reason != "bad message" {
+		t.Errorf("expected the failed message dead-lettered, got %+v", dl.failed)
+	}
+
+	// A failed message the dead letter didn't take is left for redelivery
+	if ids := run(&memoryDeadLetter{err: errors.New("unavailable")}); !reflect.DeepEqual(ids, []string{"drop", "ok"}) {
+		t.Errorf("expected the failed message not committed, got %v", ids)
+	}
+}
+
+// rejectSink rejects the messages with ID "bad" and records the rest.
+type rejectSink struct{ batchSink }
+
+func (s *rejectSink) WriteBatch(ctx context.Context, msgs []Message) error {
+	var failed []FailedMessage
+	for i, msg := range msgs {
+		if msg.ID == "bad" {
+			failed = append(failed, FailedMessage{Message: msg, Index: i, Reason: "rejected"})
+		}
+	}
+	s.batchSink.WriteBatch(ctx, msgs)
+	if len(failed) > 0 {
+		return &PartialWriteError{Failed: failed}
+	}
+	return nil
+}
+
+func TestRouterSink(t *testing.T) {
+	windows, raw := &batchSink{}, &rejectSink{}
+	router, err := NewRouterSink("aggregate", map[string]Sink{"true": windows}, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msgs := []Message{
+		{ID: "a"},
+		{ID: "w1", Metadata: map[string]string{"aggregate": "true"}},
+		{ID: "bad"},
+		{ID: "w2", Metadata: map[string]string{"aggregate": "true"}},
+	}
+	err = router.WriteBatch(context.Background(), msgs)
+
+	ids := func(batches [][]Message) []string {
+		var ids []string
+		for _, b := range batches {
+			for _, msg := range b {
+				ids = append(ids, msg.ID)
+			}
+		}
+		return ids
+	}
+	if got := ids(windows.batches); !reflect.DeepEqual(got, []string{"w1", "w2"}) {
+		t.Errorf("expected the windows routed together, got %v", got)
+	}
+	if got := ids(raw.batches); !reflect.DeepEqual(got, []string{"a", "bad"}) {
+		t.Errorf("expected the rest in the default sink, got %v", got)
+	}
+	// Rejections are reported at their index in the whole batch
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Index != 2 {
+		t.Fatalf("expected the rejected message at index 2, got %v", err)
+	}
+
+	// Without a default sink, unrouted messages are rejected
+	router.Default = nil
+	err = router.WriteBatch(context.Background(), msgs[:2])
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Message.ID != "a" {
+		t.Errorf("expected the unrouted message rejected, got %v", err)
+	}
+}
+
+// splitProcessor splits a message into one part per ID in Data["parts"].
+type splitProcessor struct{}
+
+func (splitProcessor) Process(msg Message) (Message, error) { return msg, nil }
+
+func (splitProcessor) ProcessMulti(msg Message) ([]Message, error) {
+	var parts []Message
+	for _, id := range msg.Data["parts"].([]string) {
+		parts = append(parts, Message{ID: id, Data: map[string]interface{}{}, OriginalMessage: msg.ID})
+	}
+	return parts, nil
+}
+
+func TestEngineFailedPartsAreDeadLettered(t *testing.T) {
+	source := &sliceSource{msgs: []Message{
+		{ID: "orig", Data: map[string]interface{}{"parts": []string{"ok", "fail", "drop"}}},
+	}}
+	sink := &batchSink{}
+	dl := &memoryDeadLetter{}
+	engine := NewEngine(source, []Processor{splitProcessor{}, failProcessor{}}, sink, 1, 100, time.Hour)
+	engine.DeadLetter = dl
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := engine.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 1 || sink.batches[0][0].ID != "ok" {
+		t.Errorf("expected only the valid part written, got %v", sink.batches)
+	}
+	if len(dl.failed) != 1 || dl.failed[0].Message.ID != "fail" || dl.failed[0].Reason != "bad message" {
+		t.Errorf("expected the failed part dead-lettered, got %+v", dl.failed)
+	}
+	var ids []string
+	for _, msg := range source.committed {
+		ids = append(ids, msg.ID)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"fail", "ok"}) {
+		t.Errorf("expected the written and dead-lettered parts committed, got %v", ids)
+	}
+}
@@ -2,6 +2,8 @@ package pipeline
 
 import (
 	"context"
+	"errors"
+	"fmt"
 )
 
 // Message represents the data flowing through the pipeline.
@@ -12,7 +14,9 @@ type Message struct {
 	OriginalMessage interface{} // Holds the original message object (e.g., kafka.Message) for committing
 }
 
-// Source reads data from an external system.
+// Source reads data from an external system. Finite sources (e.g. a
+// reindex) return io.EOF from Read once exhausted: the Engine then writes
+// what is in flight and Run returns.
 type Source interface {
 	Read(ctx context.Context) (Message, error)
 	Commit(ctx context.Context, msgs []Message) error
@@ -20,13 +24,106 @@ type Source interface {
 }
 
 // Processor transforms, filters, or enriches data.
+// Processors holding resources (connections, goroutines) may also implement
+// io.Closer; the Engine closes them on shutdown.
 type Processor interface {
 	Process(msg Message) (Message, error)
 }
 
+// Splitter is implemented by processors that may turn one message into
+// several (or none). The Engine calls ProcessMulti instead of Process and runs
+// each resulting message through the rest of the chain.
+type Splitter interface {
+	ProcessMulti(msg Message) ([]Message, error)
+}
+
+// WriteObserver is implemented by processors that must know which messages
+// reached the sink, e.g. to remember them only once they are durable. The
+// Engine calls OnBatchWritten after every successful Sink.WriteBatch.
+type WriteObserver interface {
+	OnBatchWritten(msgs []Message)
+}
+
+// FailureObserver is implemented by processors that hold state for messages
+// until they are written, to release it when they won't be. The Engine calls
+// OnBatchFailed with the messages of a failed Sink.WriteBatch (they will be
+// redelivered) and with the messages it dead-lettered.
+type FailureObserver interface {
+	OnBatchFailed(msgs []Message)
+}
+
+// Emitter is implemented by processors that produce messages of their own,
+// outside the flow of Process (e.g. window aggregations). The Engine polls
+// Emit on every batch tick and once more with final set on shutdown, when all
+// pending state must be returned. Emitted messages go through the processors
+// that follow the emitter and then join the current batch; emitters tag them
+// in Metadata so later processors, or a RouterSink, can tell them apart.
+type Emitter interface {
+	Emit(final bool) []Message
+}
+
+// WorkerAware is implemented by processors that keep a pool of per-call
+// resources, such as interpreter threads or module instances. The Engine
+// calls SetWorkerCount with its WorkerCount before starting the workers, so
+// the pool is sized to the callers it will have.
+type WorkerAware interface {
+	SetWorkerCount(n int)
+}
+
+// ErrDropMessage is returned (possibly wrapped) by a Processor to discard a
+// message on purpose. The Engine drops it without reporting an error.
+var ErrDropMessage = errors.New("message dropped")
+
 // Sink writes data to an external system.
 type Sink interface {
 	Write(ctx context.Context, msg Message) error
 	WriteBatch(ctx context.Context, msgs []Message) error
 	Close() error
 }
+
+// FailedMessage is a message a sink rejected permanently, with the reason
+// given by the destination, or one the processors failed on. Index is its
+// position in the written batch, -1 for processor failures.
+type FailedMessage struct {
+	Message Message
+	Index   int
+	Reason  string
+}
+
+// PartialWriteError is returned by Sink.WriteBatch when the rest of the batch
+// was written but some messages were rejected permanently (retrying cannot
+// help, e.g. a mapping conflict). The Engine hands Failed to its DeadLetter
+// and commits the batch, so a bad message doesn't block the ones after it.
+type PartialWriteError struct {
+	Failed []FailedMessage
+}
+
+func (e *PartialWriteError) Error() string {
+	if len(e.Failed) == 0 {
+		return "no messages rejected"
+	}
+	return fmt.Sprintf("%d messages rejected, first: %s", len(e.Failed), e.Failed[0].Reason)
+}
+
+// PartialProcessError is returned by RunProcessors when a Splitter fanned a
+// message out and some of the parts failed further down the chain. The parts
+// that succeeded are returned along with it; the Engine dead-letters Failed
+// like messages the processors failed on as a whole.
+type PartialProcessError struct {
+	Failed []FailedMessage
+}
+
+func (e *PartialProcessError) Error() string {
+	if len(e.Failed) == 0 {
+		return "no split messages failed"
+	}
+	return fmt.Sprintf("%d split messages failed, first: %s", len(e.Failed), e.Failed[0].Reason)
+}
+
+// DeadLetter stores messages that a sink rejected permanently or that the
+// processors failed on, for later inspection or replay. The Engine commits
+// them only once WriteFailed succeeds.
+type DeadLetter interface {
+	WriteFailed(ctx context.Context, failed []FailedMessage) error
+	Close() error
+}
@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GetValue retrieves a value from a nested map using dot notation, or nil
+// when the path doesn't exist. Flattened documents keep dotted paths as
+// literal keys, so a literal key equal to path wins over the nested walk.
+func GetValue(data map[string]interface{}, path string) interface{} {
+	if val, exists := data[path]; exists {
+		return val
+	}
+	var current interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if current, ok = m[key]; !ok {
+			return nil
+		}
+	}
+	return current
+}
+
+// Placeholder matches the ${ref} references of a template.
+var Placeholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// LookupRef resolves a reference against a message, or returns nil when it
+// doesn't exist. "Metadata.key" (or "@metadata.key") reads Metadata, "ID" is
+// the message ID and "Data.path" reads Data. A bare path reads Data and then
+// Metadata, so "${topic}" resolves the Kafka topic.
+func LookupRef(msg Message, ref string) interface{} {
+	ref = strings.TrimSpace(ref)
+	for _, prefix := range []string{"Metadata.", "@metadata."} {
+		if key, ok := strings.CutPrefix(ref, prefix); ok {
+			if v, exists := msg.Metadata[key]; exists {
+				return v
+			}
+			return nil
+		}
+	}
+	if ref == "ID" {
+		if msg.ID == "" {
+			return nil
+		}
+		return msg.ID
+	}
+	path, explicit := strings.CutPrefix(ref, "Data.")
+	if v := GetValue(msg.Data, path); v != nil {
+		return v
+	}
+	if !explicit {
+		if v, exists := msg.Metadata[ref]; exists {
+			return v
+		}
+	}
+	return nil
+}
+
+// Interpolate replaces every ${ref} in tmpl with the text of its value (see
+// ValueText). Missing references become empty strings and make ok false.
+func Interpolate(tmpl string, msg Message) (string, bool) {
+	ok := true
+	out := Placeholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		v := LookupRef(msg, m[2:len(m)-1])
+		if v == nil {
+			ok = false
+			return ""
+		}
+		return ValueText(v)
+	})
+	return out, ok
+}
+
+// ValueText renders a scalar as text. Numbers decoded from JSON are float64,
+// so they are written without exponent: 4111111111111111, not
+// 4.111111111111111e+15.
+func ValueText(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32)
+	}
+	return fmt.Sprint(v)
+}
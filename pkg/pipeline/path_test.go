@@ -0,0 +1,34 @@
+package pipeline
+
+import "testing"
+
+func TestInterpolate(t *testing.T) {
+	msg := Message{
+		ID: "k1",
+		Data: map[string]interface{}{
+			"id":    1500000.0,
+			"topic": "from-data",
+			"order": map[string]interface{}{"country": "BR"},
+		},
+		Metadata: map[string]string{"topic": "orders", "offset": "42"},
+	}
+	for tmpl, want := range map[string]string{
+		"order-${id}":                     "order-1500000",
+		"${Metadata.topic}-${offset}":     "orders-42",
+		"${topic}/${Data.order.country}":  "from-data/BR",
+		"${@metadata.offset}:${ ID }":     "42:k1",
+		"orders-${order.country}-archive": "orders-BR-archive",
+	} {
+		if got, ok := Interpolate(tmpl, msg); !ok || got != want {
+			t.Errorf("%s: expected %q, got %q (%v)", tmpl, want, got, ok)
+		}
+	}
+
+	// Explicit Data references don't fall back to Metadata
+	if got, ok := Interpolate("${Data.offset}-${missing}", msg); ok || got != "-" {
+		t.Errorf("expected missing references, got %q (%v)", got, ok)
+	}
+	if v := LookupRef(Message{}, "ID"); v != nil {
+		t.Errorf("expected an empty ID to be missing, got %v", v)
+	}
+}
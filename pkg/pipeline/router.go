@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// RouterSink writes each message to the sink routed by its Metadata[Key]
+// value, or to Default. It lets one pipeline write messages of different
+// shapes to different destinations, e.g. the windows of an aggregate
+// processor (Metadata["aggregate"] = "true") to their own table next to the
+// raw messages.
+//
+// Messages without a route are rejected as a PartialWriteError, so the Engine
+// dead-letters them. If a sink fails the whole batch fails and is
+// redelivered, including to the sinks that had already written their part.
+type RouterSink struct {
+	Key     string
+	Routes  map[string]Sink
+	Default Sink // Optional
+}
+
+func NewRouterSink(key string, routes map[string]Sink, def Sink) (*RouterSink, error) {
+	if key == "" {
+		return nil, fmt.Errorf("router sink requires a key")
+	}
+	if len(routes) == 0 && def == nil {
+		return nil, fmt.Errorf("router sink requires routes or a default sink")
+	}
+	return &RouterSink{Key: key, Routes: routes, Default: def}, nil
+}
+
+func (r *RouterSink) route(msg Message) Sink {
+	if s, ok := r.Routes[msg.Metadata[r.Key]]; ok {
+		return s
+	}
+	return r.Default
+}
+
+func (r *RouterSink) Write(ctx context.Context, msg Message) error {
+	return r.WriteBatch(ctx, []Message{msg})
+}
+
+func (r *RouterSink) WriteBatch(ctx context.Context, msgs []Message) error {
+	// Split the batch by sink, keeping the order of the messages and their
+	// index in msgs to report rejections against the whole batch
+	type part struct {
+		msgs    []Message
+		indexes []int
+	}
+	parts := make(map[Sink]*part)
+	var order []Sink
+	var failed []FailedMessage
+	for i, msg := range msgs {
+		s := r.route(msg)
+		if s == nil {
+			failed = append(failed, FailedMessage{
+				Message: msg,
+				Index:   i,
+				Reason:  fmt.Sprintf("no sink for %s %q", r.Key, msg.Metadata[r.Key]),
+			})
+			continue
+		}
+		p, ok := parts[s]
+		if !ok {
+			p = &part{}
+			parts[s] = p
+			order = append(order, s)
+		}
+		p.msgs = append(p.msgs, msg)
+		p.indexes = append(p.indexes, i)
+	}
+
+	for _, s := range order {
+		p := parts[s]
+		err := s.WriteBatch(ctx, p.msgs)
+		var partial *PartialWriteError
+		if errors.As(err, &partial) {
+			for _, f := range partial.Failed {
+				f.Index = p.indexes[f.Index]
+				failed = append(failed, f)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+		return &PartialWriteError{Failed: failed}
+	}
+	return nil
+}
+
+// Close closes every sink once, even when routed from several values.
+func (r *RouterSink) Close() error {
+	closed := make(map[Sink]bool)
+	var firstErr error
+	closeSink := func(s Sink) {
+		if s == nil || closed[s] {
+			return
+		}
+		closed[s] = true
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, s := range r.Routes {
+		closeSink(s)
+	}
+	closeSink(r.Default)
+	return firstErr
+}
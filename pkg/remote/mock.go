@@ -0,0 +1,61 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// MockHandler is a reference implementation of the protocol, used by tests
+// and by cmd/remote-mock. For every message it returns:
+//   - {"drop": true} when data has "_mock_drop": true
+//   - {"error": <value>} when data has a "_mock_error" string
+//   - otherwise {"mock_fields": [sorted data keys], "mock_id": <message id>}
+func MockHandler(_ context.Context, req *Request) (*Response, error) {
+	resp := &Response{Results: make([]Result, len(req.Messages))}
+	for i, msg := range req.Messages {
+		if drop, _ := msg.Data["_mock_drop"].(bool); drop {
+			resp.Results[i] = Result{Drop: true}
+			continue
+		}
+		if e, ok := msg.Data["_mock_error"].(string); ok {
+			resp.Results[i] = Result{Error: e}
+			continue
+		}
+		fields := make([]string, 0, len(msg.Data))
+		for k := range msg.Data {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+		resp.Results[i] = Result{Data: map[string]interface{}{
+			"mock_fields": fields,
+			"mock_id":     msg.ID,
+		}}
+	}
+	return resp, nil
+}
+
+// Counting wraps h and reports every request's size to observe, e.g. to
+// check micro-batching in tests.
+func Counting(h HandlerFunc, observe func(n int)) HandlerFunc {
+	return func(ctx context.Context, req *Request) (*Response, error) {
+		observe(len(req.Messages))
+		return h(ctx, req)
+	}
+}
+
+// Failing wraps h so the first n requests fail, e.g. to exercise retries.
+func Failing(h HandlerFunc, n int) HandlerFunc {
+	calls := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		calls <- struct{}{}
+	}
+	return func(ctx context.Context, req *Request) (*Response, error) {
+		select {
+		case <-calls:
+			return nil, fmt.Errorf("mock failure")
+		default:
+			return h(ctx, req)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package remote defines the sidecar protocol spoken by the remote processor,
+// plus helpers to serve it over HTTP or gRPC, so external services (and
+// tests) can implement it without depending on the pipeline.
+//
+// A request carries one or more messages and the response must carry one
+// result per message, in the same order:
+//
+//	{"messages": [{"id": "...", "data": {...}, "metadata": {...}}]}
+//	{"results":  [{"data": {...}}, {"drop": true}, {"error": "..."}]}
+//
+// Over HTTP the request is POSTed as JSON. Over gRPC the same JSON documents
+// are exchanged by the unary method GRPCMethod using Codec (content-type
+// application/grpc+refinery-json), so no .proto files are needed.
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	GRPCService = "refinery.remote.v1.Processor"
+	GRPCMethod  = "/" + GRPCService + "/Process"
+)
+
+type Message struct {
+	ID       string                 `json:"id"`
+	Data     map[string]interface{} `json:"data"`
+	Metadata map[string]string      `json:"metadata,omitempty"`
+}
+
+type Request struct {
+	Messages []Message `json:"messages"`
+}
+
+// Result is the outcome for one message: Data is merged into the message,
+// Drop discards it and Error fails it.
+type Result struct {
+	Data  map[string]interface{} `json:"data,omitempty"`
+	Drop  bool                   `json:"drop,omitempty"`
+	Error string                 `json:"error,omitempty"`
+}
+
+type Response struct {
+	Results []Result `json:"results"`
+}
+
+// HandlerFunc processes a request, for either transport.
+type HandlerFunc func(ctx context.Context, req *Request) (*Response, error)
+
+// CodecName names Codec. It is specific to this protocol so registering it
+// doesn't replace a "json" codec other services of the process rely on.
+const CodecName = "refinery-json"
+
+// Codec is the gRPC codec used by both ends of the protocol. Clients force it
+// per call; servers look it up in the registry by the request content-type.
+type Codec struct{}
+
+func (Codec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (Codec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (Codec) Name() string                               { return CodecName }
+
+func init() {
+	encoding.RegisterCodec(Codec{})
+}
+
+// NewHTTPHandler serves h at any path that receives a POST.
+func NewHTTPHandler(h HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := h(r.Context(), &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("remote: failed to write response: %v", err)
+		}
+	})
+}
+
+// RegisterGRPC registers h as the GRPCMethod handler on s.
+func RegisterGRPC(s *grpc.Server, h HandlerFunc) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: GRPCService,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Process",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req Request
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return h(ctx, &req)
+			},
+		}},
+	}, nil)
+}